@@ -195,36 +195,43 @@ func GenerateToken(id int64) (string, int64, error) {
 	return token, exp, err
 }
 
+// 生成设备访问令牌, 仅可用于连接指定设备
+func GenerateDeviceToken(uid int64, natId string, version int64) (string, int64, error) {
+	secret := util.GetString(tokenKey)
+	expTime := util.GetInt("token.deviceExp")
+	if expTime <= 0 {
+		expTime = 720
+	}
+	exp := time.Now().Add(time.Hour * time.Duration(expTime)).Unix()
+	tc := jwt.NewWithClaims(jwt.SigningMethodHS256,
+		jwt.MapClaims{
+			"exp":   exp,
+			"iss":   IssuerName,
+			"sub":   fmt.Sprintf("%v", uid),
+			"scope": "nat",
+			"nat":   natId,
+			"ver":   version,
+		},
+	)
+	key, _ := base64.StdEncoding.DecodeString(secret)
+	token, err := tc.SignedString(key)
+	return token, exp, err
+}
+
 func AuthHandler() gin.HandlerFunc {
 	return func(ctx *gin.Context) {
-		code := ctx.Request.Header.Get("Authorization")
+		code := requestToken(ctx)
 		if code == "" {
 			util.ReturnError(ctx, util.Errors.NotLoginError)
 			return
 		}
-		if strings.Contains(code, " ") {
-			code = code[strings.Index(code, " ")+1:]
-		}
-		info := jwt.MapClaims{}
-		secret := util.GetString(tokenKey)
-		token, err := jwt.ParseWithClaims(code, &info, func(token *jwt.Token) (interface{}, error) {
-			key, err := base64.StdEncoding.DecodeString(secret)
-			return key, err
-		})
-		if err != nil {
-			util.ReturnError(ctx, util.Errors.TokenNotAvailableError)
-			return
-		}
-		if !token.Valid {
-			util.ReturnError(ctx, util.Errors.TokenInvalidError)
+		info, cerr := verifyToken(code)
+		if cerr != nil {
+			util.ReturnError(ctx, *cerr)
 			return
 		}
-		iss, err := info.GetIssuer()
-		if err != nil {
-			util.ReturnError(ctx, util.Errors.TokenNotAvailableError)
-			return
-		}
-		if iss != IssuerName {
+		// 设备访问令牌不可用于接口
+		if _, scoped := info["scope"]; scoped {
 			util.ReturnError(ctx, util.Errors.TokenIllegalError)
 			return
 		}
@@ -236,3 +243,39 @@ func AuthHandler() gin.HandlerFunc {
 		ctx.Set("uid", sub)
 	}
 }
+
+// 校验令牌, 返回令牌声明
+func verifyToken(code string) (jwt.MapClaims, *util.CustomError) {
+	info := jwt.MapClaims{}
+	secret := util.GetString(tokenKey)
+	token, err := jwt.ParseWithClaims(code, &info, func(token *jwt.Token) (interface{}, error) {
+		key, err := base64.StdEncoding.DecodeString(secret)
+		return key, err
+	})
+	if err != nil {
+		return nil, &util.Errors.TokenNotAvailableError
+	}
+	if !token.Valid {
+		return nil, &util.Errors.TokenInvalidError
+	}
+	iss, err := info.GetIssuer()
+	if err != nil {
+		return nil, &util.Errors.TokenNotAvailableError
+	}
+	if iss != IssuerName {
+		return nil, &util.Errors.TokenIllegalError
+	}
+	return info, nil
+}
+
+// [工具] 获取请求携带的令牌, 请求头优先, WebSocket 等无法设置请求头时使用 token 参数
+func requestToken(ctx *gin.Context) string {
+	code := ctx.Request.Header.Get("Authorization")
+	if code == "" {
+		code = ctx.Query("token")
+	}
+	if strings.Contains(code, " ") {
+		code = code[strings.Index(code, " ")+1:]
+	}
+	return code
+}
@@ -0,0 +1,179 @@
+package core
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/skye-z/ons/cloud-server/model"
+	"github.com/spf13/viper"
+	"xorm.io/xorm"
+)
+
+// [工具] 设置令牌密钥
+func useTokenSecret(t *testing.T) []byte {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	viper.Set(tokenKey, base64.StdEncoding.EncodeToString(key))
+	viper.Set("token.exp", 1)
+	t.Cleanup(func() {
+		viper.Set(tokenKey, "")
+		viper.Set("token.exp", 0)
+	})
+	return key
+}
+
+// [工具] 以任意声明签发令牌
+func signClaims(t *testing.T, key []byte, claims jwt.MapClaims) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// [工具] 签发未签名的令牌
+func signNone(t *testing.T, claims jwt.MapClaims) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodNone, claims).SignedString(jwt.UnsafeAllowNoneSignatureType)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+// [工具] 创建临时数据库
+func testEngine(t *testing.T) *xorm.Engine {
+	engine, err := xorm.NewEngine("sqlite", filepath.Join(t.TempDir(), "test.store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { engine.Close() })
+	if err := engine.Sync2(new(model.User), new(model.Device), new(model.DeviceMember)); err != nil {
+		t.Fatal(err)
+	}
+	return engine
+}
+
+// [工具] 以令牌请求受保护的接口, 返回错误码与用户编号
+func callAuthHandler(token string) (int, string) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(http.MethodGet, "/api/device/list", nil)
+	if token != "" {
+		ctx.Request.Header.Set("Authorization", "Bearer "+token)
+	}
+	AuthHandler()(ctx)
+	if !ctx.IsAborted() {
+		return 0, ctx.GetString("uid")
+	}
+	var body struct {
+		Code int `json:"code"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	return body.Code, ""
+}
+
+func TestAuthHandlerScope(t *testing.T) {
+	key := useTokenSecret(t)
+	user, _, _ := GenerateToken(7)
+	device, _, _ := GenerateDeviceToken(7, "K7Q2M9X4PW", 1)
+	exp := time.Now().Add(time.Hour).Unix()
+	for _, c := range []struct {
+		name  string
+		token string
+		code  int
+		uid   string
+	}{
+		{"user token", user, 0, "7"},
+		{"no token", "", 10100, ""},
+		// 设备访问令牌只能用于连接设备
+		{"device token", device, 10102, ""},
+		{"forged scope", signClaims(t, key, jwt.MapClaims{"exp": exp, "iss": IssuerName, "sub": "7", "scope": ""}), 10102, ""},
+		{"other issuer", signClaims(t, key, jwt.MapClaims{"exp": exp, "iss": "other", "sub": "7"}), 10102, ""},
+		{"expired", signClaims(t, key, jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix(), "iss": IssuerName, "sub": "7"}), 10103, ""},
+		{"other secret", signClaims(t, []byte("fedcba9876543210fedcba9876543210"), jwt.MapClaims{"exp": exp, "iss": IssuerName, "sub": "7"}), 10103, ""},
+		{"unsigned", signNone(t, jwt.MapClaims{"exp": exp, "iss": IssuerName, "sub": "7"}), 10103, ""},
+	} {
+		code, uid := callAuthHandler(c.token)
+		if code != c.code || uid != c.uid {
+			t.Errorf("%s: code %d, uid %q, want %d, %q", c.name, code, uid, c.code, c.uid)
+		}
+	}
+}
+
+func TestClientAuth(t *testing.T) {
+	key := useTokenSecret(t)
+	var ps P2PService
+	exp := time.Now().Add(time.Hour).Unix()
+
+	user, _, _ := GenerateToken(7)
+	if grant := ps.clientAuth(user); grant == nil || grant.uid != 7 || grant.natId != "" {
+		t.Fatalf("user grant = %+v", grant)
+	}
+	device, _, _ := GenerateDeviceToken(7, "K7Q2M9X4PW", 3)
+	if grant := ps.clientAuth(device); grant == nil || grant.uid != 7 || grant.natId != "K7Q2M9X4PW" || grant.version != 3 {
+		t.Fatalf("device grant = %+v", grant)
+	}
+	for name, token := range map[string]string{
+		"empty":         "",
+		"garbage":       "not a token",
+		"unknown scope": signClaims(t, key, jwt.MapClaims{"exp": exp, "iss": IssuerName, "sub": "7", "scope": "admin", "nat": "K7Q2M9X4PW"}),
+		"scope no nat":  signClaims(t, key, jwt.MapClaims{"exp": exp, "iss": IssuerName, "sub": "7", "scope": "nat"}),
+		"bad subject":   signClaims(t, key, jwt.MapClaims{"exp": exp, "iss": IssuerName, "sub": "seven"}),
+		"other issuer":  signClaims(t, key, jwt.MapClaims{"exp": exp, "iss": "other", "sub": "7"}),
+	} {
+		if grant := ps.clientAuth(token); grant != nil {
+			t.Errorf("%s: accepted as %+v", name, grant)
+		}
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	useTokenSecret(t)
+	engine := testEngine(t)
+	ps := P2PService{
+		Data:    &model.DeviceModel{DB: engine},
+		Members: &model.MemberModel{DB: engine},
+	}
+	engine.Insert(&model.Device{UId: 2, NatId: "K7Q2M9X4PW", LegacyId: "123456", TokenVer: 1})
+	members := ps.Members
+	members.AddMember(1, 3, 2, model.RoleEditor)
+	members.AddMember(1, 4, 2, model.RoleViewer)
+	members.AddMember(1, 5, 2, model.RoleEditor)
+	for id := int64(1); id <= 2; id++ {
+		members.AcceptMember(id)
+	}
+	for _, c := range []struct {
+		name  string
+		grant *clientGrant
+		natId string
+		code  string
+	}{
+		{"no grant", nil, "K7Q2M9X4PW", "10013"},
+		{"unknown device", &clientGrant{uid: 2}, "NOPE", "10004"},
+		{"owner", &clientGrant{uid: 2}, "K7Q2M9X4PW", ""},
+		{"owner by legacy id", &clientGrant{uid: 2}, "123456", ""},
+		{"admin", &clientGrant{uid: 1}, "K7Q2M9X4PW", ""},
+		{"editor", &clientGrant{uid: 3}, "K7Q2M9X4PW", ""},
+		{"viewer", &clientGrant{uid: 4}, "K7Q2M9X4PW", "10014"},
+		{"pending invite", &clientGrant{uid: 5}, "K7Q2M9X4PW", "10014"},
+		{"stranger", &clientGrant{uid: 6}, "K7Q2M9X4PW", "10014"},
+		{"device token", &clientGrant{uid: 3, natId: "K7Q2M9X4PW", version: 1}, "K7Q2M9X4PW", ""},
+		{"device token by legacy id", &clientGrant{uid: 3, natId: "123456", version: 1}, "K7Q2M9X4PW", ""},
+		{"device token for other device", &clientGrant{uid: 3, natId: "OTHER", version: 1}, "K7Q2M9X4PW", "10014"},
+		{"revoked device token", &clientGrant{uid: 3, natId: "K7Q2M9X4PW", version: 0}, "K7Q2M9X4PW", "10014"},
+		// 成员被移除或降级后已签发的设备令牌随之失效
+		{"device token of viewer", &clientGrant{uid: 4, natId: "K7Q2M9X4PW", version: 1}, "K7Q2M9X4PW", "10014"},
+		{"device token of stranger", &clientGrant{uid: 6, natId: "K7Q2M9X4PW", version: 1}, "K7Q2M9X4PW", "10014"},
+	} {
+		if _, code := ps.authorize(c.grant, c.natId); code != c.code {
+			t.Errorf("%s: code %q, want %q", c.name, code, c.code)
+		}
+	}
+}
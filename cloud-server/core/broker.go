@@ -0,0 +1,133 @@
+package core
+
+import (
+	"sync"
+
+	"github.com/skye-z/ons/cloud-server/util"
+)
+
+// 信令代理, 负责在线状态与消息分发, 多实例部署时通过 Redis 共享
+type Broker interface {
+	// 独占在线标记, 已被占用时返回 false, 标记被其他实例占用时调用 lost
+	Claim(key string, lost func()) (bool, error)
+	// 释放本实例持有的在线标记
+	Release(key string)
+	// 检查在线标记是否存在
+	Claimed(key string) bool
+	// 加入分组, 同一分组可有多个成员
+	Join(group, member string)
+	// 退出分组
+	Leave(group, member string)
+	// 获取分组成员数
+	Members(group string) int
+	// 订阅频道, 返回取消订阅的函数
+	Subscribe(channel string, handler func(data []byte)) (func(), error)
+	// 发布消息, 返回是否有订阅者接收
+	Publish(channel string, data []byte) (bool, error)
+}
+
+// 创建信令代理, 未配置 Redis 时使用单实例的内存代理
+func CreateBroker() Broker {
+	addr := util.GetString("broker.redis")
+	if addr == "" {
+		return newMemoryBroker()
+	}
+	broker, err := newRedisBroker(addr, util.GetString("broker.password"), util.GetInt("broker.db"), util.GetString("broker.prefix"))
+	if err != nil {
+		util.OutErr("Broker", "connect redis failed: %v", err)
+	}
+	util.OutLogf("Broker", "using redis %s", addr)
+	return broker
+}
+
+// 内存代理, 仅适用于单实例部署
+type memoryBroker struct {
+	claims   map[string]bool
+	groups   map[string]map[string]bool
+	handlers map[string]*subscription
+	mu       sync.Mutex
+}
+
+// 频道订阅
+type subscription struct {
+	handler func(data []byte)
+}
+
+func newMemoryBroker() *memoryBroker {
+	return &memoryBroker{
+		claims:   make(map[string]bool),
+		groups:   make(map[string]map[string]bool),
+		handlers: make(map[string]*subscription),
+	}
+}
+
+func (mb *memoryBroker) Claim(key string, lost func()) (bool, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.claims[key] {
+		return false, nil
+	}
+	mb.claims[key] = true
+	return true, nil
+}
+
+func (mb *memoryBroker) Release(key string) {
+	mb.mu.Lock()
+	delete(mb.claims, key)
+	mb.mu.Unlock()
+}
+
+func (mb *memoryBroker) Claimed(key string) bool {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return mb.claims[key]
+}
+
+func (mb *memoryBroker) Join(group, member string) {
+	mb.mu.Lock()
+	if mb.groups[group] == nil {
+		mb.groups[group] = make(map[string]bool)
+	}
+	mb.groups[group][member] = true
+	mb.mu.Unlock()
+}
+
+func (mb *memoryBroker) Leave(group, member string) {
+	mb.mu.Lock()
+	delete(mb.groups[group], member)
+	if len(mb.groups[group]) == 0 {
+		delete(mb.groups, group)
+	}
+	mb.mu.Unlock()
+}
+
+func (mb *memoryBroker) Members(group string) int {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	return len(mb.groups[group])
+}
+
+func (mb *memoryBroker) Subscribe(channel string, handler func(data []byte)) (func(), error) {
+	sub := &subscription{handler: handler}
+	mb.mu.Lock()
+	mb.handlers[channel] = sub
+	mb.mu.Unlock()
+	return func() {
+		mb.mu.Lock()
+		if mb.handlers[channel] == sub {
+			delete(mb.handlers, channel)
+		}
+		mb.mu.Unlock()
+	}, nil
+}
+
+func (mb *memoryBroker) Publish(channel string, data []byte) (bool, error) {
+	mb.mu.Lock()
+	sub, ok := mb.handlers[channel]
+	mb.mu.Unlock()
+	if !ok {
+		return false, nil
+	}
+	sub.handler(data)
+	return true, nil
+}
@@ -0,0 +1,341 @@
+package core
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skye-z/ons/cloud-server/util"
+)
+
+const (
+	// 在线标记与分组成员有效期, 实例异常退出后自动失效
+	brokerTTL = 30 * time.Second
+	// 续期间隔, 需小于 brokerTTL
+	brokerRefresh = 10 * time.Second
+	// 单条命令超时
+	brokerTimeout = 5 * time.Second
+	// 订阅连接断开后的重连间隔
+	brokerRetry = 2 * time.Second
+)
+
+// 仅在标记仍属于本实例时续期
+const brokerRenewScript = `if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) end return 0`
+
+// Redis 代理, 多个中控实例通过发布订阅转发信令
+type redisBroker struct {
+	addr     string
+	password string
+	db       int
+	prefix   string
+	// 实例编号, 写入在线标记
+	instance string
+	// 命令连接
+	cmd   *util.RedisConn
+	cmdMu sync.Mutex
+	// 订阅连接, 同时保护订阅表的增删
+	sub   *util.RedisConn
+	subMu sync.Mutex
+	// 本实例的订阅及持有的在线标记, 分组成员
+	handlers map[string]*subscription
+	claims   map[string]func()
+	groups   map[string]map[string]bool
+	// 等待服务端确认的订阅
+	pending map[string]chan struct{}
+	mu      sync.Mutex
+}
+
+func newRedisBroker(addr, password string, db int, prefix string) (*redisBroker, error) {
+	if prefix == "" {
+		prefix = "ons:"
+	}
+	rb := &redisBroker{
+		addr:     addr,
+		password: password,
+		db:       db,
+		prefix:   prefix,
+		instance: util.GenerateRandomString(16),
+		handlers: make(map[string]*subscription),
+		claims:   make(map[string]func()),
+		groups:   make(map[string]map[string]bool),
+		pending:  make(map[string]chan struct{}),
+	}
+	if _, err := rb.do("PING"); err != nil {
+		return nil, err
+	}
+	sub, err := util.DialRedis(addr, password, db)
+	if err != nil {
+		return nil, err
+	}
+	rb.sub = sub
+	go rb.listen(sub)
+	go rb.refresh()
+	return rb, nil
+}
+
+func (rb *redisBroker) Claim(key string, lost func()) (bool, error) {
+	reply, err := rb.do("SET", rb.prefix+key, rb.instance, "NX", "PX", brokerMillis(brokerTTL))
+	if err != nil || reply == nil {
+		return false, err
+	}
+	rb.mu.Lock()
+	rb.claims[key] = lost
+	rb.mu.Unlock()
+	return true, nil
+}
+
+func (rb *redisBroker) Release(key string) {
+	rb.mu.Lock()
+	delete(rb.claims, key)
+	rb.mu.Unlock()
+	// 仅删除本实例持有的标记
+	if owner, err := rb.do("GET", rb.prefix+key); err == nil && owner == rb.instance {
+		rb.do("DEL", rb.prefix+key)
+	}
+}
+
+func (rb *redisBroker) Claimed(key string) bool {
+	reply, err := rb.do("EXISTS", rb.prefix+key)
+	count, _ := reply.(int64)
+	return err == nil && count > 0
+}
+
+func (rb *redisBroker) Join(group, member string) {
+	rb.mu.Lock()
+	if rb.groups[group] == nil {
+		rb.groups[group] = make(map[string]bool)
+	}
+	rb.groups[group][member] = true
+	rb.mu.Unlock()
+	rb.touch(group, member)
+}
+
+func (rb *redisBroker) Leave(group, member string) {
+	rb.mu.Lock()
+	delete(rb.groups[group], member)
+	if len(rb.groups[group]) == 0 {
+		delete(rb.groups, group)
+	}
+	rb.mu.Unlock()
+	rb.do("ZREM", rb.prefix+group, member)
+}
+
+func (rb *redisBroker) Members(group string) int {
+	// 成员分值为过期时间, 只统计未过期的成员
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	reply, err := rb.do("ZCOUNT", rb.prefix+group, now, "+inf")
+	count, _ := reply.(int64)
+	if err != nil {
+		return 0
+	}
+	return int(count)
+}
+
+func (rb *redisBroker) Subscribe(channel string, handler func(data []byte)) (func(), error) {
+	sub := &subscription{handler: handler}
+	ready := make(chan struct{})
+	rb.subMu.Lock()
+	rb.mu.Lock()
+	rb.handlers[channel] = sub
+	rb.pending[channel] = ready
+	rb.mu.Unlock()
+	err := rb.sub.Send("SUBSCRIBE", rb.prefix+channel)
+	rb.subMu.Unlock()
+	if err != nil {
+		// 订阅连接重建后会恢复全部订阅, 仍等待确认
+		log.Printf("[Broker] subscribe %s: %v", channel, err)
+	}
+	cancel := func() {
+		rb.subMu.Lock()
+		defer rb.subMu.Unlock()
+		rb.mu.Lock()
+		current := rb.handlers[channel] == sub
+		if current {
+			delete(rb.handlers, channel)
+		}
+		rb.mu.Unlock()
+		if current {
+			rb.sub.Send("UNSUBSCRIBE", rb.prefix+channel)
+		}
+	}
+	// 确认前发布的消息不会送达, 需等待订阅生效
+	select {
+	case <-ready:
+		return cancel, nil
+	case <-time.After(brokerTimeout):
+	}
+	rb.mu.Lock()
+	if rb.pending[channel] == ready {
+		delete(rb.pending, channel)
+	}
+	rb.mu.Unlock()
+	cancel()
+	return nil, errors.New("subscribe " + channel + " timed out")
+}
+
+func (rb *redisBroker) Publish(channel string, data []byte) (bool, error) {
+	reply, err := rb.do("PUBLISH", rb.prefix+channel, string(data))
+	count, _ := reply.(int64)
+	return count > 0, err
+}
+
+// 接收订阅消息, 连接断开后重建
+func (rb *redisBroker) listen(sub *util.RedisConn) {
+	for {
+		reply, err := sub.Receive()
+		if err != nil {
+			log.Printf("[Broker] subscription lost: %v", err)
+			sub.Close()
+			sub = rb.resubscribe()
+			continue
+		}
+		msg, ok := reply.([]any)
+		if !ok || len(msg) != 3 {
+			continue
+		}
+		channel, _ := msg[1].(string)
+		channel = strings.TrimPrefix(channel, rb.prefix)
+		if msg[0] == "subscribe" {
+			rb.mu.Lock()
+			ready := rb.pending[channel]
+			delete(rb.pending, channel)
+			rb.mu.Unlock()
+			if ready != nil {
+				close(ready)
+			}
+			continue
+		} else if msg[0] != "message" {
+			continue
+		}
+		data, _ := msg[2].(string)
+		rb.mu.Lock()
+		handler := rb.handlers[channel]
+		rb.mu.Unlock()
+		if handler != nil {
+			handler.handler([]byte(data))
+		}
+	}
+}
+
+// [工具] 重建订阅连接并恢复全部订阅
+func (rb *redisBroker) resubscribe() *util.RedisConn {
+	for {
+		time.Sleep(brokerRetry)
+		sub, err := util.DialRedis(rb.addr, rb.password, rb.db)
+		if err != nil {
+			log.Printf("[Broker] reconnect: %v", err)
+			continue
+		}
+		rb.subMu.Lock()
+		rb.mu.Lock()
+		args := []string{"SUBSCRIBE"}
+		for channel := range rb.handlers {
+			args = append(args, rb.prefix+channel)
+		}
+		rb.mu.Unlock()
+		if len(args) > 1 {
+			err = sub.Send(args...)
+		}
+		if err == nil {
+			rb.sub = sub
+		}
+		rb.subMu.Unlock()
+		if err != nil {
+			sub.Close()
+			continue
+		}
+		log.Printf("[Broker] subscription restored, %d channels", len(args)-1)
+		return sub
+	}
+}
+
+// 定时续期本实例持有的在线标记与分组成员
+func (rb *redisBroker) refresh() {
+	ticker := time.NewTicker(brokerRefresh)
+	defer ticker.Stop()
+	for range ticker.C {
+		rb.renew()
+	}
+}
+
+// 续期一次, 在线标记已被其他实例占用时通知本地会话退出
+func (rb *redisBroker) renew() {
+	rb.mu.Lock()
+	claims := make([]string, 0, len(rb.claims))
+	for key := range rb.claims {
+		claims = append(claims, key)
+	}
+	groups := make(map[string][]string, len(rb.groups))
+	for group, members := range rb.groups {
+		for member := range members {
+			groups[group] = append(groups[group], member)
+		}
+	}
+	rb.mu.Unlock()
+	for _, key := range claims {
+		reply, err := rb.do("EVAL", brokerRenewScript, "1", rb.prefix+key, rb.instance, brokerMillis(brokerTTL))
+		if err != nil || reply != int64(0) {
+			continue
+		}
+		rb.mu.Lock()
+		lost, ok := rb.claims[key]
+		delete(rb.claims, key)
+		rb.mu.Unlock()
+		if ok {
+			log.Printf("[Broker] claim %s lost", key)
+			if lost != nil {
+				lost()
+			}
+		}
+	}
+	now := strconv.FormatInt(time.Now().UnixMilli(), 10)
+	for group, members := range groups {
+		// 清理已退出实例遗留的成员
+		rb.do("ZREMRANGEBYSCORE", rb.prefix+group, "-inf", now)
+		for _, member := range members {
+			rb.touch(group, member)
+		}
+	}
+}
+
+// [工具] 写入分组成员并续期
+func (rb *redisBroker) touch(group, member string) {
+	expire := strconv.FormatInt(time.Now().Add(brokerTTL).UnixMilli(), 10)
+	rb.do("ZADD", rb.prefix+group, expire, member)
+	rb.do("PEXPIRE", rb.prefix+group, brokerMillis(brokerTTL))
+}
+
+// [工具] 执行命令, 连接断开时重连一次
+func (rb *redisBroker) do(args ...string) (any, error) {
+	rb.cmdMu.Lock()
+	defer rb.cmdMu.Unlock()
+	for i := 0; ; i++ {
+		if rb.cmd == nil {
+			conn, err := util.DialRedis(rb.addr, rb.password, rb.db)
+			if err != nil {
+				log.Printf("[Broker] %s: %v", args[0], err)
+				return nil, err
+			}
+			rb.cmd = conn
+		}
+		rb.cmd.SetDeadline(time.Now().Add(brokerTimeout))
+		reply, err := rb.cmd.Do(args...)
+		if _, ok := err.(util.RedisError); err == nil || ok {
+			return reply, err
+		}
+		rb.cmd.Close()
+		rb.cmd = nil
+		if i > 0 {
+			log.Printf("[Broker] %s: %v", args[0], err)
+			return nil, err
+		}
+	}
+}
+
+// [工具] 毫秒数
+func brokerMillis(d time.Duration) string {
+	return strconv.FormatInt(d.Milliseconds(), 10)
+}
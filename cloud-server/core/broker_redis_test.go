@@ -0,0 +1,399 @@
+package core
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// 进程内的 RESP 替身, 仅实现信令代理用到的命令
+type fakeRedis struct {
+	listener net.Listener
+	values   map[string]string
+	expires  map[string]time.Time
+	zsets    map[string]map[string]float64
+	subs     map[string]map[*fakeClient]bool
+	// 订阅生效前的延迟, 用于检查 Subscribe 是否等待确认
+	ackDelay time.Duration
+	mu       sync.Mutex
+}
+
+type fakeClient struct {
+	conn net.Conn
+	mu   sync.Mutex
+}
+
+func newFakeRedis(t *testing.T) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fr := &fakeRedis{
+		listener: listener,
+		values:   make(map[string]string),
+		expires:  make(map[string]time.Time),
+		zsets:    make(map[string]map[string]float64),
+		subs:     make(map[string]map[*fakeClient]bool),
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go fr.serve(&fakeClient{conn: conn})
+		}
+	}()
+	return fr
+}
+
+func (fr *fakeRedis) addr() string {
+	return fr.listener.Addr().String()
+}
+
+// 读取一条命令并执行
+func (fr *fakeRedis) serve(fc *fakeClient) {
+	defer fc.conn.Close()
+	reader := bufio.NewReader(fc.conn)
+	for {
+		args, err := readCommand(reader)
+		if err != nil {
+			return
+		}
+		fr.exec(fc, args)
+	}
+}
+
+func (fr *fakeRedis) exec(fc *fakeClient, args []string) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.expire()
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		fc.write("+PONG\r\n")
+	case "SET":
+		key, value := args[1], args[2]
+		var ttl time.Duration
+		nx := false
+		for i := 3; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "NX":
+				nx = true
+			case "PX":
+				ms, _ := strconv.Atoi(args[i+1])
+				ttl = time.Duration(ms) * time.Millisecond
+				i++
+			}
+		}
+		if _, ok := fr.values[key]; ok && nx {
+			fc.write("$-1\r\n")
+			return
+		}
+		fr.values[key] = value
+		delete(fr.expires, key)
+		if ttl > 0 {
+			fr.expires[key] = time.Now().Add(ttl)
+		}
+		fc.write("+OK\r\n")
+	case "GET":
+		if value, ok := fr.values[args[1]]; ok {
+			fc.write(bulk(value))
+		} else {
+			fc.write("$-1\r\n")
+		}
+	case "DEL":
+		_, ok := fr.values[args[1]]
+		delete(fr.values, args[1])
+		delete(fr.expires, args[1])
+		fc.write(integer(ok))
+	case "EXISTS":
+		_, ok := fr.values[args[1]]
+		fc.write(integer(ok))
+	case "PEXPIRE":
+		fc.write(integer(fr.pexpire(args[1], args[2])))
+	case "EVAL":
+		if args[1] != brokerRenewScript {
+			fc.write("-ERR unknown script\r\n")
+			return
+		}
+		ok := fr.values[args[3]] == args[4] && fr.pexpire(args[3], args[5])
+		fc.write(integer(ok))
+	case "ZADD":
+		score, _ := strconv.ParseFloat(args[2], 64)
+		if fr.zsets[args[1]] == nil {
+			fr.zsets[args[1]] = make(map[string]float64)
+		}
+		fr.zsets[args[1]][args[3]] = score
+		fc.write(":1\r\n")
+	case "ZREM":
+		delete(fr.zsets[args[1]], args[2])
+		fc.write(":1\r\n")
+	case "ZCOUNT", "ZREMRANGEBYSCORE":
+		min, max := parseScore(args[2]), parseScore(args[3])
+		count := 0
+		for member, score := range fr.zsets[args[1]] {
+			if score >= min && score <= max {
+				count++
+				if args[0] == "ZREMRANGEBYSCORE" {
+					delete(fr.zsets[args[1]], member)
+				}
+			}
+		}
+		fc.write(":" + strconv.Itoa(count) + "\r\n")
+	case "PUBLISH":
+		receivers := fr.subs[args[1]]
+		for client := range receivers {
+			client.write(array("message", args[1], args[2]))
+		}
+		fc.write(":" + strconv.Itoa(len(receivers)) + "\r\n")
+	case "SUBSCRIBE":
+		// 模拟服务端延迟处理, 确认前订阅尚未生效
+		go func() {
+			time.Sleep(fr.ackDelay)
+			fr.mu.Lock()
+			defer fr.mu.Unlock()
+			for i, channel := range args[1:] {
+				if fr.subs[channel] == nil {
+					fr.subs[channel] = make(map[*fakeClient]bool)
+				}
+				fr.subs[channel][fc] = true
+				fc.write("*3\r\n" + bulk("subscribe") + bulk(channel) + ":" + strconv.Itoa(i+1) + "\r\n")
+			}
+		}()
+	case "UNSUBSCRIBE":
+		for _, channel := range args[1:] {
+			delete(fr.subs[channel], fc)
+		}
+	default:
+		fc.write("-ERR unknown command\r\n")
+	}
+}
+
+// [工具] 清理过期的键
+func (fr *fakeRedis) expire() {
+	now := time.Now()
+	for key, at := range fr.expires {
+		if now.After(at) {
+			delete(fr.values, key)
+			delete(fr.zsets, key)
+			delete(fr.expires, key)
+		}
+	}
+}
+
+// [工具] 设置过期时间, 键不存在时返回 false
+func (fr *fakeRedis) pexpire(key, ms string) bool {
+	_, value := fr.values[key]
+	_, zset := fr.zsets[key]
+	if !value && !zset {
+		return false
+	}
+	ttl, _ := strconv.Atoi(ms)
+	fr.expires[key] = time.Now().Add(time.Duration(ttl) * time.Millisecond)
+	return true
+}
+
+// [工具] 读取剩余有效期
+func (fr *fakeRedis) ttl(key string) time.Duration {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return time.Until(fr.expires[key])
+}
+
+func (fr *fakeRedis) set(key, value string) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.values[key] = value
+}
+
+func (fr *fakeRedis) get(key string) string {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return fr.values[key]
+}
+
+func (fc *fakeClient) write(reply string) {
+	fc.mu.Lock()
+	defer fc.mu.Unlock()
+	fc.conn.Write([]byte(reply))
+}
+
+// [工具] 读取 RESP 数组形式的命令
+func readCommand(reader *bufio.Reader) ([]string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected command %q", line)
+	}
+	size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+	args := make([]string, size)
+	for i := range args {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		length, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		data := make([]byte, length+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		args[i] = string(data[:length])
+	}
+	return args, nil
+}
+
+func bulk(value string) string {
+	return "$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n"
+}
+
+func array(values ...string) string {
+	out := "*" + strconv.Itoa(len(values)) + "\r\n"
+	for _, value := range values {
+		out += bulk(value)
+	}
+	return out
+}
+
+func integer(ok bool) string {
+	if ok {
+		return ":1\r\n"
+	}
+	return ":0\r\n"
+}
+
+func parseScore(value string) float64 {
+	switch value {
+	case "-inf":
+		return -1e300
+	case "+inf":
+		return 1e300
+	}
+	score, _ := strconv.ParseFloat(value, 64)
+	return score
+}
+
+func newTestBroker(t *testing.T, fr *fakeRedis) *redisBroker {
+	rb, err := newRedisBroker(fr.addr(), "", 0, "test:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rb
+}
+
+func TestRedisBrokerClaim(t *testing.T) {
+	fr := newFakeRedis(t)
+	first, second := newTestBroker(t, fr), newTestBroker(t, fr)
+
+	if ok, err := first.Claim("nsb:1", nil); err != nil || !ok {
+		t.Fatalf("first claim = %v, %v", ok, err)
+	}
+	if ok, err := second.Claim("nsb:1", nil); err != nil || ok {
+		t.Fatalf("second claim = %v, %v, want rejected", ok, err)
+	}
+	if !second.Claimed("nsb:1") {
+		t.Fatal("claim not visible to other instance")
+	}
+	// 其他实例不能释放不属于自己的标记
+	second.Release("nsb:1")
+	if !first.Claimed("nsb:1") {
+		t.Fatal("claim released by other instance")
+	}
+	first.Release("nsb:1")
+	if first.Claimed("nsb:1") {
+		t.Fatal("claim not released")
+	}
+}
+
+func TestRedisBrokerRenew(t *testing.T) {
+	fr := newFakeRedis(t)
+	rb := newTestBroker(t, fr)
+	lost := make(chan struct{}, 1)
+	if ok, _ := rb.Claim("nsb:1", func() { lost <- struct{}{} }); !ok {
+		t.Fatal("claim failed")
+	}
+
+	// 标记仍属于本实例时续期
+	fr.mu.Lock()
+	fr.expires["test:nsb:1"] = time.Now().Add(time.Second)
+	fr.mu.Unlock()
+	rb.renew()
+	if ttl := fr.ttl("test:nsb:1"); ttl < brokerTTL-time.Second {
+		t.Fatalf("claim not renewed, ttl %v", ttl)
+	}
+	select {
+	case <-lost:
+		t.Fatal("owned claim reported lost")
+	default:
+	}
+
+	// 标记被其他实例占用后不再续期, 并通知本地会话
+	fr.set("test:nsb:1", "other")
+	fr.mu.Lock()
+	fr.expires["test:nsb:1"] = time.Now().Add(time.Second)
+	fr.mu.Unlock()
+	rb.renew()
+	select {
+	case <-lost:
+	default:
+		t.Fatal("lost claim not reported")
+	}
+	if ttl := fr.ttl("test:nsb:1"); ttl > time.Second {
+		t.Fatalf("claim of other instance renewed, ttl %v", ttl)
+	}
+	if fr.get("test:nsb:1") != "other" {
+		t.Fatal("claim of other instance overwritten")
+	}
+	rb.mu.Lock()
+	_, held := rb.claims["nsb:1"]
+	rb.mu.Unlock()
+	if held {
+		t.Fatal("lost claim still held locally")
+	}
+}
+
+func TestRedisBrokerPubSub(t *testing.T) {
+	fr := newFakeRedis(t)
+	fr.ackDelay = 100 * time.Millisecond
+	publisher, subscriber := newTestBroker(t, fr), newTestBroker(t, fr)
+
+	received := make(chan string, 1)
+	cancel, err := subscriber.Subscribe("nsb:1", func(data []byte) {
+		received <- string(data)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Subscribe 返回后订阅已生效, 立即发布也能送达
+	if delivered, err := publisher.Publish("nsb:1", []byte("hello")); err != nil || !delivered {
+		t.Fatalf("publish = %v, %v", delivered, err)
+	}
+	select {
+	case data := <-received:
+		if data != "hello" {
+			t.Fatalf("received %q", data)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("message not forwarded")
+	}
+
+	cancel()
+	deadline := time.Now().Add(time.Second)
+	for {
+		delivered, _ := publisher.Publish("nsb:1", []byte("bye"))
+		if !delivered {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("still subscribed after cancel")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
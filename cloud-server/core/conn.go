@@ -0,0 +1,178 @@
+package core
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	// 等待 pong 或消息的最长时间, 超时视为连接失效
+	pongWait = 60 * time.Second
+	// 发送 ping 的间隔, 需小于 pongWait
+	pingPeriod = 25 * time.Second
+	// 写入超时
+	writeWait = 10 * time.Second
+	// 待发送队列长度, 写满说明对端长时间未读取
+	sendQueue = 256
+	// 超过一个心跳周期未收到任何数据视为失效
+	staleAfter = pingPeriod + writeWait
+)
+
+var errConnClosed = errors.New("connection closed")
+
+// 信令连接, 写入统一由写协程完成, 避免并发写入
+type peerConn struct {
+	ws   *websocket.Conn
+	send chan []byte
+	done chan struct{}
+	once sync.Once
+	// 最近一次收到消息或 pong 的时间
+	seen atomic.Int64
+	// 固定的读取期限, 不随 pong 延长, 0 为不限
+	limitAt atomic.Int64
+	// 接收消息限速, 仅由读取协程使用
+	limit *tokenBucket
+}
+
+// 包装信令连接并启动写协程
+func newPeerConn(ws *websocket.Conn, limit *tokenBucket) *peerConn {
+	pc := &peerConn{
+		ws:    ws,
+		send:  make(chan []byte, sendQueue),
+		done:  make(chan struct{}),
+		limit: limit,
+	}
+	pc.touch()
+	ws.SetPongHandler(func(string) error {
+		pc.touch()
+		return nil
+	})
+	go pc.writeLoop()
+	return pc
+}
+
+// 读取一条消息, 成功后延长读取期限
+func (pc *peerConn) read() ([]byte, error) {
+	_, message, err := pc.ws.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	pc.touch()
+	return message, nil
+}
+
+// 检查消息是否超出限速
+func (pc *peerConn) allow() bool {
+	return pc.limit == nil || pc.limit.take()
+}
+
+// 检查连接是否已长时间无响应
+func (pc *peerConn) stale() bool {
+	return time.Since(time.Unix(0, pc.seen.Load())) > staleAfter
+}
+
+// 设置固定的读取期限, 期间收到 pong 也不延长, 传入 0 时恢复
+func (pc *peerConn) limitRead(wait time.Duration) {
+	if wait <= 0 {
+		pc.limitAt.Store(0)
+		pc.ws.SetReadDeadline(time.Now().Add(pongWait))
+		return
+	}
+	until := time.Now().Add(wait)
+	pc.limitAt.Store(until.UnixNano())
+	pc.ws.SetReadDeadline(until)
+}
+
+// [工具] 记录活动并延长读取期限, 不超过固定期限
+func (pc *peerConn) touch() {
+	now := time.Now()
+	pc.seen.Store(now.UnixNano())
+	until := now.Add(pongWait)
+	if limit := pc.limitAt.Load(); limit != 0 && limit < until.UnixNano() {
+		until = time.Unix(0, limit)
+	}
+	pc.ws.SetReadDeadline(until)
+}
+
+// 消息加入发送队列, 队列已满时断开连接
+func (pc *peerConn) write(data []byte) error {
+	select {
+	case <-pc.done:
+		return errConnClosed
+	default:
+	}
+	select {
+	case pc.send <- data:
+		return nil
+	case <-pc.done:
+		return errConnClosed
+	default:
+		log.Printf("[P2P] send queue of %s is full, connection evicted", pc.ws.RemoteAddr())
+		pc.evict()
+		return errConnClosed
+	}
+}
+
+// 发送完队列中的消息后关闭连接
+func (pc *peerConn) close() {
+	pc.once.Do(func() {
+		close(pc.done)
+	})
+}
+
+// 立即关闭连接, 读取随之返回错误
+func (pc *peerConn) evict() {
+	pc.close()
+	pc.ws.Close()
+}
+
+// 写协程, 负责发送消息与心跳
+func (pc *peerConn) writeLoop() {
+	ticker := time.NewTicker(pingPeriod)
+	defer func() {
+		ticker.Stop()
+		pc.ws.Close()
+	}()
+	for {
+		select {
+		case data := <-pc.send:
+			if !pc.flush(data) {
+				return
+			}
+		case <-ticker.C:
+			if err := pc.ws.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait)); err != nil {
+				pc.close()
+				return
+			}
+		case <-pc.done:
+			// 尽量发出关闭前排队的消息, 如错误码
+			for {
+				select {
+				case data := <-pc.send:
+					if !pc.flush(data) {
+						return
+					}
+				default:
+					pc.ws.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(writeWait))
+					return
+				}
+			}
+		}
+	}
+}
+
+// [工具] 写入一条消息, 失败时关闭连接
+func (pc *peerConn) flush(data []byte) bool {
+	pc.ws.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := pc.ws.WriteMessage(websocket.TextMessage, data); err != nil {
+		log.Printf("[P2P] write %s: %v", pc.ws.RemoteAddr(), err)
+		pc.close()
+		return false
+	}
+	return true
+}
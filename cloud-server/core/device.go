@@ -3,6 +3,7 @@ package core
 import (
 	"log"
 	"strconv"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/skye-z/ons/cloud-server/model"
@@ -11,7 +12,10 @@ import (
 )
 
 type DeviceService struct {
-	Data *model.DeviceModel
+	Data     *model.DeviceModel
+	Presence *model.PresenceModel
+	Events   *model.EventModel
+	Members  *model.MemberModel
 }
 
 func CreateDeviceService(engine *xorm.Engine) *DeviceService {
@@ -19,7 +23,10 @@ func CreateDeviceService(engine *xorm.Engine) *DeviceService {
 		DB: engine,
 	}
 	return &DeviceService{
-		Data: data,
+		Data:     data,
+		Presence: &model.PresenceModel{DB: engine},
+		Events:   &model.EventModel{DB: engine},
+		Members:  &model.MemberModel{DB: engine},
 	}
 }
 
@@ -31,6 +38,17 @@ func (ds DeviceService) Register(ctx *gin.Context) {
 		util.ReturnMessage(ctx, false, "设备名称不能为空")
 		return
 	}
+	// NAS 生成的设备公钥, 连接中控时需以对应私钥签名
+	publicKey := ctx.PostForm("publicKey")
+	if !util.CheckDeviceKey(publicKey) {
+		util.ReturnMessage(ctx, false, "设备公钥无效, 请升级 NAS 服务")
+		return
+	}
+	// 已注册的设备重新绑定公钥, 可同时升级旧版编号
+	if natId := ctx.PostForm("natId"); natId != "" {
+		ds.rebind(ctx, uid, natId, publicKey, util.GetPostBool(ctx, "migrate", false))
+		return
+	}
 	list, err := ds.Data.GetDeviceList(uid, 1, 5)
 	if err == nil && len(list) >= 3 {
 		util.ReturnMessage(ctx, false, "当前账户注册设备已达上限")
@@ -39,45 +57,80 @@ func (ds DeviceService) Register(ctx *gin.Context) {
 		util.ReturnMessage(ctx, false, "设备服务异常")
 		return
 	}
-	nat := util.GenerateRandomNumber(6)
-	if ds.Data.CheckNATId(name) {
-		nat = util.GenerateRandomNumber(6)
-		if ds.Data.CheckNATId(name) {
-			nat = util.GenerateRandomNumber(6)
-		}
-	}
-
-	if ds.Data.AddDevice(uid, name, nat) {
+	// 唯一索引兜底并发注册时的编号冲突
+	nat := allocNATId(ds.Data, func(nat string) bool {
+		return ds.Data.AddDevice(uid, name, nat, publicKey)
+	})
+	if nat != "" {
 		util.ReturnMessage(ctx, true, nat)
 	} else {
 		util.ReturnMessage(ctx, false, "设备注册失败")
 	}
 }
 
+// 为已注册的设备绑定新公钥, 仅设备所有者可操作
+// 按所有者查找, 编号重复而被重新分配的设备可凭原编号取回新编号
+func (ds DeviceService) rebind(ctx *gin.Context, uid int64, natId, publicKey string, migrate bool) {
+	info, err := ds.Data.OwnerGetDevice(uid, natId)
+	if err != nil {
+		util.ReturnError(ctx, util.Errors.UnexpectedError)
+		return
+	} else if info == nil {
+		if other, _ := ds.Data.NATGetDevice(natId); other != nil {
+			util.ReturnMessage(ctx, false, "非法访问")
+		} else {
+			util.ReturnMessage(ctx, false, "设备不存在")
+		}
+		return
+	}
+	if !ds.Data.UpdatePublicKey(info.Id, publicKey) {
+		util.ReturnMessage(ctx, false, "设备密钥绑定失败")
+		return
+	}
+	// 旧版编号升级为新格式, 旧编号保留为别名
+	if migrate && info.LegacyId == "" && !util.ValidNATId(info.NatId) {
+		nat := allocNATId(ds.Data, func(nat string) bool {
+			return ds.Data.MigrateNATId(info.Id, nat, info.NatId)
+		})
+		if nat == "" {
+			util.ReturnMessage(ctx, false, "NAT.ID 升级失败")
+			return
+		}
+		log.Printf("[Device] nat id %s migrated to %s", info.NatId, nat)
+		info.NatId = nat
+	}
+	util.ReturnMessage(ctx, true, info.NatId)
+}
+
+// [工具] 分配未被占用的 NAT 编号并保存, 保存失败时重试
+func allocNATId(data *model.DeviceModel, save func(nat string) bool) string {
+	for i := 0; i < 5; i++ {
+		nat := util.GenerateNATId()
+		if data.CheckNATId(nat) {
+			continue
+		}
+		if save(nat) {
+			return nat
+		}
+	}
+	return ""
+}
+
 // 重命名设备
 func (ds DeviceService) ReName(ctx *gin.Context) {
-	id, _ := strconv.ParseInt(ctx.Param("id"), 10, 64)
 	name := ctx.PostForm("name")
 	if len(name) == 0 {
 		util.ReturnMessage(ctx, false, "设备名称不能为空")
 		return
 	}
-	info, err := ds.Data.GetDevice(id)
-	uid, _ := strconv.ParseInt(ctx.GetString("uid"), 10, 64)
-	if err != nil {
-		util.ReturnError(ctx, util.Errors.UnexpectedError)
-		return
-	} else if info == nil {
-		util.ReturnMessage(ctx, false, "设备不存在")
-		return
-	} else if uid != 1 && uid != info.UId {
-		util.ReturnMessage(ctx, false, "非法访问")
+	info, ok := ds.access(ctx, ctx.PostForm("id"), model.RoleEditor)
+	if !ok {
 		return
 	}
-	if ds.Data.UpdateName(id, name) {
-		util.ReturnMessage(ctx, false, "重命名失败")
-	} else {
+	if ds.Data.UpdateName(info.Id, name) {
 		util.ReturnMessage(ctx, true, "重命名成功")
+	} else {
+		util.ReturnMessage(ctx, false, "重命名失败")
 	}
 }
 
@@ -100,45 +153,172 @@ func (ds DeviceService) GetList(ctx *gin.Context) {
 		util.ReturnError(ctx, util.Errors.ParamIllegalError)
 		return
 	}
-	list, err := ds.Data.GetDeviceList(uid, iPage, iNum)
+	list, err := ds.Data.GetAccessList(uid, iPage, iNum)
 	if err != nil {
 		log.Println(err)
 		util.ReturnError(ctx, util.Errors.UnexpectedError)
-	} else {
-		util.ReturnData(ctx, true, list)
+		return
+	}
+	// 附带当前用户的角色, 共享的设备按成员角色
+	for i := range list {
+		list[i].Role, _ = ds.Members.GetRole(&list[i], uid)
 	}
+	util.ReturnData(ctx, true, list)
 }
 
 // 获取设备信息
 func (ds DeviceService) GetInfo(ctx *gin.Context) {
-	id, _ := strconv.ParseInt(ctx.Param("id"), 10, 64)
-	info, err := ds.Data.GetDevice(id)
-	uid, _ := strconv.ParseInt(ctx.GetString("uid"), 10, 64)
+	info, ok := ds.access(ctx, ctx.Param("id"), model.RoleViewer)
+	if ok {
+		util.ReturnData(ctx, true, info)
+	}
+}
+
+// 获取设备在线历史及在线率, 默认统计最近 7 天
+func (ds DeviceService) GetPresence(ctx *gin.Context) {
+	info, ok := ds.access(ctx, ctx.Param("id"), model.RoleViewer)
+	if !ok {
+		return
+	}
+	days, err := strconv.Atoi(ctx.DefaultQuery("days", "7"))
+	if err != nil || days <= 0 || days > 90 {
+		util.ReturnError(ctx, util.Errors.ParamIllegalError)
+		return
+	}
+	now := time.Now().Unix() * 1000
+	since := now - int64(days)*24*time.Hour.Milliseconds()
+	list, err := ds.Presence.GetPresenceList(info.Id, since)
 	if err != nil {
 		util.ReturnError(ctx, util.Errors.UnexpectedError)
-	} else if uid != 1 && uid != info.UId {
-		util.ReturnMessage(ctx, false, "非法访问")
+		return
+	}
+	var online int64
+	for _, item := range list {
+		start, end := item.Online, item.Offline
+		if end == 0 {
+			// 心跳中断的记录以最近心跳时间结束
+			end = now
+			if now-item.Seen > 2*presenceBeat.Milliseconds() {
+				end = item.Seen
+			}
+		}
+		if start < since {
+			start = since
+		}
+		if end > start {
+			online += end - start
+		}
+	}
+	util.ReturnData(ctx, true, map[string]any{
+		"since":  since,
+		"uptime": float64(online) / float64(now-since),
+		"list":   list,
+	})
+}
+
+// 分页获取设备事件, 用于排查连接问题
+func (ds DeviceService) GetEvents(ctx *gin.Context) {
+	info, ok := ds.access(ctx, ctx.Param("id"), model.RoleViewer)
+	if !ok {
+		return
+	}
+	page, err1 := strconv.Atoi(ctx.DefaultQuery("page", "1"))
+	num, err2 := strconv.Atoi(ctx.DefaultQuery("number", "20"))
+	if err1 != nil || err2 != nil || page <= 0 || num <= 0 || num > 100 {
+		util.ReturnError(ctx, util.Errors.ParamIllegalError)
+		return
+	}
+	list, total, err := ds.Events.GetEventList(info.Id, page, num)
+	if err != nil {
+		util.ReturnError(ctx, util.Errors.UnexpectedError)
+		return
+	}
+	util.ReturnData(ctx, true, map[string]any{
+		"total": total,
+		"list":  list,
+	})
+}
+
+// 签发设备访问令牌, 供插件连接指定设备, 令牌随成员资格失效
+func (ds DeviceService) IssueToken(ctx *gin.Context) {
+	info, ok := ds.access(ctx, ctx.Param("id"), model.RoleEditor)
+	if !ok {
+		return
+	}
+	uid, _ := strconv.ParseInt(ctx.GetString("uid"), 10, 64)
+	token, exp, err := GenerateDeviceToken(uid, info.NatId, info.TokenVer)
+	if err != nil {
+		util.ReturnMessage(ctx, false, "令牌签发失败")
+		return
+	}
+	util.ReturnMessageData(ctx, true, "签发成功", map[string]any{
+		"token": token,
+		"exp":   exp,
+	})
+}
+
+// 吊销设备已签发的全部访问令牌
+func (ds DeviceService) RevokeTokens(ctx *gin.Context) {
+	info, ok := ds.access(ctx, ctx.Param("id"), model.RoleOwner)
+	if !ok {
+		return
+	}
+	if ds.Data.RevokeTokens(info.Id) {
+		util.ReturnMessage(ctx, true, "吊销成功")
 	} else {
-		util.ReturnData(ctx, true, info)
+		util.ReturnMessage(ctx, false, "吊销失败")
 	}
 }
 
-// 删除设备
-func (ds DeviceService) Del(ctx *gin.Context) {
-	id, _ := strconv.ParseInt(ctx.Param("id"), 10, 64)
-	info, err := ds.Data.GetDevice(id)
+// [工具] 获取当前用户具备指定角色的设备, 无权访问时返回错误
+func (ds DeviceService) access(ctx *gin.Context, id, need string) (*model.Device, bool) {
+	return deviceAccess(ctx, ds.Data, ds.Members, id, need)
+}
+
+// [工具] 按设备编号获取设备并校验当前用户的角色
+func deviceAccess(ctx *gin.Context, data *model.DeviceModel, members *model.MemberModel, id, need string) (*model.Device, bool) {
+	deviceId, err := strconv.ParseInt(id, 10, 64)
+	if err != nil || deviceId <= 0 {
+		util.ReturnError(ctx, util.Errors.ParamIllegalError)
+		return nil, false
+	}
+	info, err := data.GetDevice(deviceId)
 	uid, _ := strconv.ParseInt(ctx.GetString("uid"), 10, 64)
 	if err != nil {
 		util.ReturnError(ctx, util.Errors.UnexpectedError)
-		return
+		return nil, false
 	} else if info == nil {
 		util.ReturnMessage(ctx, false, "设备不存在")
-		return
-	} else if uid != 1 && uid != info.UId {
+		return nil, false
+	}
+	role, err := members.GetRole(info, uid)
+	if err != nil {
+		util.ReturnError(ctx, util.Errors.UnexpectedError)
+		return nil, false
+	} else if !model.RoleAllows(role, need) {
 		util.ReturnMessage(ctx, false, "非法访问")
+		return nil, false
+	}
+	info.Role = role
+	return info, true
+}
+
+// 删除设备, 共同所有者不能删除
+func (ds DeviceService) Del(ctx *gin.Context) {
+	info, ok := ds.access(ctx, ctx.Param("id"), model.RoleOwner)
+	if !ok {
+		return
+	}
+	uid, _ := strconv.ParseInt(ctx.GetString("uid"), 10, 64)
+	if !model.PrimaryOwner(info, uid) {
+		util.ReturnMessage(ctx, false, "只有设备注册者可以删除设备")
 		return
 	}
+	id := info.Id
 	if ds.Data.DelDevice(id) {
+		ds.Presence.DelPresence(id)
+		ds.Events.DelEvent(id)
+		ds.Members.DelMembers(id)
 		util.ReturnData(ctx, true, "删除成功")
 	} else {
 		util.ReturnData(ctx, false, "删除失败")
@@ -0,0 +1,189 @@
+package core
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skye-z/ons/cloud-server/util"
+)
+
+// 限速桶清理间隔
+const limitPrunePeriod = time.Minute
+
+// 访问频率限制, 各实例独立计数
+type Limits struct {
+	// 每个 IP 的 WebSocket 握手次数/分钟
+	Upgrade *rateLimit
+	// 每个 IP 连接或注册不存在、未授权设备的次数/分钟, 防止探测 NAT 编号
+	Probe *rateLimit
+	// 每个用户的接口请求次数/分钟, 未登录按 IP 计
+	API *rateLimit
+	// 每个连接每秒的消息数, 0 为不限
+	message float64
+	// 允许的 WebSocket 来源
+	origins []string
+}
+
+// 创建访问频率限制
+func CreateLimits() *Limits {
+	limits := &Limits{
+		Upgrade: newRateLimit(float64(util.GetInt("limit.upgrade")) / 60),
+		Probe:   newRateLimit(float64(util.GetInt("limit.probe")) / 60),
+		API:     newRateLimit(float64(util.GetInt("limit.api")) / 60),
+		message: float64(util.GetInt("limit.message")),
+	}
+	for _, origin := range strings.Split(util.GetString("limit.origins"), ",") {
+		if origin = strings.TrimSpace(origin); origin != "" {
+			limits.origins = append(limits.origins, strings.TrimSuffix(origin, "/"))
+		}
+	}
+	return limits
+}
+
+// 校验 WebSocket 来源, 非浏览器客户端不携带 Origin
+func (l *Limits) CheckOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	if u, err := url.Parse(origin); err == nil && strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, allowed := range l.origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	log.Printf("[Limit] origin %s rejected", origin)
+	return false
+}
+
+// 接口限速中间件, key 为空时按 IP 计
+func (l *Limits) Handler(key func(ctx *gin.Context) string) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		id := key(ctx)
+		if id == "" {
+			id = ctx.ClientIP()
+		}
+		if !l.API.allow(id) {
+			ctx.AbortWithStatusJSON(http.StatusTooManyRequests, util.Errors.TooManyRequestsError)
+		}
+	}
+}
+
+// [工具] 创建单个连接的消息限速桶, 允许两倍速率的突发
+func (l *Limits) messageBucket() *tokenBucket {
+	if l == nil || l.message <= 0 {
+		return nil
+	}
+	return newTokenBucket(l.message, l.message*2)
+}
+
+// 按键计数的令牌桶限速, 桶容量为一分钟的配额
+type rateLimit struct {
+	// 每秒补充的令牌数, 0 为不限
+	rate    float64
+	buckets map[string]*tokenBucket
+	mu      sync.Mutex
+}
+
+func newRateLimit(rate float64) *rateLimit {
+	rl := &rateLimit{
+		rate:    rate,
+		buckets: make(map[string]*tokenBucket),
+	}
+	if rate > 0 {
+		go rl.prune()
+	}
+	return rl
+}
+
+// 消耗一个令牌, 不足时返回 false
+func (rl *rateLimit) allow(key string) bool {
+	if rl == nil || rl.rate <= 0 {
+		return true
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.bucket(key).take()
+}
+
+// 检查令牌是否已耗尽, 不消耗令牌
+func (rl *rateLimit) exhausted(key string) bool {
+	if rl == nil || rl.rate <= 0 {
+		return false
+	}
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	bucket := rl.bucket(key)
+	bucket.refill()
+	return bucket.tokens < 1
+}
+
+// [工具] 获取或创建令牌桶, 调用方需持有锁
+func (rl *rateLimit) bucket(key string) *tokenBucket {
+	bucket, ok := rl.buckets[key]
+	if !ok {
+		// 至少允许一次请求
+		burst := rl.rate * 60
+		if burst < 1 {
+			burst = 1
+		}
+		bucket = newTokenBucket(rl.rate, burst)
+		rl.buckets[key] = bucket
+	}
+	return bucket
+}
+
+// 定时清理已补满的令牌桶, 与新建的桶等价
+func (rl *rateLimit) prune() {
+	ticker := time.NewTicker(limitPrunePeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		rl.mu.Lock()
+		for key, bucket := range rl.buckets {
+			bucket.refill()
+			if bucket.tokens >= bucket.burst {
+				delete(rl.buckets, key)
+			}
+		}
+		rl.mu.Unlock()
+	}
+}
+
+// 令牌桶
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *tokenBucket {
+	return &tokenBucket{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// 消耗一个令牌, 不足时返回 false
+func (tb *tokenBucket) take() bool {
+	tb.refill()
+	if tb.tokens < 1 {
+		return false
+	}
+	tb.tokens--
+	return true
+}
+
+// [工具] 按经过的时间补充令牌
+func (tb *tokenBucket) refill() {
+	now := time.Now()
+	tb.tokens += now.Sub(tb.last).Seconds() * tb.rate
+	if tb.tokens > tb.burst {
+		tb.tokens = tb.burst
+	}
+	tb.last = now
+}
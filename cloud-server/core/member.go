@@ -0,0 +1,207 @@
+package core
+
+import (
+	"log"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skye-z/ons/cloud-server/model"
+	"github.com/skye-z/ons/cloud-server/util"
+	"xorm.io/xorm"
+)
+
+// 设备共享服务
+type MemberService struct {
+	Data   *model.MemberModel
+	Device *model.DeviceModel
+	User   *model.UserModel
+	P2P    *P2PService
+}
+
+func CreateMemberService(engine *xorm.Engine, p2p *P2PService) *MemberService {
+	return &MemberService{
+		Data:   &model.MemberModel{DB: engine},
+		Device: &model.DeviceModel{DB: engine},
+		User:   &model.UserModel{DB: engine},
+		P2P:    p2p,
+	}
+}
+
+// 获取设备成员列表, 设备所有者排在首位
+func (ms MemberService) GetList(ctx *gin.Context) {
+	info, ok := deviceAccess(ctx, ms.Device, ms.Data, ctx.Param("id"), model.RoleViewer)
+	if !ok {
+		return
+	}
+	list, err := ms.Data.GetMemberList(info.Id)
+	if err != nil {
+		util.ReturnError(ctx, util.Errors.UnexpectedError)
+		return
+	}
+	members := []map[string]any{ms.member(model.DeviceMember{
+		UId:      info.UId,
+		Role:     model.RoleOwner,
+		Accepted: true,
+	})}
+	for _, item := range list {
+		members = append(members, ms.member(item))
+	}
+	util.ReturnData(ctx, true, members)
+}
+
+// 按用户名或邮箱邀请成员, 已邀请的用户更新角色
+// 共同所有者只能管理编辑者与查看者, 授予或变更所有者角色须由主所有者操作
+func (ms MemberService) Invite(ctx *gin.Context) {
+	info, ok := deviceAccess(ctx, ms.Device, ms.Data, ctx.Param("id"), model.RoleOwner)
+	if !ok {
+		return
+	}
+	role := ctx.PostForm("role")
+	if !model.ValidRole(role) {
+		util.ReturnError(ctx, util.Errors.ParamIllegalError)
+		return
+	}
+	uid, _ := strconv.ParseInt(ctx.GetString("uid"), 10, 64)
+	primary := model.PrimaryOwner(info, uid)
+	if role == model.RoleOwner && !primary {
+		util.ReturnMessage(ctx, false, "只有设备注册者可以授予所有者角色")
+		return
+	}
+	target, err := ms.User.FindUserId(ctx.PostForm("account"))
+	if err != nil {
+		util.ReturnError(ctx, util.Errors.UnexpectedError)
+		return
+	} else if target == 0 {
+		util.ReturnMessage(ctx, false, "用户不存在")
+		return
+	}
+	if target == uid || target == info.UId {
+		util.ReturnMessage(ctx, false, "该用户已是设备所有者")
+		return
+	}
+	member, err := ms.Data.FindMember(info.Id, target)
+	if err != nil {
+		util.ReturnError(ctx, util.Errors.UnexpectedError)
+		return
+	}
+	if member != nil {
+		if member.Role == model.RoleOwner && !primary {
+			util.ReturnMessage(ctx, false, "只有设备注册者可以变更所有者角色")
+			return
+		}
+		if ms.Data.UpdateRole(member.Id, role) {
+			// 降为查看者后不能再连接设备
+			if !model.RoleAllows(role, model.RoleEditor) {
+				ms.P2P.Kick(info.Id, target)
+			}
+			util.ReturnMessage(ctx, true, "角色已更新")
+		} else {
+			util.ReturnMessage(ctx, false, "角色更新失败")
+		}
+		return
+	}
+	if ms.Data.AddMember(info.Id, target, uid, role) {
+		log.Printf("[Member] device %d shared with user %d as %s", info.Id, target, role)
+		util.ReturnMessage(ctx, true, "邀请成功")
+	} else {
+		util.ReturnMessage(ctx, false, "邀请失败")
+	}
+}
+
+// 移除成员, 成员本人可拒绝邀请或退出共享, 共同所有者只能由主所有者移除
+func (ms MemberService) Revoke(ctx *gin.Context) {
+	id, _ := strconv.ParseInt(ctx.Param("mid"), 10, 64)
+	member, err := ms.Data.GetMember(id)
+	if err != nil {
+		util.ReturnError(ctx, util.Errors.UnexpectedError)
+		return
+	} else if member == nil || strconv.FormatInt(member.DeviceId, 10) != ctx.Param("id") {
+		util.ReturnMessage(ctx, false, "成员不存在")
+		return
+	}
+	uid, _ := strconv.ParseInt(ctx.GetString("uid"), 10, 64)
+	if member.UId != uid {
+		info, ok := deviceAccess(ctx, ms.Device, ms.Data, ctx.Param("id"), model.RoleOwner)
+		if !ok {
+			return
+		} else if member.Role == model.RoleOwner && !model.PrimaryOwner(info, uid) {
+			util.ReturnMessage(ctx, false, "只有设备注册者可以移除所有者")
+			return
+		}
+	}
+	if ms.Data.DelMember(member.Id) {
+		ms.P2P.Kick(member.DeviceId, member.UId)
+		log.Printf("[Member] user %d removed from device %d", member.UId, member.DeviceId)
+		util.ReturnMessage(ctx, true, "移除成功")
+	} else {
+		util.ReturnMessage(ctx, false, "移除失败")
+	}
+}
+
+// 获取当前用户待接受的邀请
+func (ms MemberService) GetInvites(ctx *gin.Context) {
+	uid, _ := strconv.ParseInt(ctx.GetString("uid"), 10, 64)
+	list, err := ms.Data.GetInviteList(uid)
+	if err != nil {
+		util.ReturnError(ctx, util.Errors.UnexpectedError)
+		return
+	}
+	invites := []map[string]any{}
+	for _, item := range list {
+		info, err := ms.Device.GetDevice(item.DeviceId)
+		if err != nil || info == nil {
+			continue
+		}
+		invite := map[string]any{
+			"id":       item.Id,
+			"deviceId": item.DeviceId,
+			"name":     info.Name,
+			"role":     item.Role,
+			"created":  item.Created,
+		}
+		if inviter, err := ms.User.GetUser(item.Inviter); err == nil && inviter != nil {
+			invite["inviter"] = inviter.Nickname
+		}
+		invites = append(invites, invite)
+	}
+	util.ReturnData(ctx, true, invites)
+}
+
+// 接受邀请
+func (ms MemberService) Accept(ctx *gin.Context) {
+	id, _ := strconv.ParseInt(ctx.Param("mid"), 10, 64)
+	uid, _ := strconv.ParseInt(ctx.GetString("uid"), 10, 64)
+	member, err := ms.Data.GetMember(id)
+	if err != nil {
+		util.ReturnError(ctx, util.Errors.UnexpectedError)
+		return
+	} else if member == nil || member.UId != uid {
+		util.ReturnMessage(ctx, false, "邀请不存在")
+		return
+	}
+	if ms.Data.AcceptMember(member.Id) {
+		util.ReturnMessage(ctx, true, "已加入共享")
+	} else {
+		util.ReturnMessage(ctx, false, "操作失败")
+	}
+}
+
+// [工具] 附带用户信息的成员记录, 接受邀请前不公开对方资料
+func (ms MemberService) member(item model.DeviceMember) map[string]any {
+	member := map[string]any{
+		"id":       item.Id,
+		"uid":      item.UId,
+		"role":     item.Role,
+		"accepted": item.Accepted,
+		"created":  item.Created,
+	}
+	if !item.Accepted {
+		return member
+	}
+	if user, err := ms.User.GetUser(item.UId); err == nil && user != nil {
+		member["nickname"] = user.Nickname
+		member["username"] = user.Username
+		member["avatar"] = user.Avatar
+	}
+	return member
+}
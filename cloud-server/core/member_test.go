@@ -0,0 +1,174 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skye-z/ons/cloud-server/model"
+	"xorm.io/xorm"
+)
+
+// [工具] 创建共享设备: 用户 2 注册, 3 为共同所有者, 4 为编辑者, 5 为查看者, 8 为另一所有者
+func memberFixture(t *testing.T) (*xorm.Engine, *MemberService, chan [2]int64) {
+	engine := testEngine(t)
+	if err := engine.Sync2(new(model.Presence), new(model.DeviceEvent)); err != nil {
+		t.Fatal(err)
+	}
+	for id := int64(1); id <= 8; id++ {
+		engine.Insert(&model.User{Id: id, Username: "user" + strconv.FormatInt(id, 10)})
+	}
+	engine.Insert(&model.Device{UId: 2, Name: "nas", NatId: "K7Q2M9X4PW"})
+	members := &model.MemberModel{DB: engine}
+	for uid, role := range map[int64]string{3: model.RoleOwner, 4: model.RoleEditor, 5: model.RoleViewer, 8: model.RoleOwner} {
+		members.AddMember(1, uid, 2, role)
+	}
+	engine.Table(new(model.DeviceMember)).Update(map[string]any{"accepted": true})
+
+	broker := newMemoryBroker()
+	kicks := make(chan [2]int64, 16)
+	broker.Subscribe("kick", func(data []byte) {
+		var notice struct {
+			Device int64 `json:"device"`
+			UId    int64 `json:"uid"`
+		}
+		json.Unmarshal(data, &notice)
+		kicks <- [2]int64{notice.Device, notice.UId}
+	})
+	return engine, CreateMemberService(engine, &P2PService{Broker: broker}), kicks
+}
+
+// [工具] 以指定用户调用接口, 返回结果状态与提示
+func callMember(handler gin.HandlerFunc, uid int64, params gin.Params, form url.Values) (bool, string) {
+	gin.SetMode(gin.TestMode)
+	recorder := httptest.NewRecorder()
+	ctx, _ := gin.CreateTestContext(recorder)
+	ctx.Request = httptest.NewRequest(http.MethodPost, "/", strings.NewReader(form.Encode()))
+	ctx.Request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	ctx.Params = params
+	ctx.Set("uid", strconv.FormatInt(uid, 10))
+	handler(ctx)
+	var body struct {
+		State   bool   `json:"state"`
+		Message string `json:"message"`
+	}
+	json.Unmarshal(recorder.Body.Bytes(), &body)
+	return body.State, body.Message
+}
+
+// [工具] 查询用户在设备上的成员角色, 非成员为空
+func memberRole(t *testing.T, ms *MemberService, uid int64) string {
+	member, err := ms.Data.FindMember(1, uid)
+	if err != nil {
+		t.Fatal(err)
+	} else if member == nil {
+		return ""
+	}
+	return member.Role
+}
+
+func TestMemberInvite(t *testing.T) {
+	_, ms, kicks := memberFixture(t)
+	device := gin.Params{{Key: "id", Value: "1"}}
+	for _, c := range []struct {
+		name    string
+		uid     int64
+		account string
+		role    string
+		ok      bool
+		want    string
+	}{
+		{"editor cannot invite", 4, "user6", model.RoleViewer, false, ""},
+		{"viewer cannot invite", 5, "user6", model.RoleViewer, false, ""},
+		{"unknown role", 2, "user6", "admin", false, ""},
+		{"unknown user", 2, "nobody", model.RoleViewer, false, ""},
+		{"registered owner", 3, "user2", model.RoleViewer, false, ""},
+		{"co-owner invites viewer", 3, "user6", model.RoleViewer, true, model.RoleViewer},
+		// 只有主所有者可以授予或变更所有者角色
+		{"co-owner grants owner", 3, "user6", model.RoleOwner, false, model.RoleViewer},
+		{"co-owner demotes owner", 3, "user8", model.RoleViewer, false, model.RoleOwner},
+		{"co-owner demotes editor", 3, "user4", model.RoleViewer, true, model.RoleViewer},
+		{"primary grants owner", 2, "user6", model.RoleOwner, true, model.RoleOwner},
+		{"admin grants owner", 1, "user7", model.RoleOwner, true, model.RoleOwner},
+		{"primary demotes owner", 2, "user8", model.RoleEditor, true, model.RoleEditor},
+	} {
+		form := url.Values{"account": {c.account}, "role": {c.role}}
+		if ok, message := callMember(ms.Invite, c.uid, device, form); ok != c.ok {
+			t.Errorf("%s: state %v (%s), want %v", c.name, ok, message, c.ok)
+		}
+		target, _ := ms.User.FindUserId(c.account)
+		if c.want != "" && memberRole(t, ms, target) != c.want {
+			t.Errorf("%s: role %q, want %q", c.name, memberRole(t, ms, target), c.want)
+		}
+	}
+	// 降为查看者后断开其连接
+	if kick := <-kicks; kick != [2]int64{1, 4} {
+		t.Fatalf("kick = %v, want editor demoted", kick)
+	}
+	select {
+	case kick := <-kicks:
+		t.Fatalf("unexpected kick %v", kick)
+	default:
+	}
+}
+
+func TestMemberRevoke(t *testing.T) {
+	_, ms, kicks := memberFixture(t)
+	for _, c := range []struct {
+		name   string
+		uid    int64
+		target int64
+		ok     bool
+	}{
+		{"editor removes viewer", 4, 5, false},
+		{"co-owner removes owner", 3, 8, false},
+		{"co-owner removes viewer", 3, 5, true},
+		{"primary removes owner", 2, 8, true},
+		{"editor leaves", 4, 4, true},
+		{"co-owner leaves", 3, 3, true},
+	} {
+		member, _ := ms.Data.FindMember(1, c.target)
+		if member == nil {
+			t.Fatalf("%s: member %d missing", c.name, c.target)
+		}
+		params := gin.Params{{Key: "id", Value: "1"}, {Key: "mid", Value: strconv.FormatInt(member.Id, 10)}}
+		if ok, message := callMember(ms.Revoke, c.uid, params, nil); ok != c.ok {
+			t.Errorf("%s: state %v (%s), want %v", c.name, ok, message, c.ok)
+		}
+		if removed := memberRole(t, ms, c.target) == ""; removed != c.ok {
+			t.Errorf("%s: removed %v, want %v", c.name, removed, c.ok)
+		}
+		if c.ok {
+			if kick := <-kicks; kick != [2]int64{1, c.target} {
+				t.Errorf("%s: kick = %v", c.name, kick)
+			}
+		}
+	}
+	// 其他设备的成员编号不能越权使用
+	params := gin.Params{{Key: "id", Value: "2"}, {Key: "mid", Value: "1"}}
+	if ok, _ := callMember(ms.Revoke, 2, params, nil); ok {
+		t.Fatal("member removed through another device")
+	}
+}
+
+func TestDeviceDelPrimary(t *testing.T) {
+	engine, _, _ := memberFixture(t)
+	ds := CreateDeviceService(engine)
+	device := gin.Params{{Key: "id", Value: "1"}}
+	for _, uid := range []int64{3, 4, 5} {
+		if ok, _ := callMember(ds.Del, uid, device, nil); ok {
+			t.Fatalf("user %d deleted the device", uid)
+		}
+	}
+	if ok, message := callMember(ds.Del, 2, device, nil); !ok {
+		t.Fatalf("primary owner delete failed: %s", message)
+	}
+	if info, _ := ds.Data.GetDevice(1); info != nil {
+		t.Fatal("device kept after delete")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/gorilla/websocket"
@@ -16,29 +17,74 @@ import (
 )
 
 var (
-	upgrader = websocket.Upgrader{
-		ReadBufferSize:  1024,
-		WriteBufferSize: 1024,
-		CheckOrigin:     func(r *http.Request) bool { return true },
-	}
-	peers         = make(map[string]*websocket.Conn)
-	clients       = make(map[*websocket.Conn]string)
-	clientPeers   = make(map[string]*websocket.Conn)
-	clientMapping = make(map[string]string)
-	mu            sync.Mutex
+	// 本实例的 NSC 会话, 按中控分配的会话编号索引
+	sessions = make(map[string]*clientSession)
+	mu       sync.Mutex
 )
 
+const (
+	// 等待 NSB 应答注册挑战的最长时间
+	challengeWait = 10 * time.Second
+	// 重复注册时等待失效连接释放的时间
+	evictWait = 500 * time.Millisecond
+)
+
+// NSC 会话, 编号写入转发给 NSB 的消息 From 中, NSB 据此回复
+type clientSession struct {
+	ws *peerConn
+	// 已授权连接的 NAT 编号及设备所属用户
+	natId  string
+	uid    int64
+	device int64
+	// 发起连接的用户
+	member int64
+	// NSC 来源地址
+	ip string
+}
+
+// 经代理分发的信令, NatId 为消息所属的设备
+type envelope struct {
+	NatId   string  `json:"natId"`
+	Message Message `json:"message"`
+	// 实例间的控制指令, 不转发给对端
+	Control string `json:"control,omitempty"`
+}
+
 type P2PService struct {
-	Data *model.DeviceModel
+	Data     *model.DeviceModel
+	Relay    *RelayService
+	Broker   Broker
+	Limits   *Limits
+	Presence *PresenceService
+	Events   *model.EventModel
+	Members  *model.MemberModel
+	upgrader websocket.Upgrader
 }
 
-func CreateP2PService(engine *xorm.Engine) *P2PService {
+func CreateP2PService(engine *xorm.Engine, relay *RelayService, broker Broker, limits *Limits, presence *PresenceService) *P2PService {
 	data := &model.DeviceModel{
 		DB: engine,
 	}
-	return &P2PService{
-		Data: data,
+	ps := &P2PService{
+		Data:     data,
+		Relay:    relay,
+		Broker:   broker,
+		Limits:   limits,
+		Presence: presence,
+		Events:   &model.EventModel{DB: engine},
+		Members:  &model.MemberModel{DB: engine},
+		upgrader: websocket.Upgrader{
+			ReadBufferSize:  1024,
+			WriteBufferSize: 1024,
+			CheckOrigin:     limits.CheckOrigin,
+		},
+	}
+	// 成员被移除时各实例断开其会话
+	if _, err := broker.Subscribe("kick", ps.dispatchKick); err != nil {
+		util.OutErr("P2P", "subscribe failed: %v", err)
 	}
+	go ps.cleanEvents()
+	return ps
 }
 
 type Message struct {
@@ -47,20 +93,26 @@ type Message struct {
 	To    string          `json:"to,omitempty"`
 	From  string          `json:"from,omitempty"`
 	Pass  string          `json:"pass,omitempty"`
+	// NSC 来源地址, 由中控填写
+	Source string `json:"source,omitempty"`
 }
 
 func (ps P2PService) Assess(ctx *gin.Context) {
-	ws, err := upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	ip := ctx.ClientIP()
+	if !ps.Limits.Upgrade.allow(ip) {
+		log.Printf("[P2P] %s connects too frequently", ip)
+		ctx.AbortWithStatusJSON(http.StatusTooManyRequests, util.Errors.TooManyRequestsError)
+		return
+	}
+	conn, err := ps.upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
 	if err != nil {
-		ps.sendError(ws, "10001")
+		ps.sendError(nil, "10001")
 		return
 	}
-	defer func() {
-		if err := ws.Close(); err != nil {
-			log.Printf("[P2P] connection closure failed: %v", err)
-		}
-	}()
-	_, message, err := ws.ReadMessage()
+	// 发出排队的消息后关闭, 超时未响应心跳的连接由读取超时淘汰
+	ws := newPeerConn(conn, ps.Limits.messageBucket())
+	defer ws.close()
+	message, err := ws.read()
 	if err != nil {
 		ps.sendError(ws, "10002")
 		return
@@ -71,57 +123,155 @@ func (ps P2PService) Assess(ctx *gin.Context) {
 		return
 	}
 	if msg.Event == "register" {
-		// NSB注册
-		info, err := ps.Data.NATGetDevice(strings.Trim(string(msg.Data), `"`))
+		// NSB注册, 旧版编号按别名查找
+		natId := strings.Trim(string(msg.Data), `"`)
+		if ps.Limits.Probe.exhausted(ip) {
+			ps.sendError(ws, "10015")
+			return
+		}
+		info, err := ps.Data.NATGetDevice(natId)
 		if err != nil {
 			ps.sendError(ws, "10010")
 		} else if info == nil {
+			ps.Limits.Probe.allow(ip)
 			ps.sendError(ws, "10004")
+		} else if !ps.authDevice(ws, info, natId) {
+			ps.Limits.Probe.allow(ip)
+			ps.event(info.Id, "register-error", "", "10011", ip)
+			ps.sendError(ws, "10011")
 		} else {
 			// 更新在线时间
 			ps.Data.UpdateOnlineTime(info.Id)
 			// 注册设备
-			ps.register(ws, info.NatId)
+			ps.register(ws, info, ip)
 		}
 	} else if msg.Event == "connect" {
-		// NSC接入
-		ps.connet(ws, message)
+		// NSC接入, 令牌可在握手时携带, 也可放在 connect 消息的 pass 中
+		ps.connet(ws, ip, requestToken(ctx), message)
 	} else {
 		ps.sendError(ws, "10005")
-		ws.Close()
 	}
 }
 
+// 校验 NSB 对注册挑战的签名, 防止冒用 NAT 编号
+func (ps P2PService) authDevice(ws *peerConn, info *model.Device, natId string) bool {
+	if info.PublicKey == "" {
+		log.Printf("[P2P] NSB %s has no device key, register again to bind one", info.NatId)
+		return false
+	}
+	nonce := util.GenerateChallenge()
+	data, _ := json.Marshal(nonce)
+	if err := ps.sendMessage(ws, Message{
+		Event: "challenge",
+		Data:  json.RawMessage(data),
+		From:  "NSA",
+	}); err != nil {
+		return false
+	}
+	ws.limitRead(challengeWait)
+	defer ws.limitRead(0)
+	message, err := ws.read()
+	if err != nil {
+		return false
+	}
+	var msg Message
+	if err := json.Unmarshal(message, &msg); err != nil || msg.Event != "register-auth" {
+		return false
+	}
+	if !util.VerifyChallenge(info.PublicKey, natId, nonce, msg.Pass) {
+		log.Printf("[P2P] NSB %s challenge signature rejected", info.NatId)
+		return false
+	}
+	return true
+}
+
 // 注册设备
-func (ps P2PService) register(ws *websocket.Conn, natId string) {
+func (ps P2PService) register(ws *peerConn, info *model.Device, ip string) {
+	natId := info.NatId
+	// 标记丢失时断开连接, 由 NSB 重连后重新登记
+	claimed, err := ps.Broker.Claim("nsb:"+natId, ws.evict)
+	if err == nil && !claimed {
+		// 已登记的连接可能已失效但尚未超时, 要求其所在实例检查后重试
+		data, _ := json.Marshal(envelope{NatId: natId, Control: "stale-check"})
+		if delivered, _ := ps.Broker.Publish("nsb:"+natId, data); delivered {
+			time.Sleep(evictWait)
+		}
+		claimed, err = ps.Broker.Claim("nsb:"+natId, ws.evict)
+	}
+	if err != nil {
+		ps.event(info.Id, "register-error", "", "10010", ip)
+		ps.sendError(ws, "10010")
+		return
+	} else if !claimed {
+		// 同一设备已在线, 拒绝重复注册
+		log.Printf("[P2P] NSB %s is already registered", natId)
+		ps.event(info.Id, "register-error", "", "10012", ip)
+		ps.sendError(ws, "10012")
+		return
+	}
+	defer ps.Broker.Release("nsb:" + natId)
+	// 接收其他会话发往本设备的消息, 可能来自其他实例
+	cancel, err := ps.Broker.Subscribe("nsb:"+natId, func(data []byte) {
+		var env envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			return
+		}
+		if env.Control == "stale-check" {
+			if ws.stale() {
+				log.Printf("[P2P] NSB %s is stale, connection evicted", natId)
+				ws.evict()
+			}
+			return
+		}
+		ps.sendMessage(ws, env.Message)
+	})
+	if err != nil {
+		ps.event(info.Id, "register-error", "", "10010", ip)
+		ps.sendError(ws, "10010")
+		return
+	}
+	defer cancel()
 	log.Printf("[P2P] register NSB: %s", natId)
-	mu.Lock()
-	peers[natId] = ws
-	mu.Unlock()
-
+	record := ps.Presence.online(info)
+	defer ps.Presence.offline(info, record)
+	ps.event(info.Id, "register", "", "", ip)
+	// 记录断开原因, 便于排查设备离线
+	reason := ""
 	defer func() {
-		mu.Lock()
-		delete(peers, natId)
-		mu.Unlock()
+		ps.event(info.Id, "disconnect", "", reason, ip)
 	}()
 
+	// 附带当前编号, 使用旧版编号注册的 NSB 据此更新
+	data, _ := json.Marshal(natId)
 	ps.sendMessage(ws, Message{
 		Event: "online",
+		Data:  json.RawMessage(data),
 		From:  "NSA",
 	})
 
 	for {
-		_, message, err := ws.ReadMessage()
+		message, err := ws.read()
 		if err != nil {
+			reason = err.Error()
 			ps.sendError(ws, "10006")
 			break
 		}
+		if !ws.allow() {
+			ps.sendError(ws, "10015")
+			continue
+		}
 
 		// 转发信令消息
 		var msg Message
 		if err := json.Unmarshal(message, &msg); err == nil {
-			if msg.To != "" {
-				ps.relay(ws, msg)
+			if msg.Event == "p2p-report" {
+				// 连接结果仅记录, 不转发给 NSC
+				ps.report(info.Id, ip, msg)
+			} else if msg.To != "" {
+				if msg.Event == "p2p-error" {
+					ps.event(info.Id, "p2p-error", msg.To, strings.Trim(string(msg.Data), `"`), ip)
+				}
+				ps.relayToClient(ws, natId, msg)
 			}
 		} else {
 			ps.sendError(ws, "10007")
@@ -129,38 +279,129 @@ func (ps P2PService) register(ws *websocket.Conn, natId string) {
 	}
 }
 
+// NSC 接入凭据
+type clientGrant struct {
+	uid int64
+	// 设备访问令牌限定的 NAT 编号及令牌版本, 用户令牌为空
+	natId   string
+	version int64
+}
+
+// 解析 NSC 令牌, 无效时返回 nil
+func (ps P2PService) clientAuth(code string) *clientGrant {
+	if code == "" {
+		return nil
+	}
+	info, cerr := verifyToken(code)
+	if cerr != nil {
+		return nil
+	}
+	sub, err := info.GetSubject()
+	if err != nil {
+		return nil
+	}
+	grant := &clientGrant{}
+	if grant.uid, err = strconv.ParseInt(sub, 10, 64); err != nil {
+		return nil
+	}
+	if scope, _ := info["scope"].(string); scope != "" {
+		nat, _ := info["nat"].(string)
+		version, _ := info["ver"].(float64)
+		if scope != "nat" || nat == "" {
+			return nil
+		}
+		grant.natId = nat
+		grant.version = int64(version)
+	}
+	return grant
+}
+
+// 检查 NSC 是否有权连接设备, 返回设备与错误码
+func (ps P2PService) authorize(grant *clientGrant, natId string) (*model.Device, string) {
+	if grant == nil {
+		return nil, "10013"
+	}
+	info, err := ps.Data.NATGetDevice(natId)
+	if err != nil {
+		return nil, "10010"
+	} else if info == nil {
+		return nil, "10004"
+	}
+	// 无权访问时仍返回设备, 用于记录事件
+	if grant.natId != "" {
+		// 设备访问令牌仅限签发的设备, 吊销后版本不再匹配
+		if (grant.natId != info.NatId && grant.natId != info.LegacyId) || grant.version != info.TokenVer {
+			return info, "10014"
+		}
+	}
+	// 所有者及编辑者可连接, 移除成员后其令牌随之失效
+	role, err := ps.Members.GetRole(info, grant.uid)
+	if err != nil {
+		return nil, "10010"
+	} else if !model.RoleAllows(role, model.RoleEditor) {
+		return info, "10014"
+	}
+	return info, ""
+}
+
 // 连接设备
-func (ps P2PService) connet(ws *websocket.Conn, firstMessage []byte) {
-	clientID := util.GenerateRandomNumber(6)
+func (ps P2PService) connet(ws *peerConn, ip, token string, firstMessage []byte) {
+	grant := ps.clientAuth(token)
+	clientID := openSession(ws, ip)
 	log.Printf("[P2P] NSC #%s is connected", clientID)
+	// 接收 NSB 的回复, 仅接受当前连接设备的消息
+	cancel, err := ps.Broker.Subscribe("nsc:"+clientID, func(data []byte) {
+		var env envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			return
+		}
+		mu.Lock()
+		session := sessions[clientID]
+		mu.Unlock()
+		if session == nil || env.NatId != session.natId {
+			log.Printf("[P2P] NSC #%s drops message from #%s NSB", clientID, env.NatId)
+			return
+		}
+		ps.sendMessage(ws, env.Message)
+	})
+	if err != nil {
+		mu.Lock()
+		delete(sessions, clientID)
+		mu.Unlock()
+		ps.sendError(ws, "10010")
+		return
+	}
 
 	defer func() {
+		cancel()
 		mu.Lock()
-		if clientID != "" {
-			delete(clients, ws)
-			delete(clientPeers, clientMapping[clientID])
-			delete(clientMapping, clientID)
-		}
+		session := sessions[clientID]
+		delete(sessions, clientID)
 		mu.Unlock()
+		ps.leave(clientID, *session)
 		log.Printf("[P2P] NSC #%s disconnected", clientID)
 	}()
 
 	// 处理客户端的初始连接消息
-	ps.handleClientMessage(ws, clientID, firstMessage)
+	ps.handleClientMessage(ws, clientID, ip, grant, firstMessage)
 
 	for {
-		_, message, err := ws.ReadMessage()
+		message, err := ws.read()
 		if err != nil {
 			ps.sendError(ws, "10006")
 			break
 		}
+		if !ws.allow() {
+			ps.sendError(ws, "10015")
+			continue
+		}
 
-		ps.handleClientMessage(ws, clientID, message)
+		ps.handleClientMessage(ws, clientID, ip, grant, message)
 	}
 }
 
 // 处理客户端消息
-func (ps P2PService) handleClientMessage(ws *websocket.Conn, clientID string, message []byte) {
+func (ps P2PService) handleClientMessage(ws *peerConn, clientID, ip string, grant *clientGrant, message []byte) {
 	var msg Message
 	if err := json.Unmarshal(message, &msg); err != nil {
 		ps.sendError(ws, "10007")
@@ -169,16 +410,65 @@ func (ps P2PService) handleClientMessage(ws *websocket.Conn, clientID string, me
 
 	// 客户端请求连接到 Peer
 	if msg.Event == "connect" && msg.To != "" {
+		if msg.Pass != "" {
+			grant = ps.clientAuth(msg.Pass)
+		}
+		// 多次连接不存在或无权访问的设备后暂时拒绝, 防止探测 NAT 编号
+		if ps.Limits.Probe.exhausted(ip) {
+			ps.sendError(ws, "10015")
+			return
+		}
+		info, code := ps.authorize(grant, msg.To)
+		if code != "" {
+			if code != "10010" {
+				ps.Limits.Probe.allow(ip)
+			}
+			if info != nil {
+				ps.event(info.Id, "connect-error", clientID, code, ip)
+			}
+			log.Printf("[P2P] NSC #%s denied to connect #%s NSB", clientID, msg.To)
+			ps.sendError(ws, code)
+			return
+		}
+		// 旧版编号转为当前编号
+		msg.To = info.NatId
 		mu.Lock()
-		clients[ws] = msg.To
-		clientPeers[msg.To] = ws
-		clientMapping[clientID] = msg.To
+		session := sessions[clientID]
+		previous := *session
+		session.natId = msg.To
+		session.uid = info.UId
+		session.device = info.Id
+		session.member = grant.uid
 		mu.Unlock()
+		// 同一会话改连其他设备时通知原设备
+		if previous.natId != msg.To {
+			ps.leave(clientID, previous)
+			ps.Broker.Join("link:"+msg.To, clientID)
+			ps.Presence.client("connect", msg.To, clientID, info.UId)
+		}
+
+		// 向 NSB 下发 ICE 服务器
+		iceServers := ps.iceServers(msg.To, clientID, grant.uid)
+		iceData, _ := json.Marshal(iceServers)
+		if len(iceServers) > 0 {
+			ps.publish("nsb:"+msg.To, msg.To, Message{
+				Event: "ice-config",
+				Data:  json.RawMessage(iceData),
+				To:    msg.To,
+				From:  "NSA",
+			})
+		}
 
-		// 发送确认消息给客户端
+		// 发送确认消息给客户端, 附带 ICE 服务器
+		data, _ := json.Marshal(map[string]any{
+			"message":    "准许连接 #" + msg.To + " NSB",
+			"natId":      msg.To,
+			"session":    clientID,
+			"iceServers": iceServers,
+		})
 		msg := Message{
 			Event: "connect",
-			Data:  json.RawMessage(`"准许连接 #` + msg.To + ` NSB"`),
+			Data:  json.RawMessage(data),
 			To:    msg.To,
 			From:  "NSA",
 		}
@@ -187,38 +477,181 @@ func (ps P2PService) handleClientMessage(ws *websocket.Conn, clientID string, me
 		} else {
 			// 更新连接时间
 			ps.Data.UpdateConnectTime(msg.To)
+			ps.event(info.Id, "connect", clientID, "", ip)
 			log.Printf("[P2P] NSC applies to connect #%s NSB", msg.To)
 		}
-	} else if msg.Event == "p2p-error" || msg.Event == "p2p-exchange" || msg.Event == "p2p-node" {
-		ps.relay(ws, msg)
+	} else if msg.Event == "pake-init" || msg.Event == "p2p-error" || msg.Event == "p2p-exchange" || msg.Event == "p2p-node" || msg.Event == "relay-data" {
+		// 仅转发给已授权连接的设备
+		mu.Lock()
+		target := sessions[clientID].natId
+		mu.Unlock()
+		if target == "" || target != msg.To {
+			ps.sendError(ws, "10014")
+			return
+		}
+		// relay-data 为端到端加密的同步数据, 中控仅转发
+		msg.From = clientID
+		msg.Source = ip
+		ps.relayToPeer(ws, msg)
 	}
 }
 
-// 转发消息
-func (ps P2PService) relay(now *websocket.Conn, msg Message) {
-	var ws *websocket.Conn
-	var peerExists bool
-	if msg.From == "NSC" {
-		mu.Lock()
-		ws, peerExists = peers[msg.To]
-		mu.Unlock()
-	} else if msg.From == "NSB" {
-		mu.Lock()
-		ws, peerExists = clientPeers[msg.To]
-		mu.Unlock()
+// 获取下发的 ICE 服务器, 启用内置中继时附带临时凭据
+func (ps P2PService) iceServers(natId, session string, member int64) []util.ICEServer {
+	servers := util.ICEServers()
+	if ps.Relay != nil {
+		servers = append(servers, ps.Relay.Credentials(natId, session, member))
 	}
+	return servers
+}
 
-	if peerExists {
-		if err := ps.sendMessage(ws, msg); err != nil {
-			log.Printf("[P2P] mssage sending failed %s: %v", msg.To, err)
+// [工具] 分配 NSC 会话编号
+func openSession(ws *peerConn, ip string) string {
+	mu.Lock()
+	defer mu.Unlock()
+	for {
+		id := util.GenerateRandomString(16)
+		if _, exists := sessions[id]; !exists {
+			sessions[id] = &clientSession{ws: ws, ip: ip}
+			return id
 		}
-	} else {
+	}
+}
+
+// 断开用户连接设备的全部会话, 用于移除成员或降低角色
+func (ps P2PService) Kick(device, uid int64) {
+	data, _ := json.Marshal(map[string]int64{"device": device, "uid": uid})
+	if _, err := ps.Broker.Publish("kick", data); err != nil {
+		log.Printf("[P2P] kick user %d from device %d: %v", uid, device, err)
+	}
+}
+
+// [工具] 断开本实例上被移除用户的会话与中继, 并通知 NSB 关闭对等连接
+func (ps P2PService) dispatchKick(data []byte) {
+	var notice struct {
+		Device int64 `json:"device"`
+		UId    int64 `json:"uid"`
+	}
+	if err := json.Unmarshal(data, &notice); err != nil {
+		return
+	}
+	mu.Lock()
+	kicked := make(map[string]clientSession)
+	for id, session := range sessions {
+		if session.device == notice.Device && session.member == notice.UId {
+			kicked[id] = *session
+		}
+	}
+	mu.Unlock()
+	if ps.Relay != nil {
+		ids := make([]string, 0, len(kicked))
+		for id := range kicked {
+			ids = append(ids, id)
+		}
+		ps.Relay.Revoke(notice.Device, notice.UId, ids...)
+	}
+	for id, session := range kicked {
+		ps.publish("nsb:"+session.natId, session.natId, Message{
+			Event: "kick",
+			To:    session.natId,
+			From:  id,
+		})
+		log.Printf("[P2P] NSC #%s access revoked", id)
+		session.ws.evict()
+	}
+}
+
+// 通知 NSB 会话已离开, 便于及时释放资源
+func (ps P2PService) leave(clientID string, session clientSession) {
+	natId := session.natId
+	if natId == "" {
+		return
+	}
+	ps.Broker.Leave("link:"+natId, clientID)
+	ps.Presence.client("disconnect", natId, clientID, session.uid)
+	ps.event(session.device, "leave", clientID, "", session.ip)
+	ps.publish("nsb:"+natId, natId, Message{
+		Event: "leave",
+		To:    natId,
+		From:  clientID,
+	})
+}
+
+// 记录 NSB 报告的连接结果
+func (ps P2PService) report(deviceId int64, ip string, msg Message) {
+	var result struct {
+		State  string `json:"state"`
+		Detail string `json:"detail"`
+	}
+	if err := json.Unmarshal(msg.Data, &result); err != nil {
+		return
+	}
+	switch result.State {
+	case "connected":
+		// 详情为本地/远端候选类型, 如 host/srflx
+		ps.event(deviceId, "ice", msg.To, result.Detail, ip)
+	case "relay":
+		ps.event(deviceId, "relay", msg.To, "", ip)
+	case "failed":
+		ps.event(deviceId, "p2p-error", msg.To, result.Detail, ip)
+	}
+}
+
+// [工具] 记录设备事件
+func (ps P2PService) event(deviceId int64, kind, session, detail, ip string) {
+	if !ps.Events.AddEvent(&model.DeviceEvent{
+		DeviceId: deviceId,
+		Type:     kind,
+		Session:  session,
+		Detail:   detail,
+		IP:       ip,
+	}) {
+		log.Printf("[P2P] record %s event failed", kind)
+	}
+}
+
+// 定时清理超出保留期的设备事件
+func (ps P2PService) cleanEvents() {
+	ticker := time.NewTicker(presenceClean)
+	defer ticker.Stop()
+	for range ticker.C {
+		days := util.GetInt("event.days")
+		if days <= 0 {
+			continue
+		}
+		before := time.Now().AddDate(0, 0, -days).Unix() * 1000
+		if !ps.Events.CleanEvent(before) {
+			log.Println("[P2P] clean events failed")
+		}
+	}
+}
+
+// 转发 NSC 消息给 NSB
+func (ps P2PService) relayToPeer(now *peerConn, msg Message) {
+	if !ps.publish("nsb:"+msg.To, msg.To, msg) {
+		ps.sendError(now, "10008")
+	}
+}
+
+// 转发 NSB 消息给指定会话的 NSC, 由会话所在实例校验来源设备
+func (ps P2PService) relayToClient(now *peerConn, natId string, msg Message) {
+	if !ps.publish("nsc:"+msg.To, natId, msg) {
 		ps.sendError(now, "10008")
 	}
 }
 
+// [工具] 经代理投递消息, 返回是否有接收者
+func (ps P2PService) publish(channel, natId string, msg Message) bool {
+	data, _ := json.Marshal(envelope{NatId: natId, Message: msg})
+	delivered, err := ps.Broker.Publish(channel, data)
+	if err != nil {
+		log.Printf("[P2P] mssage sending failed %s: %v", channel, err)
+	}
+	return delivered
+}
+
 // 发送消息
-func (ps P2PService) sendError(ws *websocket.Conn, msg string) error {
+func (ps P2PService) sendError(ws *peerConn, msg string) error {
 	log.Printf("[P2P] error: %s", msg)
 	if ws == nil {
 		return nil
@@ -228,19 +661,19 @@ func (ps P2PService) sendError(ws *websocket.Conn, msg string) error {
 		Data:  json.RawMessage(msg),
 		From:  "NSA",
 	})
-	return ws.WriteMessage(websocket.TextMessage, msgBytes)
+	return ws.write(msgBytes)
 }
 
 // 发送消息
-func (ps P2PService) sendMessage(ws *websocket.Conn, msg Message) error {
+func (ps P2PService) sendMessage(ws *peerConn, msg Message) error {
 	msgBytes, _ := json.Marshal(msg)
-	return ws.WriteMessage(websocket.TextMessage, msgBytes)
+	return ws.write(msgBytes)
 }
 
 // 检查连接状态
 func (ps P2PService) CheckOnline(ctx *gin.Context) {
 	uid, _ := strconv.ParseInt(ctx.GetString("uid"), 10, 64)
-	list, err := ps.Data.GetDeviceList(uid, 1, 100)
+	list, err := ps.Data.GetAccessList(uid, 1, 100)
 	if err != nil {
 		util.ReturnMessage(ctx, false, "获取状态失败")
 		return
@@ -251,10 +684,8 @@ func (ps P2PService) CheckOnline(ctx *gin.Context) {
 	connect := make(map[string]bool)
 	for _, device := range list {
 		id := device.NatId
-		_, oe := peers[id]
-		online[id] = oe
-		_, ce := clientPeers[id]
-		connect[id] = ce
+		online[id] = ps.Broker.Claimed("nsb:" + id)
+		connect[id] = ps.Broker.Members("link:"+id) > 0
 	}
 	date["online"] = online
 	date["connect"] = connect
@@ -0,0 +1,216 @@
+package core
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skye-z/ons/cloud-server/model"
+	"github.com/skye-z/ons/cloud-server/util"
+	"xorm.io/xorm"
+)
+
+const (
+	// 在线记录心跳间隔
+	presenceBeat = time.Minute
+	// 过期记录清理间隔
+	presenceClean = time.Hour
+	// 推送连接保活间隔
+	presenceKeepalive = 25 * time.Second
+	// 每个推送连接的待发送事件数
+	presenceQueue = 32
+)
+
+// 设备状态事件
+type PresenceEvent struct {
+	// online/offline 为 NAS 上下线, connect/disconnect 为插件连接与断开
+	Type  string `json:"type"`
+	NatId string `json:"natId"`
+	// 设备所属用户
+	UId int64 `json:"uid"`
+	// 插件会话编号及设备当前的会话数
+	Session string `json:"session,omitempty"`
+	Clients int    `json:"clients"`
+	Time    int64  `json:"time"`
+}
+
+// 设备状态服务, 记录在线历史并推送状态变化
+type PresenceService struct {
+	Data    *model.PresenceModel
+	Devices *model.DeviceModel
+	Broker  Broker
+	// 本实例的推送连接
+	listeners map[*presenceListener]bool
+	mu        sync.Mutex
+}
+
+// 推送连接
+type presenceListener struct {
+	uid int64
+	// 连接时已共享给该用户的设备
+	shared map[string]bool
+	events chan PresenceEvent
+}
+
+// 设备在线期间的记录
+type presenceRecord struct {
+	id   int64
+	stop chan struct{}
+}
+
+func CreatePresenceService(engine *xorm.Engine, broker Broker) *PresenceService {
+	pres := &PresenceService{
+		Data:      &model.PresenceModel{DB: engine},
+		Devices:   &model.DeviceModel{DB: engine},
+		Broker:    broker,
+		listeners: make(map[*presenceListener]bool),
+	}
+	// 事件经代理广播, 各实例推送给本地连接
+	if _, err := broker.Subscribe("presence", pres.dispatch); err != nil {
+		util.OutErr("Presence", "subscribe failed: %v", err)
+	}
+	go pres.clean()
+	return pres
+}
+
+// 推送当前用户设备的状态变化
+func (pres *PresenceService) Stream(ctx *gin.Context) {
+	uid, _ := strconv.ParseInt(ctx.GetString("uid"), 10, 64)
+	listener := &presenceListener{
+		uid:    uid,
+		shared: make(map[string]bool),
+		events: make(chan PresenceEvent, presenceQueue),
+	}
+	if uid != 1 {
+		list, _ := pres.Devices.GetAccessList(uid, 1, 100)
+		for _, device := range list {
+			if device.UId != uid {
+				listener.shared[device.NatId] = true
+			}
+		}
+	}
+	pres.mu.Lock()
+	pres.listeners[listener] = true
+	pres.mu.Unlock()
+	defer func() {
+		pres.mu.Lock()
+		delete(pres.listeners, listener)
+		pres.mu.Unlock()
+	}()
+
+	ctx.Header("Content-Type", "text/event-stream")
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("X-Accel-Buffering", "no")
+	ctx.Status(http.StatusOK)
+	ctx.Writer.Flush()
+	ticker := time.NewTicker(presenceKeepalive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Request.Context().Done():
+			return
+		case event := <-listener.events:
+			ctx.SSEvent("presence", event)
+		case <-ticker.C:
+			// 注释行保活, 避免代理断开空闲连接
+			if _, err := ctx.Writer.WriteString(": ping\n\n"); err != nil {
+				return
+			}
+		}
+		ctx.Writer.Flush()
+	}
+}
+
+// 记录设备上线并推送, 在线期间定时写入心跳
+func (pres *PresenceService) online(info *model.Device) *presenceRecord {
+	record := &presenceRecord{
+		id:   pres.Data.AddOnline(info.Id),
+		stop: make(chan struct{}),
+	}
+	if record.id == 0 {
+		log.Printf("[Presence] NSB %s online record failed", info.NatId)
+	} else {
+		go func() {
+			ticker := time.NewTicker(presenceBeat)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-record.stop:
+					return
+				case <-ticker.C:
+					pres.Data.UpdateSeen(record.id)
+				}
+			}
+		}()
+	}
+	pres.publish(PresenceEvent{Type: "online", NatId: info.NatId, UId: info.UId})
+	return record
+}
+
+// 记录设备下线并推送
+func (pres *PresenceService) offline(info *model.Device, record *presenceRecord) {
+	close(record.stop)
+	if record.id != 0 {
+		pres.Data.UpdateOffline(record.id)
+	}
+	pres.publish(PresenceEvent{Type: "offline", NatId: info.NatId, UId: info.UId})
+}
+
+// 推送插件连接或断开, 附带设备当前的会话数
+func (pres *PresenceService) client(kind, natId, session string, uid int64) {
+	pres.publish(PresenceEvent{
+		Type:    kind,
+		NatId:   natId,
+		UId:     uid,
+		Session: session,
+		Clients: pres.Broker.Members("link:" + natId),
+	})
+}
+
+// [工具] 经代理广播事件
+func (pres *PresenceService) publish(event PresenceEvent) {
+	event.Time = time.Now().Unix() * 1000
+	data, _ := json.Marshal(event)
+	if _, err := pres.Broker.Publish("presence", data); err != nil {
+		log.Printf("[Presence] publish %s failed: %v", event.Type, err)
+	}
+}
+
+// [工具] 分发事件给有权查看的本地连接, 连接阻塞时丢弃
+func (pres *PresenceService) dispatch(data []byte) {
+	var event PresenceEvent
+	if err := json.Unmarshal(data, &event); err != nil {
+		return
+	}
+	pres.mu.Lock()
+	defer pres.mu.Unlock()
+	for listener := range pres.listeners {
+		if listener.uid != 1 && listener.uid != event.UId && !listener.shared[event.NatId] {
+			continue
+		}
+		select {
+		case listener.events <- event:
+		default:
+		}
+	}
+}
+
+// 定时清理超出保留期的在线记录
+func (pres *PresenceService) clean() {
+	ticker := time.NewTicker(presenceClean)
+	defer ticker.Stop()
+	for range ticker.C {
+		days := util.GetInt("presence.days")
+		if days <= 0 {
+			continue
+		}
+		before := time.Now().AddDate(0, 0, -days).Unix() * 1000
+		if !pres.Data.CleanPresence(before) {
+			log.Println("[Presence] clean failed")
+		}
+	}
+}
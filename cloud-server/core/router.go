@@ -68,14 +68,18 @@ func BuildRouter(release bool, port int, host, cert, key string, engine *xorm.En
 
 	ds := CreateDeviceService(engine)
 	us := CreateUserService(engine)
-	ps := CreateP2PService(engine)
+	limits := CreateLimits()
+	broker := CreateBroker()
+	pres := CreatePresenceService(engine, broker)
+	ps := CreateP2PService(engine, CreateRelayService(engine), broker, limits, pres)
+	ms := CreateMemberService(engine, ps)
 
 	// 挂载鉴权路由
-	addOAuth2Route(router.Object, engine)
+	addOAuth2Route(router.Object, engine, limits)
 	// 挂载公共路由
 	addPublicRoute(router.Object, ps)
 	// 挂载私有路由
-	addPrivateRoute(router.Object, ds, ps, us)
+	addPrivateRoute(router.Object, ds, ms, ps, pres, us, limits)
 	// 兼容路由
 	router.Object.NoRoute(func(c *gin.Context) {
 		switch {
@@ -111,11 +115,13 @@ func getIndexFile(c *gin.Context, fileSystem http.FileSystem) {
 }
 
 // 授权登陆路由
-func addOAuth2Route(router *gin.Engine, engine *xorm.Engine) {
+func addOAuth2Route(router *gin.Engine, engine *xorm.Engine, limits *Limits) {
 	as := NewAuthService(engine)
 	if as != nil {
-		router.GET("/login", as.Login)
-		router.GET("/oauth2/callback", as.Callback)
+		// 按 IP 限速
+		limit := limits.Handler(func(ctx *gin.Context) string { return "" })
+		router.GET("/login", limit, as.Login)
+		router.GET("/oauth2/callback", limit, as.Callback)
 	}
 }
 
@@ -130,8 +136,13 @@ func addPublicRoute(router *gin.Engine, ps *P2PService) {
 }
 
 // 挂载私有路由
-func addPrivateRoute(router *gin.Engine, ds *DeviceService, ps *P2PService, us *UserService) {
-	private := router.Group("").Use(AuthHandler())
+func addPrivateRoute(router *gin.Engine, ds *DeviceService, ms *MemberService, ps *P2PService, pres *PresenceService, us *UserService, limits *Limits) {
+	// 先按 IP 限速, 避免无效令牌绕过限速反复校验, 再按登录用户限速
+	private := router.Group("").Use(limits.Handler(func(ctx *gin.Context) string {
+		return ""
+	}), AuthHandler(), limits.Handler(func(ctx *gin.Context) string {
+		return ctx.GetString("uid")
+	}))
 	{
 		// 注册设备
 		private.POST("/api/nas/register", ds.Register)
@@ -143,8 +154,28 @@ func addPrivateRoute(router *gin.Engine, ds *DeviceService, ps *P2PService, us *
 		private.GET("/api/nas/:id", ds.GetInfo)
 		// 删除设备
 		private.POST("/api/nas/:id", ds.Del)
+		// 签发设备访问令牌
+		private.POST("/api/nas/:id/token", ds.IssueToken)
+		// 吊销设备访问令牌
+		private.POST("/api/nas/:id/token/revoke", ds.RevokeTokens)
 		// 获取NAS在线状态
 		private.GET("/api/nas/state", ps.CheckOnline)
+		// 推送NAS状态变化
+		private.GET("/api/nas/presence", pres.Stream)
+		// 获取NAS在线历史
+		private.GET("/api/nas/:id/presence", ds.GetPresence)
+		// 获取NAS事件记录
+		private.GET("/api/nas/:id/events", ds.GetEvents)
+		// 获取NAS成员
+		private.GET("/api/nas/:id/member", ms.GetList)
+		// 邀请NAS成员
+		private.POST("/api/nas/:id/member", ms.Invite)
+		// 移除NAS成员
+		private.POST("/api/nas/:id/member/:mid/revoke", ms.Revoke)
+		// 获取待接受的共享邀请
+		private.GET("/api/member/invite", ms.GetInvites)
+		// 接受共享邀请
+		private.POST("/api/member/invite/:mid/accept", ms.Accept)
 
 		// 获取当前登录用户信息
 		private.GET("/api/user", us.GetLoginUser)
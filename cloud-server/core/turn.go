@@ -0,0 +1,326 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pion/turn/v2"
+	"github.com/skye-z/ons/cloud-server/model"
+	"github.com/skye-z/ons/cloud-server/util"
+	"xorm.io/xorm"
+)
+
+const turnRealm = "ons"
+
+// 中继用量写入间隔
+const relayFlushPeriod = 30 * time.Second
+
+// 内置 TURN 中继服务
+type RelayService struct {
+	Data    *model.DeviceModel
+	Members *model.MemberModel
+	server  *turn.Server
+	// 签发临时凭据的密钥
+	secret string
+	// 对外地址
+	host string
+	port int
+	// 凭据有效期
+	ttl time.Duration
+	// 每个用户的中继带宽, 字节/秒, 0 为不限
+	bandwidth float64
+	// 已认证的中继客户端, 按来源地址索引
+	clients map[string]*relayClient
+	// 设备缓存
+	devices map[string]*model.Device
+	// 已吊销的会话, 值为其凭据的最晚到期时间
+	revoked map[string]int64
+	// 每个用户的限速器
+	limiters map[int64]*relayLimiter
+	// 待写入的设备中继流量
+	usage map[string]int64
+	mu    sync.Mutex
+}
+
+// 中继客户端
+type relayClient struct {
+	natId   string
+	device  int64
+	session string
+	// 设备所属用户, 按其限速
+	uid int64
+	// 发起连接的用户
+	member int64
+	expire int64
+	// 已吊销, 不再转发数据
+	revoked bool
+}
+
+// 令牌桶限速器
+type relayLimiter struct {
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// 创建中继服务, 未启用时返回 nil
+func CreateRelayService(engine *xorm.Engine) *RelayService {
+	if !util.GetBool("turn.enable") {
+		return nil
+	}
+	host := util.GetString("turn.publicIP")
+	relayIP := net.ParseIP(host)
+	if relayIP == nil {
+		util.OutLogf("Relay", "turn.publicIP is not a valid IP, relay disabled")
+		return nil
+	}
+	port := util.GetInt("turn.port")
+	if port == 0 {
+		port = 3478
+	}
+	secret := util.GetString("turn.secret")
+	if secret == "" && util.GetString("broker.redis") != "" {
+		// 多实例部署时凭据可能由其他实例签发
+		util.OutLogf("Relay", "turn.secret is required when broker.redis is set, relay disabled")
+		return nil
+	} else if secret == "" {
+		// 未配置时使用临时密钥, 重启后旧凭据失效
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			util.OutLogf("Relay", "generate secret failed: %v", err)
+			return nil
+		}
+		secret = base64.StdEncoding.EncodeToString(key)
+	}
+	ttl := util.GetInt("turn.ttl")
+	if ttl <= 0 {
+		ttl = 600
+	}
+	rs := &RelayService{
+		Data:      &model.DeviceModel{DB: engine},
+		Members:   &model.MemberModel{DB: engine},
+		secret:    secret,
+		host:      host,
+		port:      port,
+		ttl:       time.Duration(ttl) * time.Second,
+		bandwidth: util.GetFloat64("turn.bandwidth") * 1024,
+		clients:   make(map[string]*relayClient),
+		devices:   make(map[string]*model.Device),
+		revoked:   make(map[string]int64),
+		limiters:  make(map[int64]*relayLimiter),
+		usage:     make(map[string]int64),
+	}
+	conn, err := net.ListenPacket("udp4", fmt.Sprintf("0.0.0.0:%d", port))
+	if err != nil {
+		util.OutLogf("Relay", "listen failed: %v", err)
+		return nil
+	}
+	rs.server, err = turn.NewServer(turn.ServerConfig{
+		Realm:       turnRealm,
+		AuthHandler: rs.auth,
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn: &relayConn{PacketConn: conn, relay: rs},
+				RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+					RelayAddress: relayIP,
+					Address:      "0.0.0.0",
+				},
+			},
+		},
+	})
+	if err != nil {
+		conn.Close()
+		util.OutLogf("Relay", "startup failed: %v", err)
+		return nil
+	}
+	go rs.flush()
+	util.OutLogf("Relay", "turn server listening on %s:%d", host, port)
+	return rs
+}
+
+// 为设备会话签发临时凭据, 凭据绑定 NSC 会话与发起连接的用户
+func (rs *RelayService) Credentials(natId, session string, member int64) util.ICEServer {
+	username := fmt.Sprintf("%d:%s:%s:%d", time.Now().Add(rs.ttl).Unix(), natId, session, member)
+	return util.ICEServer{
+		URLs:       []string{fmt.Sprintf("turn:%s:%d?transport=udp", rs.host, rs.port)},
+		Username:   username,
+		Credential: rs.password(username),
+	}
+}
+
+// [工具] 计算临时凭据的密码
+func (rs *RelayService) password(username string) string {
+	mac := hmac.New(sha1.New, []byte(rs.secret))
+	mac.Write([]byte(username))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// 校验临时凭据, 用户名格式为 过期时间:NAT编号:会话编号:用户编号
+// 会话已吊销或用户已无权连接设备时拒绝, 分配与续期都会重新校验
+func (rs *RelayService) auth(username, realm string, srcAddr net.Addr) ([]byte, bool) {
+	parts := strings.Split(username, ":")
+	if len(parts) != 4 || parts[2] == "" {
+		return nil, false
+	}
+	expire, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || expire < time.Now().Unix() {
+		return nil, false
+	}
+	member, err := strconv.ParseInt(parts[3], 10, 64)
+	if err != nil {
+		return nil, false
+	}
+	natId, session := parts[1], parts[2]
+	rs.mu.Lock()
+	_, revoked := rs.revoked[session]
+	rs.mu.Unlock()
+	if revoked {
+		return nil, false
+	}
+	info, ok := rs.device(natId)
+	if !ok {
+		return nil, false
+	}
+	role, err := rs.Members.GetRole(info, member)
+	if err != nil || !model.RoleAllows(role, model.RoleEditor) {
+		return nil, false
+	}
+	rs.mu.Lock()
+	rs.clients[srcAddr.String()] = &relayClient{natId: natId, device: info.Id, session: session, uid: info.UId, member: member, expire: expire}
+	rs.mu.Unlock()
+	return turn.GenerateAuthKey(username, realm, rs.password(username)), true
+}
+
+// 吊销用户连接设备的中继凭据并停止转发, 用于移除成员或降低角色
+// 会话由其他实例签发时按设备与用户匹配, 再次认证时校验角色
+func (rs *RelayService) Revoke(device, member int64, sessions ...string) {
+	expire := time.Now().Add(rs.ttl).Unix()
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	for _, session := range sessions {
+		rs.revoked[session] = expire
+	}
+	for _, client := range rs.clients {
+		if _, ok := rs.revoked[client.session]; ok || (client.device == device && client.member == member) {
+			client.revoked = true
+		}
+	}
+}
+
+// [工具] 获取设备信息
+func (rs *RelayService) device(natId string) (*model.Device, bool) {
+	rs.mu.Lock()
+	info, ok := rs.devices[natId]
+	rs.mu.Unlock()
+	if ok {
+		return info, true
+	}
+	info, err := rs.Data.NATGetDevice(natId)
+	if err != nil || info == nil {
+		return nil, false
+	}
+	rs.mu.Lock()
+	rs.devices[natId] = info
+	rs.mu.Unlock()
+	return info, true
+}
+
+// 统计中继流量并限速, 返回是否放行
+func (rs *RelayService) account(addr net.Addr, size int) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	client, ok := rs.clients[addr.String()]
+	if !ok {
+		// 未认证的请求交由 TURN 服务处理
+		return true
+	} else if client.revoked {
+		return false
+	}
+	if rs.bandwidth > 0 {
+		limiter, ok := rs.limiters[client.uid]
+		if !ok {
+			limiter = &relayLimiter{rate: rs.bandwidth, tokens: rs.bandwidth, last: time.Now()}
+			rs.limiters[client.uid] = limiter
+		}
+		if !limiter.allow(size) {
+			return false
+		}
+	}
+	rs.usage[client.natId] += int64(size)
+	return true
+}
+
+// 定时写入中继用量并清理过期数据
+func (rs *RelayService) flush() {
+	ticker := time.NewTicker(relayFlushPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		rs.mu.Lock()
+		usage := rs.usage
+		rs.usage = make(map[string]int64)
+		now := time.Now().Unix()
+		for addr, client := range rs.clients {
+			if client.expire < now {
+				delete(rs.clients, addr)
+			}
+		}
+		for session, expire := range rs.revoked {
+			if expire < now {
+				delete(rs.revoked, session)
+			}
+		}
+		rs.devices = make(map[string]*model.Device)
+		rs.mu.Unlock()
+		for natId, size := range usage {
+			if !rs.Data.AddRelayUsage(natId, size) {
+				log.Printf("[Relay] usage update failed: %s", natId)
+			}
+		}
+	}
+}
+
+// [工具] 消耗令牌, 不足时丢弃数据包
+func (l *relayLimiter) allow(size int) bool {
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+	if l.tokens < float64(size) {
+		return false
+	}
+	l.tokens -= float64(size)
+	return true
+}
+
+// 统计流量的监听连接
+type relayConn struct {
+	net.PacketConn
+	relay *RelayService
+}
+
+func (c *relayConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	for {
+		n, addr, err := c.PacketConn.ReadFrom(p)
+		if err != nil || c.relay.account(addr, n) {
+			return n, addr, err
+		}
+	}
+}
+
+func (c *relayConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	if !c.relay.account(addr, len(p)) {
+		return len(p), nil
+	}
+	return c.PacketConn.WriteTo(p, addr)
+}
@@ -0,0 +1,135 @@
+package core
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pion/turn/v2"
+	"github.com/skye-z/ons/cloud-server/model"
+	"github.com/skye-z/ons/cloud-server/util"
+	"github.com/spf13/viper"
+)
+
+// [工具] 创建未监听端口的中继服务: 用户 2 注册设备, 3 为编辑者, 4 为查看者
+func testRelay(t *testing.T) *RelayService {
+	engine := testEngine(t)
+	engine.Insert(&model.Device{UId: 2, NatId: "K7Q2M9X4PW"})
+	members := &model.MemberModel{DB: engine}
+	members.AddMember(1, 3, 2, model.RoleEditor)
+	members.AddMember(1, 4, 2, model.RoleViewer)
+	members.AcceptMember(1)
+	members.AcceptMember(2)
+	return &RelayService{
+		Data:     &model.DeviceModel{DB: engine},
+		Members:  members,
+		secret:   "relay secret",
+		host:     "203.0.113.1",
+		port:     3478,
+		ttl:      time.Minute,
+		clients:  make(map[string]*relayClient),
+		devices:  make(map[string]*model.Device),
+		limiters: make(map[int64]*relayLimiter),
+		revoked:  make(map[string]int64),
+		usage:    make(map[string]int64),
+	}
+}
+
+// [工具] 以凭据认证, 返回是否通过
+func relayAuth(rs *RelayService, username, credential string, port int) bool {
+	addr := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: port}
+	key, ok := rs.auth(username, turnRealm, addr)
+	return ok && bytes.Equal(key, turn.GenerateAuthKey(username, turnRealm, credential))
+}
+
+func TestRelayCredentials(t *testing.T) {
+	rs := testRelay(t)
+	server := rs.Credentials("K7Q2M9X4PW", "c1", 3)
+	if len(server.URLs) != 1 || server.URLs[0] != "turn:203.0.113.1:3478?transport=udp" {
+		t.Fatalf("urls = %v", server.URLs)
+	}
+	if !strings.HasSuffix(server.Username, ":K7Q2M9X4PW:c1:3") {
+		t.Fatalf("username = %s", server.Username)
+	}
+	if !relayAuth(rs, server.Username, server.Credential, 1) {
+		t.Fatal("issued credentials refused")
+	}
+	exp := time.Now().Add(time.Minute).Unix()
+	for _, c := range []struct {
+		name     string
+		username string
+		ok       bool
+	}{
+		{"owner", fmt.Sprintf("%d:K7Q2M9X4PW:c1:2", exp), true},
+		{"admin", fmt.Sprintf("%d:K7Q2M9X4PW:c1:1", exp), true},
+		{"viewer", fmt.Sprintf("%d:K7Q2M9X4PW:c1:4", exp), false},
+		{"stranger", fmt.Sprintf("%d:K7Q2M9X4PW:c1:5", exp), false},
+		{"unknown device", fmt.Sprintf("%d:NOPE:c1:2", exp), false},
+		{"expired", fmt.Sprintf("%d:K7Q2M9X4PW:c1:2", time.Now().Add(-time.Second).Unix()), false},
+		// 旧格式不含会话与用户
+		{"legacy format", fmt.Sprintf("%d:K7Q2M9X4PW", exp), false},
+		{"no session", fmt.Sprintf("%d:K7Q2M9X4PW::2", exp), false},
+		{"bad member", fmt.Sprintf("%d:K7Q2M9X4PW:c1:two", exp), false},
+	} {
+		if ok := relayAuth(rs, c.username, rs.password(c.username), 2); ok != c.ok {
+			t.Errorf("%s: auth %v, want %v", c.name, ok, c.ok)
+		}
+	}
+	// 其他密钥签发的凭据认证后密钥不匹配
+	other := &RelayService{secret: "other secret"}
+	if relayAuth(rs, server.Username, other.password(server.Username), 3) {
+		t.Fatal("credentials of another secret accepted")
+	}
+}
+
+func TestRelayRevoke(t *testing.T) {
+	rs := testRelay(t)
+	editor := rs.Credentials("K7Q2M9X4PW", "c1", 3)
+	other := rs.Credentials("K7Q2M9X4PW", "c2", 3)
+	owner := rs.Credentials("K7Q2M9X4PW", "c3", 2)
+	for port, server := range []util.ICEServer{editor, other, owner} {
+		if !relayAuth(rs, server.Username, server.Credential, port+1) {
+			t.Fatalf("credentials %s refused", server.Username)
+		}
+	}
+	// 移除成员后按设备与用户停止转发, 本实例的会话一并吊销
+	rs.Members.DelMember(1)
+	rs.Revoke(1, 3, "c1")
+	for port, want := range []bool{false, false, true} {
+		addr := &net.UDPAddr{IP: net.IPv4(198, 51, 100, 1), Port: port + 1}
+		if got := rs.account(addr, 100); got != want {
+			t.Errorf("client %d relayed %v, want %v", port+1, got, want)
+		}
+	}
+	if relayAuth(rs, editor.Username, editor.Credential, 4) {
+		t.Fatal("revoked session authenticated")
+	}
+	// 重新加入后旧会话仍被吊销, 新会话可用
+	rs.Members.AddMember(1, 3, 2, model.RoleEditor)
+	rs.Members.AcceptMember(3)
+	if relayAuth(rs, editor.Username, editor.Credential, 5) {
+		t.Fatal("revoked session authenticated after rejoin")
+	}
+	if !relayAuth(rs, other.Username, other.Credential, 6) {
+		t.Fatal("session of rejoined member refused")
+	}
+}
+
+func TestRelaySecretRequired(t *testing.T) {
+	viper.Set("turn.enable", true)
+	viper.Set("turn.publicIP", "203.0.113.1")
+	viper.Set("turn.secret", "")
+	viper.Set("broker.redis", "127.0.0.1:6379")
+	t.Cleanup(func() {
+		viper.Set("turn.enable", false)
+		viper.Set("turn.publicIP", "")
+		viper.Set("broker.redis", "")
+	})
+	// 多实例部署时各实例的临时密钥不同, 须显式配置
+	if rs := CreateRelayService(testEngine(t)); rs != nil {
+		t.Fatal("relay started without turn.secret")
+	}
+}
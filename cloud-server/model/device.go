@@ -7,12 +7,18 @@ import (
 )
 
 type Device struct {
-	Id          int64  `json:"id"`          // 设备编号
-	UId         int64  `json:"uid"`         // 关联用户
-	NatId       string `json:"natId"`       // NAT编号
-	Name        string `json:"name"`        // 设备名称
-	LastOnline  int64  `json:"lastOnline"`  // 上次上线时间
-	LastConnect int64  `json:"lastConnect"` // 上次连接时间
+	Id          int64  `json:"id"`                      // 设备编号
+	UId         int64  `json:"uid"`                     // 关联用户
+	NatId       string `json:"natId" xorm:"unique"`     // NAT编号
+	LegacyId    string `json:"legacyId" xorm:"index"`   // 升级前的旧版 NAT 编号, 仍可用于连接
+	Name        string `json:"name"`                    // 设备名称
+	LastOnline  int64  `json:"lastOnline"`              // 上次上线时间
+	LastConnect int64  `json:"lastConnect"`             // 上次连接时间
+	RelayBytes  int64  `json:"relayBytes"`              // 中继流量
+	LastRelay   int64  `json:"lastRelay"`               // 上次中继时间
+	PublicKey   string `json:"-"`                       // 设备公钥, 用于校验 NSB 注册
+	TokenVer    int64  `json:"-"`                       // 访问令牌版本, 递增后已签发的令牌失效
+	Role        string `json:"role,omitempty" xorm:"-"` // 当前用户在设备上的角色
 }
 
 type DeviceModel struct {
@@ -20,11 +26,12 @@ type DeviceModel struct {
 }
 
 // 新增设备
-func (model DeviceModel) AddDevice(uid int64, name, nat string) bool {
+func (model DeviceModel) AddDevice(uid int64, name, nat, publicKey string) bool {
 	device := &Device{
-		UId:   uid,
-		NatId: nat,
-		Name:  name,
+		UId:       uid,
+		NatId:     nat,
+		Name:      name,
+		PublicKey: publicKey,
 	}
 	_, err := model.DB.Insert(device)
 	if err == nil {
@@ -76,6 +83,28 @@ func (model DeviceModel) UpdateConnectTime(natId string) bool {
 	return err == nil
 }
 
+// 累加中继流量
+func (model DeviceModel) AddRelayUsage(natId string, size int64) bool {
+	_, err := model.DB.Where("nat_id = ?", natId).Incr("relay_bytes", size).Cols("last_relay").Update(&Device{
+		LastRelay: time.Now().Unix() * 1000,
+	})
+	return err == nil
+}
+
+// 更新设备公钥
+func (model DeviceModel) UpdatePublicKey(id int64, publicKey string) bool {
+	_, err := model.DB.ID(id).Cols("public_key").Update(&Device{
+		PublicKey: publicKey,
+	})
+	return err == nil
+}
+
+// 递增访问令牌版本
+func (model DeviceModel) RevokeTokens(id int64) bool {
+	_, err := model.DB.ID(id).Incr("token_ver").Update(&Device{})
+	return err == nil
+}
+
 // 删除设备
 func (model DeviceModel) DelDevice(id int64) bool {
 	device := &Device{
@@ -85,18 +114,24 @@ func (model DeviceModel) DelDevice(id int64) bool {
 	return err == nil
 }
 
-// 检查NAT编号
+// 检查NAT编号是否已被占用, 包括旧版编号
 func (model DeviceModel) CheckNATId(nat string) bool {
-	device := &Device{
-		NatId: nat,
-	}
-	has, err := model.DB.Get(device)
+	has, err := model.DB.Where("nat_id = ? OR legacy_id = ?", nat, nat).Exist(&Device{})
 	if err != nil {
 		return true
 	}
 	return has
 }
 
+// 升级NAT编号, 旧编号保留为别名
+func (model DeviceModel) MigrateNATId(id int64, nat, legacy string) bool {
+	_, err := model.DB.ID(id).Cols("nat_id", "legacy_id").Update(&Device{
+		NatId:    nat,
+		LegacyId: legacy,
+	})
+	return err == nil
+}
+
 // 获取设备信息
 func (model DeviceModel) GetDevice(id int64) (*Device, error) {
 	device := &Device{
@@ -112,12 +147,33 @@ func (model DeviceModel) GetDevice(id int64) (*Device, error) {
 	return device, nil
 }
 
-// 获取设备信息
+// 获取设备信息, 可使用旧版编号, 与其他设备的旧版编号相同时以当前编号为准
 func (model DeviceModel) NATGetDevice(id string) (*Device, error) {
-	device := &Device{
-		NatId: id,
+	if id == "" {
+		return nil, nil
 	}
-	has, err := model.DB.Get(device)
+	device := &Device{}
+	has, err := model.DB.Where("nat_id = ?", id).Get(device)
+	if err != nil || has {
+		return device, err
+	}
+	has, err = model.DB.Where("legacy_id = ?", id).Get(device)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, nil
+	}
+	return device, nil
+}
+
+// 获取用户名下的设备, 可使用旧版编号
+func (model DeviceModel) OwnerGetDevice(uid int64, id string) (*Device, error) {
+	if id == "" {
+		return nil, nil
+	}
+	device := &Device{}
+	has, err := model.DB.Where("u_id = ? AND (nat_id = ? OR legacy_id = ?)", uid, id, id).Get(device)
 	if err != nil {
 		return nil, err
 	}
@@ -132,7 +188,7 @@ func (model DeviceModel) GetDeviceList(uid int64, page, num int) ([]Device, erro
 	var list []Device
 	var err error
 	if uid != 1 {
-		err = model.DB.Where("uid = ?", uid).Desc("id").Limit(num, (page-1)*num).Find(&list)
+		err = model.DB.Where("u_id = ?", uid).Desc("id").Limit(num, (page-1)*num).Find(&list)
 	} else {
 		err = model.DB.Desc("id").Limit(num, (page-1)*num).Find(&list)
 	}
@@ -141,3 +197,16 @@ func (model DeviceModel) GetDeviceList(uid int64, page, num int) ([]Device, erro
 	}
 	return list, nil
 }
+
+// 获取用户可访问的设备列表, 包含他人共享的设备
+func (model DeviceModel) GetAccessList(uid int64, page, num int) ([]Device, error) {
+	if uid == 1 {
+		return model.GetDeviceList(uid, page, num)
+	}
+	var list []Device
+	err := model.DB.Where("u_id = ? OR id IN (SELECT device_id FROM device_member WHERE u_id = ? AND accepted = ?)", uid, uid, true).Desc("id").Limit(num, (page-1)*num).Find(&list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
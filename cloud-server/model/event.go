@@ -0,0 +1,51 @@
+package model
+
+import (
+	"time"
+
+	"xorm.io/xorm"
+)
+
+// 设备事件, 用于排查连接与同步问题
+type DeviceEvent struct {
+	Id       int64  `json:"id"`                    // 事件编号
+	DeviceId int64  `json:"deviceId" xorm:"index"` // 关联设备
+	Type     string `json:"type"`                  // 事件类型
+	Session  string `json:"session"`               // 插件会话编号
+	Detail   string `json:"detail"`                // 错误码、失败原因或连接方式
+	IP       string `json:"ip" xorm:"'ip'"`        // 来源地址
+	Time     int64  `json:"time" xorm:"index"`     // 发生时间
+}
+
+type EventModel struct {
+	DB *xorm.Engine
+}
+
+// 记录事件
+func (model EventModel) AddEvent(event *DeviceEvent) bool {
+	event.Time = time.Now().Unix() * 1000
+	_, err := model.DB.Insert(event)
+	return err == nil
+}
+
+// 分页获取设备事件, 按时间倒序
+func (model EventModel) GetEventList(deviceId int64, page, num int) ([]DeviceEvent, int64, error) {
+	var list []DeviceEvent
+	total, err := model.DB.Where("device_id = ?", deviceId).Desc("id").Limit(num, (page-1)*num).FindAndCount(&list)
+	if err != nil {
+		return nil, 0, err
+	}
+	return list, total, nil
+}
+
+// 清理指定时间前的事件
+func (model EventModel) CleanEvent(before int64) bool {
+	_, err := model.DB.Where("time < ?", before).Delete(new(DeviceEvent))
+	return err == nil
+}
+
+// 删除设备的全部事件
+func (model EventModel) DelEvent(deviceId int64) bool {
+	_, err := model.DB.Where("device_id = ?", deviceId).Delete(new(DeviceEvent))
+	return err == nil
+}
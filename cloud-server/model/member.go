@@ -0,0 +1,150 @@
+package model
+
+import (
+	"time"
+
+	"xorm.io/xorm"
+)
+
+// 设备成员角色
+const (
+	// 管理成员、吊销令牌, 注册设备的用户还可删除设备与管理其他所有者
+	RoleOwner = "owner"
+	// 连接设备、重命名、签发令牌
+	RoleEditor = "editor"
+	// 查看设备状态与记录
+	RoleViewer = "viewer"
+)
+
+// 角色等级, 高等级包含低等级的权限
+var roleLevel = map[string]int{
+	RoleViewer: 1,
+	RoleEditor: 2,
+	RoleOwner:  3,
+}
+
+// 检查角色是否有效
+func ValidRole(role string) bool {
+	_, ok := roleLevel[role]
+	return ok
+}
+
+// 检查角色是否具备所需权限
+func RoleAllows(role, need string) bool {
+	return roleLevel[role] > 0 && roleLevel[role] >= roleLevel[need]
+}
+
+// 是否为设备的主所有者, 即注册设备的用户或管理员
+func PrimaryOwner(device *Device, uid int64) bool {
+	return uid == 1 || uid == device.UId
+}
+
+// 设备成员, 注册设备的用户为默认所有者, 不在此表中
+type DeviceMember struct {
+	Id       int64  `json:"id"`                                     // 成员编号
+	DeviceId int64  `json:"deviceId" xorm:"unique(device_member)"`  // 关联设备
+	UId      int64  `json:"uid" xorm:"unique(device_member) index"` // 关联用户
+	Role     string `json:"role"`                                   // 角色
+	Accepted bool   `json:"accepted"`                               // 是否已接受邀请
+	Inviter  int64  `json:"inviter"`                                // 邀请人
+	Created  int64  `json:"created"`                                // 邀请时间
+}
+
+type MemberModel struct {
+	DB *xorm.Engine
+}
+
+// 新增成员邀请
+func (model MemberModel) AddMember(deviceId, uid, inviter int64, role string) bool {
+	member := &DeviceMember{
+		DeviceId: deviceId,
+		UId:      uid,
+		Role:     role,
+		Inviter:  inviter,
+		Created:  time.Now().Unix() * 1000,
+	}
+	_, err := model.DB.Insert(member)
+	return err == nil
+}
+
+// 获取成员
+func (model MemberModel) GetMember(id int64) (*DeviceMember, error) {
+	member := &DeviceMember{}
+	has, err := model.DB.ID(id).Get(member)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, nil
+	}
+	return member, nil
+}
+
+// 获取用户在设备上的成员记录
+func (model MemberModel) FindMember(deviceId, uid int64) (*DeviceMember, error) {
+	member := &DeviceMember{}
+	has, err := model.DB.Where("device_id = ? AND u_id = ?", deviceId, uid).Get(member)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return nil, nil
+	}
+	return member, nil
+}
+
+// 获取用户在设备上的角色, 无权访问时为空
+func (model MemberModel) GetRole(device *Device, uid int64) (string, error) {
+	if PrimaryOwner(device, uid) {
+		return RoleOwner, nil
+	}
+	member, err := model.FindMember(device.Id, uid)
+	if err != nil || member == nil || !member.Accepted {
+		return "", err
+	}
+	return member.Role, nil
+}
+
+// 更新成员角色
+func (model MemberModel) UpdateRole(id int64, role string) bool {
+	_, err := model.DB.ID(id).Cols("role").Update(&DeviceMember{Role: role})
+	return err == nil
+}
+
+// 接受邀请
+func (model MemberModel) AcceptMember(id int64) bool {
+	_, err := model.DB.ID(id).Cols("accepted").Update(&DeviceMember{Accepted: true})
+	return err == nil
+}
+
+// 获取设备的成员列表
+func (model MemberModel) GetMemberList(deviceId int64) ([]DeviceMember, error) {
+	var list []DeviceMember
+	err := model.DB.Where("device_id = ?", deviceId).Asc("id").Find(&list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// 获取用户待接受的邀请
+func (model MemberModel) GetInviteList(uid int64) ([]DeviceMember, error) {
+	var list []DeviceMember
+	err := model.DB.Where("u_id = ? AND accepted = ?", uid, false).Desc("id").Find(&list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// 删除成员
+func (model MemberModel) DelMember(id int64) bool {
+	_, err := model.DB.ID(id).Delete(new(DeviceMember))
+	return err == nil
+}
+
+// 删除设备的全部成员
+func (model MemberModel) DelMembers(deviceId int64) bool {
+	_, err := model.DB.Where("device_id = ?", deviceId).Delete(new(DeviceMember))
+	return err == nil
+}
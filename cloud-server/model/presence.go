@@ -0,0 +1,70 @@
+package model
+
+import (
+	"time"
+
+	"xorm.io/xorm"
+)
+
+// 设备在线记录, 每次上线一条
+type Presence struct {
+	Id       int64 `json:"id"`                    // 记录编号
+	DeviceId int64 `json:"deviceId" xorm:"index"` // 关联设备
+	Online   int64 `json:"online"`                // 上线时间
+	Offline  int64 `json:"offline" xorm:"index"`  // 下线时间, 在线中为 0
+	Seen     int64 `json:"seen"`                  // 最近心跳时间, 实例异常退出时作为下线时间
+}
+
+type PresenceModel struct {
+	DB *xorm.Engine
+}
+
+// 记录上线, 先以心跳时间结束未正常下线的记录
+func (model PresenceModel) AddOnline(deviceId int64) int64 {
+	model.DB.Where("device_id = ? AND offline = 0", deviceId).SetExpr("offline", "seen").Update(new(Presence))
+	now := time.Now().Unix() * 1000
+	presence := &Presence{
+		DeviceId: deviceId,
+		Online:   now,
+		Seen:     now,
+	}
+	if _, err := model.DB.Insert(presence); err != nil {
+		return 0
+	}
+	return presence.Id
+}
+
+// 更新心跳时间
+func (model PresenceModel) UpdateSeen(id int64) bool {
+	_, err := model.DB.ID(id).Cols("seen").Update(&Presence{Seen: time.Now().Unix() * 1000})
+	return err == nil
+}
+
+// 记录下线
+func (model PresenceModel) UpdateOffline(id int64) bool {
+	now := time.Now().Unix() * 1000
+	_, err := model.DB.ID(id).Cols("seen", "offline").Update(&Presence{Seen: now, Offline: now})
+	return err == nil
+}
+
+// 获取指定时间后仍在线过的记录
+func (model PresenceModel) GetPresenceList(deviceId, since int64) ([]Presence, error) {
+	var list []Presence
+	err := model.DB.Where("device_id = ? AND (offline = 0 OR offline > ?)", deviceId, since).Asc("online").Find(&list)
+	if err != nil {
+		return nil, err
+	}
+	return list, nil
+}
+
+// 清理指定时间前已结束的记录
+func (model PresenceModel) CleanPresence(before int64) bool {
+	_, err := model.DB.Where("offline > 0 AND offline < ?", before).Delete(new(Presence))
+	return err == nil
+}
+
+// 删除设备的全部记录
+func (model PresenceModel) DelPresence(deviceId int64) bool {
+	_, err := model.DB.Where("device_id = ?", deviceId).Delete(new(Presence))
+	return err == nil
+}
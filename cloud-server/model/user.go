@@ -1,6 +1,8 @@
 package model
 
 import (
+	"strings"
+
 	"xorm.io/xorm"
 )
 
@@ -86,3 +88,21 @@ func (model UserModel) GetUser(id int64) (*User, error) {
 	}
 	return user, nil
 }
+
+// 按用户名或邮箱精确查找用户编号, 不存在时为 0
+func (model UserModel) FindUserId(account string) (int64, error) {
+	if account == "" {
+		return 0, nil
+	}
+	// 含 @ 时仅按邮箱匹配, 否则仅按用户名匹配
+	column := "username"
+	if strings.Contains(account, "@") {
+		column = "email"
+	}
+	user := &User{}
+	has, err := model.DB.Cols("id").Where(column+" = ?", account).Get(user)
+	if err != nil || !has {
+		return 0, err
+	}
+	return user.Id, nil
+}
@@ -40,9 +40,22 @@ export const user = {
 
 export const device = {
     register: name => post('/nas/register', { name }),
-    rename: name => post('/nas/rename', { name }),
+    rename: (id, name) => post('/nas/rename', { id, name }),
     remove: id => post('/nas/' + id, {}),
     getList: () => get('/nas/list'),
     getState: () => get('/nas/state'),
-    getInfo: id => get('/nas/' + id)
+    getInfo: id => get('/nas/' + id),
+    issueToken: id => post('/nas/' + id + '/token', {}),
+    revokeTokens: id => post('/nas/' + id + '/token/revoke', {}),
+    getPresence: (id, days) => get('/nas/' + id + '/presence?days=' + days),
+    getEvents: (id, page, number) => get('/nas/' + id + '/events?page=' + page + '&number=' + number),
+    watch: () => new EventSource('/api/nas/presence?token=' + localStorage.getItem("access:token"))
+}
+
+export const member = {
+    getList: id => get('/nas/' + id + '/member'),
+    invite: (id, account, role) => post('/nas/' + id + '/member', { account, role }),
+    revoke: (id, mid) => post('/nas/' + id + '/member/' + mid + '/revoke', {}),
+    getInvites: () => get('/member/invite'),
+    accept: mid => post('/member/invite/' + mid + '/accept', {})
 }
\ No newline at end of file
@@ -17,6 +17,7 @@ import (
 const Version = "0.2.0"
 
 func InitConfig() {
+	loadDefault()
 	viper.SetConfigName("config")
 	viper.SetConfigType("ini")
 	viper.AddConfigPath(".")
@@ -82,6 +83,47 @@ func createDefault() {
 	viper.SafeWriteConfig()
 }
 
+// 后续版本新增的配置项, 旧配置文件中缺失时使用默认值
+func loadDefault() {
+	// 下发的 ICE 服务器, 逗号分隔, 支持 stun: 与 turn:/turns:, 留空则由两端自行配置
+	viper.SetDefault("ice.servers", "")
+	viper.SetDefault("ice.username", "")
+	viper.SetDefault("ice.credential", "")
+	// 内置 TURN 中继
+	viper.SetDefault("turn.enable", "false")
+	viper.SetDefault("turn.publicIP", "")
+	viper.SetDefault("turn.port", 3478)
+	viper.SetDefault("turn.secret", "")
+	// 临时凭据有效期/秒
+	viper.SetDefault("turn.ttl", 600)
+	// 每个用户的中继带宽/KB每秒, 0 为不限
+	viper.SetDefault("turn.bandwidth", 0)
+	// NAT 编号长度 (含末位校验字符) 与字符集
+	viper.SetDefault("nat.length", 10)
+	viper.SetDefault("nat.alphabet", "0123456789")
+	// 信令代理, 多实例部署时填写共享的 Redis 地址, 留空则仅支持单实例
+	viper.SetDefault("broker.redis", "")
+	viper.SetDefault("broker.password", "")
+	viper.SetDefault("broker.db", 0)
+	viper.SetDefault("broker.prefix", "ons:")
+	// 设备访问令牌有效期/小时
+	viper.SetDefault("token.deviceExp", 720)
+	// 每个 IP 的 WebSocket 握手次数/分钟, 0 为不限
+	viper.SetDefault("limit.upgrade", 60)
+	// 每个连接每秒的信令消息数
+	viper.SetDefault("limit.message", 50)
+	// 每个 IP 连接不存在或无权访问设备的次数/分钟
+	viper.SetDefault("limit.probe", 10)
+	// 每个用户的接口请求次数/分钟
+	viper.SetDefault("limit.api", 120)
+	// 允许的 WebSocket 来源, 逗号分隔, * 为不限, 同域名及非浏览器客户端始终允许
+	viper.SetDefault("limit.origins", "app://obsidian.md,capacitor://localhost")
+	// 设备在线记录保留天数, 0 为永久保留
+	viper.SetDefault("presence.days", 30)
+	// 设备事件保留天数, 0 为永久保留
+	viper.SetDefault("event.days", 30)
+}
+
 func generateSecret() (string, error) {
 	key := make([]byte, 32)
 	_, err := rand.Read(key)
@@ -8,6 +8,11 @@ Copyright © 2024 SkyeZhang <skai-zhang@hotmail.com>
 package util
 
 import (
+	"context"
+	"fmt"
+	"strconv"
+	"time"
+
 	"github.com/skye-z/ons/cloud-server/model"
 	_ "modernc.org/sqlite"
 	"xorm.io/xorm"
@@ -28,8 +33,95 @@ func InitDBTable(engine *xorm.Engine) {
 	if err != nil {
 		panic(err)
 	}
+	err = engine.Sync2(new(model.DeviceEvent))
+	if err != nil {
+		panic(err)
+	}
+	// 建立唯一索引前处理重复的 NAT 编号
+	err = dedupeNATIds(engine)
+	if err != nil {
+		panic(err)
+	}
 	err = engine.Sync2(new(model.Device))
 	if err != nil {
 		panic(err)
 	}
+	err = engine.Sync2(new(model.Presence))
+	if err != nil {
+		panic(err)
+	}
+	err = engine.Sync2(new(model.DeviceMember))
+	if err != nil {
+		panic(err)
+	}
+}
+
+// 旧版本生成的 NAT 编号可能重复, 保留最早注册的设备, 其余重新分配
+// 原编号保留为重新分配设备的旧版编号, 所有者在 NAS 上升级 NAT.ID 即可取回新编号
+func dedupeNATIds(engine *xorm.Engine) error {
+	exist, err := engine.IsTableExist(new(model.Device))
+	if err != nil || !exist {
+		return err
+	}
+	// 更早版本的设备表没有旧版编号字段, 先行补齐
+	table, err := engine.TableInfo(new(model.Device))
+	if err != nil {
+		return err
+	}
+	has, err := engine.Dialect().IsColumnExist(engine.DB(), context.Background(), table.Name, "legacy_id")
+	if err != nil {
+		return err
+	} else if !has {
+		if _, err := engine.Exec(engine.Dialect().AddColumnSQL(table.Name, table.GetColumn("legacy_id"))); err != nil {
+			return err
+		}
+	}
+	rows, err := engine.QueryString("SELECT id, nat_id, legacy_id FROM device ORDER BY id")
+	if err != nil {
+		return err
+	}
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		seen[row["nat_id"]] = true
+		if row["legacy_id"] != "" {
+			seen[row["legacy_id"]] = true
+		}
+	}
+	session := engine.NewSession()
+	defer session.Close()
+	if err := session.Begin(); err != nil {
+		return err
+	}
+	used := make(map[string]bool)
+	for _, row := range rows {
+		nat := row["nat_id"]
+		if !used[nat] {
+			used[nat] = true
+			continue
+		}
+		fresh := GenerateNATId()
+		for seen[fresh] {
+			fresh = GenerateNATId()
+		}
+		seen[fresh] = true
+		// 已有旧版编号的设备仍可按旧版编号连接, 不覆盖
+		legacy := row["legacy_id"]
+		if legacy == "" {
+			legacy = nat
+		}
+		if _, err := session.Exec("UPDATE device SET nat_id = ?, legacy_id = ? WHERE id = ?", fresh, legacy, row["id"]); err != nil {
+			return err
+		}
+		deviceId, _ := strconv.ParseInt(row["id"], 10, 64)
+		if _, err := session.Insert(&model.DeviceEvent{
+			DeviceId: deviceId,
+			Type:     "nat-reassign",
+			Detail:   fmt.Sprintf("%s 与其他设备重复, 已改为 %s, 请在 NAS 上升级 NAT.ID", nat, fresh),
+			Time:     time.Now().Unix() * 1000,
+		}); err != nil {
+			return err
+		}
+		OutLogf("Data", "duplicate nat id %s of device %s reassigned to %s", nat, row["id"], fresh)
+	}
+	return session.Commit()
 }
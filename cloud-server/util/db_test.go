@@ -0,0 +1,86 @@
+package util
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/skye-z/ons/cloud-server/model"
+	"xorm.io/xorm"
+)
+
+// [工具] 创建含重复 NAT 编号的旧版设备表, 尚无旧版编号字段
+func legacyEngine(t *testing.T, nats ...string) *xorm.Engine {
+	engine, err := xorm.NewEngine("sqlite", filepath.Join(t.TempDir(), "test.store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { engine.Close() })
+	if _, err := engine.Exec("CREATE TABLE device (id INTEGER PRIMARY KEY AUTOINCREMENT, u_id INTEGER, nat_id TEXT, name TEXT)"); err != nil {
+		t.Fatal(err)
+	}
+	for i, nat := range nats {
+		if _, err := engine.Exec("INSERT INTO device (u_id, nat_id, name) VALUES (?, ?, ?)", i+2, nat, "nas"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return engine
+}
+
+func TestDedupeNATIds(t *testing.T) {
+	engine := legacyEngine(t, "123456", "654321", "123456", "123456")
+	InitDBTable(engine)
+
+	var list []model.Device
+	if err := engine.Asc("id").Find(&list); err != nil {
+		t.Fatal(err)
+	}
+	seen := make(map[string]bool)
+	for _, item := range list {
+		if seen[item.NatId] {
+			t.Fatalf("duplicate nat id %s kept", item.NatId)
+		}
+		seen[item.NatId] = true
+	}
+	// 最早注册的设备保留原编号
+	if list[0].NatId != "123456" || list[0].LegacyId != "" || list[1].NatId != "654321" {
+		t.Fatalf("kept devices changed: %+v", list[:2])
+	}
+	for _, item := range list[2:] {
+		if !ValidNATId(item.NatId) || item.LegacyId != "123456" {
+			t.Fatalf("device %d = %s, legacy %q", item.Id, item.NatId, item.LegacyId)
+		}
+		has, err := engine.Where("device_id = ? AND type = ?", item.Id, "nat-reassign").Exist(new(model.DeviceEvent))
+		if err != nil || !has {
+			t.Fatalf("reassignment of device %d not recorded", item.Id)
+		}
+	}
+	// 原编号仍指向保留的设备
+	devices := model.DeviceModel{DB: engine}
+	if info, _ := devices.NATGetDevice("123456"); info == nil || info.Id != list[0].Id {
+		t.Fatalf("NATGetDevice(123456) = %+v", info)
+	}
+	// 重新分配设备的所有者凭原编号取回自己的设备
+	if info, _ := devices.OwnerGetDevice(list[2].UId, "123456"); info == nil || info.Id != list[2].Id {
+		t.Fatalf("OwnerGetDevice = %+v", info)
+	}
+	// 唯一索引已建立
+	if _, err := engine.Exec("UPDATE device SET nat_id = ? WHERE id = ?", "654321", list[0].Id); err == nil {
+		t.Fatal("unique index missing")
+	}
+}
+
+func TestDedupeNATIdsFresh(t *testing.T) {
+	engine, err := xorm.NewEngine("sqlite", filepath.Join(t.TempDir(), "test.store"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer engine.Close()
+	// 新建数据库无需处理
+	if err := dedupeNATIds(engine); err != nil {
+		t.Fatal(err)
+	}
+	InitDBTable(engine)
+	if err := dedupeNATIds(engine); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,43 @@
+/*
+设备密钥工具
+
+BetaX Blog
+Copyright © 2024 SkyeZhang <skai-zhang@hotmail.com>
+*/
+
+package util
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// 校验设备公钥格式
+func CheckDeviceKey(publicKey string) bool {
+	raw, err := base64.StdEncoding.DecodeString(publicKey)
+	return err == nil && len(raw) == ed25519.PublicKeySize
+}
+
+// 生成注册挑战
+func GenerateChallenge() string {
+	nonce := make([]byte, 32)
+	if _, err := rand.Read(nonce); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(nonce)
+}
+
+// 校验 NSB 对注册挑战的签名
+func VerifyChallenge(publicKey, natId, nonce, sign string) bool {
+	key, err := base64.StdEncoding.DecodeString(publicKey)
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return false
+	}
+	raw, err := base64.StdEncoding.DecodeString(sign)
+	if err != nil {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(key), []byte("ons-register:"+natId+":"+nonce), raw)
+}
@@ -34,6 +34,8 @@ type CustomErrors struct {
 	ParamEmptyError CustomError
 	// 参数不合法
 	ParamIllegalError CustomError
+	// 请求过于频繁
+	TooManyRequestsError CustomError
 	// 意料之外
 	UnexpectedError CustomError
 }
@@ -46,5 +48,6 @@ var Errors = CustomErrors{
 	PermissionDeniedError:  CustomError{false, 10104, "权限不足"},
 	ParamEmptyError:        CustomError{false, 10105, "缺少关键参数"},
 	ParamIllegalError:      CustomError{false, 10106, "参数类型错误"},
+	TooManyRequestsError:   CustomError{false, 10107, "请求过于频繁, 请稍后再试"},
 	UnexpectedError:        CustomError{false, 99999, "发生意料之外的错误"},
 }
@@ -0,0 +1,46 @@
+/*
+ICE 服务器配置工具
+
+BetaX Blog
+Copyright © 2024 SkyeZhang <skai-zhang@hotmail.com>
+*/
+
+package util
+
+import "strings"
+
+// ICE 服务器, 字段与 WebRTC RTCIceServer 一致
+type ICEServer struct {
+	URLs       []string `json:"urls"`
+	Username   string   `json:"username,omitempty"`
+	Credential string   `json:"credential,omitempty"`
+}
+
+// 获取下发给 NSB 与 NSC 的 ICE 服务器
+// ice.servers 为逗号分隔的 stun/turn 地址, ice.username 与 ice.credential 用于 TURN 认证
+func ICEServers() []ICEServer {
+	var stuns, turns []string
+	for _, item := range strings.Split(GetString("ice.servers"), ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if strings.HasPrefix(item, "turn:") || strings.HasPrefix(item, "turns:") {
+			turns = append(turns, item)
+		} else {
+			stuns = append(stuns, item)
+		}
+	}
+	servers := []ICEServer{}
+	for _, url := range stuns {
+		servers = append(servers, ICEServer{URLs: []string{url}})
+	}
+	if len(turns) > 0 {
+		servers = append(servers, ICEServer{
+			URLs:       turns,
+			Username:   GetString("ice.username"),
+			Credential: GetString("ice.credential"),
+		})
+	}
+	return servers
+}
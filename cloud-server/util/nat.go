@@ -0,0 +1,79 @@
+/*
+NAT 编号工具
+
+BetaX Blog
+Copyright © 2024 SkyeZhang <skai-zhang@hotmail.com>
+*/
+
+package util
+
+import "strings"
+
+const (
+	// 默认编号长度, 含末位校验字符
+	natDefaultLength   = 10
+	natDefaultAlphabet = "0123456789"
+)
+
+// 生成 NAT 编号, 末位为 Luhn mod N 校验字符
+// 长度与字符集由 nat.length 与 nat.alphabet 配置
+func GenerateNATId() string {
+	length, alphabet := natFormat()
+	payload := GenerateRandom(alphabet, length-1)
+	check, _ := natChecksum(payload, alphabet)
+	return payload + string(check)
+}
+
+// 检查 NAT 编号格式与校验字符, 旧版 6 位编号不含校验字符
+func ValidNATId(id string) bool {
+	length, alphabet := natFormat()
+	if len(id) != length {
+		return false
+	}
+	check, ok := natChecksum(id[:length-1], alphabet)
+	return ok && id[length-1] == check
+}
+
+// [工具] 读取编号格式, 配置无效时使用默认值
+func natFormat() (int, string) {
+	length := GetInt("nat.length")
+	if length < 8 {
+		length = natDefaultLength
+	}
+	alphabet := GetString("nat.alphabet")
+	if len(alphabet) < 2 || !validAlphabet(alphabet) {
+		alphabet = natDefaultAlphabet
+	}
+	return length, alphabet
+}
+
+// [工具] 计算 Luhn mod N 校验字符
+func natChecksum(payload, alphabet string) (byte, bool) {
+	n := len(alphabet)
+	factor := 2
+	sum := 0
+	for i := len(payload) - 1; i >= 0; i-- {
+		code := strings.IndexByte(alphabet, payload[i])
+		if code < 0 {
+			return 0, false
+		}
+		addend := factor * code
+		if factor == 2 {
+			factor = 1
+		} else {
+			factor = 2
+		}
+		sum += addend/n + addend%n
+	}
+	return alphabet[(n-sum%n)%n], true
+}
+
+// [工具] 字符集仅限 ASCII 且不可有重复字符
+func validAlphabet(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] > 127 || strings.IndexByte(s[i+1:], s[i]) >= 0 {
+			return false
+		}
+	}
+	return true
+}
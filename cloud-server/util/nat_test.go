@@ -0,0 +1,91 @@
+package util
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// [工具] 设置编号格式, 测试结束后恢复默认
+func useNATFormat(t *testing.T, length int, alphabet string) {
+	viper.Set("nat.length", length)
+	viper.Set("nat.alphabet", alphabet)
+	t.Cleanup(func() {
+		viper.Set("nat.length", 0)
+		viper.Set("nat.alphabet", "")
+	})
+}
+
+func TestNATChecksum(t *testing.T) {
+	for _, c := range []struct {
+		payload  string
+		alphabet string
+		check    byte
+	}{
+		// 数字字符集即标准 Luhn 校验位
+		{"799273987", "0123456789", '5'},
+		{"000000000", "0123456789", '0'},
+		{"123456789", "0123456789", '7'},
+		{"ABCD", "ABCDEF", 'B'},
+	} {
+		check, ok := natChecksum(c.payload, c.alphabet)
+		if !ok || check != c.check {
+			t.Errorf("natChecksum(%s, %s) = %c, %v, want %c", c.payload, c.alphabet, check, ok, c.check)
+		}
+	}
+	if _, ok := natChecksum("12A4", "0123456789"); ok {
+		t.Error("character outside alphabet accepted")
+	}
+}
+
+func TestValidNATId(t *testing.T) {
+	useNATFormat(t, 0, "")
+	for _, c := range []struct {
+		id   string
+		want bool
+	}{
+		{"7992739875", true},
+		{"7992739871", false},
+		// 单个字符错误
+		{"7992739975", false},
+		// 相邻字符对调
+		{"9792739875", false},
+		// 旧版 6 位编号
+		{"123456", false},
+		{"799273987", false},
+		{"79927398755", false},
+		{"79927398A5", false},
+		{"", false},
+	} {
+		if got := ValidNATId(c.id); got != c.want {
+			t.Errorf("ValidNATId(%s) = %v, want %v", c.id, got, c.want)
+		}
+	}
+}
+
+func TestGenerateNATId(t *testing.T) {
+	for _, c := range []struct {
+		length   int
+		alphabet string
+		want     int
+		charset  string
+	}{
+		{0, "", natDefaultLength, natDefaultAlphabet},
+		{12, "0123456789ABCDEFGHJKMNPQRSTVWXYZ", 12, "0123456789ABCDEFGHJKMNPQRSTVWXYZ"},
+		// 无效配置回退为默认格式
+		{6, "AAB", natDefaultLength, natDefaultAlphabet},
+		{10, "数字", natDefaultLength, natDefaultAlphabet},
+	} {
+		useNATFormat(t, c.length, c.alphabet)
+		for i := 0; i < 100; i++ {
+			id := GenerateNATId()
+			if len(id) != c.want || strings.Trim(id, c.charset) != "" {
+				t.Fatalf("GenerateNATId() = %s, want %d characters of %s", id, c.want, c.charset)
+			}
+			if !ValidNATId(id) {
+				t.Fatalf("generated id %s invalid", id)
+			}
+		}
+	}
+}
@@ -0,0 +1,148 @@
+/*
+Redis 工具
+
+BetaX Blog
+Copyright © 2024 SkyeZhang <skai-zhang@hotmail.com>
+*/
+
+package util
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// 连接超时
+const redisDialTimeout = 5 * time.Second
+
+// Redis 返回的错误
+type RedisError string
+
+func (re RedisError) Error() string {
+	return string(re)
+}
+
+// 精简的 RESP 客户端, 仅支持信令代理所需的命令, 兼容 Redis 协议的服务均可使用
+type RedisConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// 连接 Redis, 按需认证并选择数据库
+func DialRedis(addr, password string, db int) (*RedisConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, redisDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := &RedisConn{conn: conn, reader: bufio.NewReader(conn)}
+	if password != "" {
+		if _, err := rc.Do("AUTH", password); err != nil {
+			rc.Close()
+			return nil, err
+		}
+	}
+	if db != 0 {
+		if _, err := rc.Do("SELECT", strconv.Itoa(db)); err != nil {
+			rc.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// 执行命令并读取应答
+func (rc *RedisConn) Do(args ...string) (any, error) {
+	if err := rc.Send(args...); err != nil {
+		return nil, err
+	}
+	return rc.Receive()
+}
+
+// 发送命令
+func (rc *RedisConn) Send(args ...string) error {
+	buf := make([]byte, 0, 64)
+	buf = append(buf, '*')
+	buf = strconv.AppendInt(buf, int64(len(args)), 10)
+	buf = append(buf, '\r', '\n')
+	for _, arg := range args {
+		buf = append(buf, '$')
+		buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+		buf = append(buf, '\r', '\n')
+		buf = append(buf, arg...)
+		buf = append(buf, '\r', '\n')
+	}
+	_, err := rc.conn.Write(buf)
+	return err
+}
+
+// 读取一条应答, 字符串为 string, 整数为 int64, 数组为 []any, 空值为 nil
+func (rc *RedisConn) Receive() (any, error) {
+	line, err := rc.readLine()
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, RedisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(rc.reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		// 数组中的错误项记为 nil, 保证读完整条应答
+		list := make([]any, size)
+		for i := range list {
+			if list[i], err = rc.Receive(); err != nil {
+				if _, ok := err.(RedisError); !ok {
+					return nil, err
+				}
+			}
+		}
+		return list, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+// 设置读写超时, 零值为不限
+func (rc *RedisConn) SetDeadline(t time.Time) error {
+	return rc.conn.SetDeadline(t)
+}
+
+// 关闭连接
+func (rc *RedisConn) Close() error {
+	return rc.conn.Close()
+}
+
+// [工具] 读取一行, 去除行尾
+func (rc *RedisConn) readLine() (string, error) {
+	line, err := rc.reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("redis: malformed line %q", line)
+	}
+	return line[:len(line)-2], nil
+}
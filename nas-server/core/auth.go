@@ -0,0 +1,154 @@
+package core
+
+import (
+	"encoding/base64"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/skye-z/ons/nas-server/util"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const IssuerName = "BetaX ONS NAS"
+const tokenKey = "token.secret"
+const adminKey = "admin.password"
+
+type AuthServer struct {
+}
+
+func CreateAuthServer() *AuthServer {
+	return &AuthServer{}
+}
+
+// 获取管理员初始化状态
+func (as AuthServer) GetState(ctx *gin.Context) {
+	util.ReturnData(ctx, true, map[string]bool{
+		"init": util.GetString(adminKey) != "",
+	})
+}
+
+// 首次运行设置管理员密码
+func (as AuthServer) Init(ctx *gin.Context) {
+	if util.GetString(adminKey) != "" {
+		util.ReturnMessage(ctx, false, "管理员密码已设置")
+		return
+	}
+	password := ctx.PostForm("password")
+	if len(password) < 8 {
+		util.ReturnMessage(ctx, false, "密码长度不能少于8位")
+		return
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		util.ReturnError(ctx, util.Errors.UnexpectedError)
+		return
+	}
+	util.Set(adminKey, string(hash))
+	as.returnToken(ctx)
+}
+
+// 管理员登录
+func (as AuthServer) Login(ctx *gin.Context) {
+	hash := util.GetString(adminKey)
+	if hash == "" {
+		util.ReturnMessage(ctx, false, "请先设置管理员密码")
+		return
+	}
+	source := "web:" + ctx.ClientIP()
+	if !guardBegin(source) {
+		guardFail(source, "locked out")
+		util.ReturnMessage(ctx, false, "密码错误次数过多, 请稍后再试")
+		return
+	}
+	password := ctx.PostForm("password")
+	if bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) != nil {
+		guardFail(source, "admin password error")
+		util.ReturnMessage(ctx, false, "密码错误")
+		return
+	}
+	guardSuccess(source)
+	as.returnToken(ctx)
+}
+
+// 签发令牌并返回
+func (as AuthServer) returnToken(ctx *gin.Context) {
+	token, exp, err := GenerateToken()
+	if err != nil {
+		util.ReturnError(ctx, util.Errors.UnexpectedError)
+		return
+	}
+	util.ReturnData(ctx, true, map[string]any{
+		"token": token,
+		"exp":   exp,
+	})
+}
+
+// 生成令牌
+func GenerateToken() (string, int64, error) {
+	secret := util.GetString(tokenKey)
+	expTime := util.GetInt("token.exp")
+	exp := time.Now().Add(time.Hour * time.Duration(expTime)).Unix()
+	tc := jwt.NewWithClaims(jwt.SigningMethodHS256,
+		jwt.MapClaims{
+			"exp": exp,
+			"iss": IssuerName,
+			"sub": "admin",
+		},
+	)
+	key, _ := base64.StdEncoding.DecodeString(secret)
+	token, err := tc.SignedString(key)
+	return token, exp, err
+}
+
+// 校验管理员令牌
+func verifyToken(code string) *util.CustomError {
+	info := jwt.MapClaims{}
+	secret := util.GetString(tokenKey)
+	token, err := jwt.ParseWithClaims(code, &info, func(token *jwt.Token) (interface{}, error) {
+		key, err := base64.StdEncoding.DecodeString(secret)
+		return key, err
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}))
+	if err != nil {
+		return &util.Errors.TokenNotAvailableError
+	}
+	if !token.Valid {
+		return &util.Errors.TokenInvalidError
+	}
+	iss, err := info.GetIssuer()
+	if err != nil {
+		return &util.Errors.TokenNotAvailableError
+	}
+	if iss != IssuerName {
+		return &util.Errors.TokenIllegalError
+	}
+	return nil
+}
+
+// [工具] 获取请求携带的令牌
+func requestToken(ctx *gin.Context) string {
+	code := ctx.Request.Header.Get("Authorization")
+	if code == "" {
+		// EventSource 与 WebSocket 无法设置请求头
+		code = ctx.Query("token")
+	}
+	if strings.Contains(code, " ") {
+		code = code[strings.Index(code, " ")+1:]
+	}
+	return code
+}
+
+func AuthHandler() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		code := requestToken(ctx)
+		if code == "" {
+			util.ReturnError(ctx, util.Errors.NotLoginError)
+			return
+		}
+		if err := verifyToken(code); err != nil {
+			util.ReturnError(ctx, *err)
+			return
+		}
+	}
+}
@@ -5,8 +5,10 @@ import (
 	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -14,7 +16,9 @@ import (
 )
 
 type Controller struct {
-	Server *P2PServer
+	// 当前的 P2P 服务, 未连接时为空
+	server *P2PServer
+	mu     sync.Mutex
 }
 
 func CreateController() *Controller {
@@ -27,7 +31,10 @@ func CreateController() *Controller {
 }
 
 func (c *Controller) Register(ctx *gin.Context) {
-	if util.GetString("connect.natId") != "" {
+	natId := util.GetString("connect.natId")
+	// 升级旧版编号时重新绑定设备密钥
+	migrate := ctx.Query("migrate") == "true"
+	if natId != "" && util.GetString("connect.deviceKey") != "" && !migrate {
 		util.ReturnMessage(ctx, false, "已完成设备注册, 请勿重复操作")
 		return
 	}
@@ -35,19 +42,38 @@ func (c *Controller) Register(ctx *gin.Context) {
 	if err != nil {
 		hostname = "匿名主机"
 	}
-	req, err := http.NewRequest("POST", fmt.Sprintf("https://%s/api/nas/register", util.GetString("connect.server")), strings.NewReader(fmt.Sprintf("name=%s", hostname)))
+	scheme := "https"
+	if util.GetBool("connect.insecure") {
+		scheme = "http"
+	}
+	// 生成设备密钥, 公钥交由中控校验注册
+	deviceKey, publicKey, err := util.GenerateDeviceKey()
+	if err != nil {
+		util.ReturnMessage(ctx, false, "设备密钥生成失败")
+		return
+	}
+	form := url.Values{}
+	form.Set("name", hostname)
+	form.Set("publicKey", publicKey)
+	// 已注册但未绑定密钥的设备, 沿用原 NAT 编号
+	if natId != "" {
+		form.Set("natId", natId)
+		form.Set("migrate", fmt.Sprint(migrate))
+	}
+	req, err := http.NewRequest("POST", fmt.Sprintf("%s://%s/api/nas/register", scheme, util.GetString("connect.server")), strings.NewReader(form.Encode()))
 	if err != nil {
 		util.ReturnMessage(ctx, false, "中控服务器地址不可用")
 		return
 	}
 
-	code := ctx.Request.Header.Get("Authorization")
+	// 中控令牌, 请求头已用于本机管理员认证
+	code := ctx.Query("code")
 	if code == "" {
 		util.ReturnError(ctx, util.Errors.NotLoginError)
 		return
 	}
 	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	req.Header.Set("Authorization", code)
+	req.Header.Set("Authorization", "Bearer "+code)
 
 	client := &http.Client{
 		Timeout: time.Second * 10,
@@ -64,8 +90,18 @@ func (c *Controller) Register(ctx *gin.Context) {
 		return
 	}
 	msg := util.ToReturnMessage(bodyBytes)
-	if msg.State {
+	if msg == nil {
+		util.ReturnMessage(ctx, false, "中控服务器故障")
+	} else if msg.State {
 		util.Set("connect.natId", msg.Message)
+		util.Set("connect.deviceKey", deviceKey)
+		if natId != "" && msg.Message != natId {
+			// 编号已升级, 原访问密钥随编号失效
+			log.Printf("[P2P] nat id migrated from %s to %s", natId, msg.Message)
+			revokeAllKeys()
+		}
+		// 设备密钥已更换, 重新连接中控
+		go c.restart()
 		util.ReturnMessageData(ctx, true, "注册成功", msg.Message)
 	} else {
 		util.ReturnMessage(ctx, false, msg.Message)
@@ -73,11 +109,45 @@ func (c *Controller) Register(ctx *gin.Context) {
 }
 
 func (c *Controller) GetStatus(ctx *gin.Context) {
-	if c.Server != nil && c.Server.connect != nil {
-		util.ReturnMessage(ctx, true, "已连接")
+	state := c.state()
+	if state.Online {
+		util.ReturnMessageData(ctx, true, "已连接", state)
 	} else {
-		util.ReturnMessage(ctx, false, "未连接")
+		util.ReturnMessageData(ctx, false, "未连接", state)
+	}
+}
+
+// 推送连接状态, 状态变化时立即推送, 否则定时推送传输统计
+func (c *Controller) StreamStatus(ctx *gin.Context) {
+	listener := subscribeState()
+	defer unsubscribeState(listener)
+	ticker := time.NewTicker(5 * time.Second)
+	defer ticker.Stop()
+	ctx.Header("Cache-Control", "no-cache")
+	ctx.Header("X-Accel-Buffering", "no")
+	ctx.SSEvent("state", c.state())
+	ctx.Writer.Flush()
+	ctx.Stream(func(w io.Writer) bool {
+		select {
+		case <-ctx.Request.Context().Done():
+			return false
+		case <-listener:
+		case <-ticker.C:
+		}
+		ctx.SSEvent("state", c.state())
+		return true
+	})
+}
+
+// [工具] 获取连接状态
+func (c *Controller) state() ConnState {
+	state := ConnState{State: StateDisconnected, Clients: []ClientState{}}
+	if server := c.current(); server != nil {
+		state = server.State()
 	}
+	// 附加局域网直连会话
+	state.Clients = append(state.Clients, lanClients()...)
+	return state
 }
 
 func (c *Controller) Connect(ctx *gin.Context) {
@@ -85,7 +155,7 @@ func (c *Controller) Connect(ctx *gin.Context) {
 		util.ReturnMessage(ctx, false, "请先完成设备注册")
 		return
 	}
-	go c.open()
+	c.open()
 	util.ReturnMessage(ctx, true, "开始连接")
 }
 
@@ -94,12 +164,42 @@ func (c *Controller) SwitchAutoConnect(ctx *gin.Context) {
 	util.ReturnMessage(ctx, true, "切换成功")
 }
 
+// 启动 P2P 服务, 已在运行时不做处理
 func (c *Controller) open() {
-	if c.Server != nil {
-		c.Server.connect = nil
-		c.Server.ticker.Stop()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.server != nil {
+		return
+	}
+	c.server = NewP2PServer(util.GetString("connect.natId"), util.GetString("connect.server"))
+}
+
+// 以新的设备信息重启运行中的 P2P 服务
+func (c *Controller) restart() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.server == nil {
+		return
 	}
-	c.Server = NewP2PServer(util.GetString("connect.natId"), util.GetString("connect.server"))
+	c.server.Close()
+	c.server = NewP2PServer(util.GetString("connect.natId"), util.GetString("connect.server"))
+}
+
+// 停止 P2P 服务
+func (c *Controller) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.server != nil {
+		c.server.Close()
+		c.server = nil
+	}
+}
+
+// [工具] 获取当前的 P2P 服务
+func (c *Controller) current() *P2PServer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.server
 }
 
 func (c *Controller) Disconnect(ctx *gin.Context) {
@@ -107,12 +207,7 @@ func (c *Controller) Disconnect(ctx *gin.Context) {
 		util.ReturnMessage(ctx, false, "请先完成设备注册")
 		return
 	}
-	if c.Server != nil && c.Server.connect != nil {
-		c.Server.connect.Close()
-		c.Server.connect = nil
-		c.Server.ticker.Stop()
-		c.Server.ticker = time.NewTicker(5 * time.Minute)
-	}
+	c.close()
 	log.Println("[P2P] connection close")
 	util.ReturnMessage(ctx, true, "连接关闭")
 }
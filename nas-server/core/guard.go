@@ -0,0 +1,161 @@
+package core
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skye-z/ons/nas-server/util"
+)
+
+const auditPath = "./audit.log"
+
+// 审计日志保留条数
+const auditLimit = 200
+
+const (
+	// 无尝试超过该时长且未锁定的来源清除记录/秒
+	guardWindow = 900
+	// 清理过期记录的间隔/秒
+	guardSweepPeriod = 60
+)
+
+// 失败审计记录
+type AuditEntry struct {
+	Time   int64  `json:"time"`
+	Source string `json:"source"`
+	Reason string `json:"reason"`
+}
+
+// 来源锁定状态
+type LockState struct {
+	Source      string `json:"source"`
+	Failures    int    `json:"failures"`
+	LockedUntil int64  `json:"lockedUntil"`
+	// 最近一次尝试时间
+	lastTry int64
+}
+
+var (
+	attempts   = make(map[string]*LockState) // 各来源的尝试次数
+	auditLog   []AuditEntry                  // 最近的失败记录
+	lastSweep  int64                         // 上次清理过期记录的时间
+	guardMutex sync.Mutex                    // 保护尝试记录的互斥锁
+)
+
+// 清除锁定与观察窗口均已过期的来源, 调用方需持有锁
+func guardSweep(now int64) {
+	lastSweep = now
+	for source, state := range attempts {
+		if state.LockedUntil <= now && now-state.lastTry >= guardWindow {
+			delete(attempts, source)
+		}
+	}
+}
+
+// 检查来源是否允许认证, 并计入一次尝试
+func guardBegin(source string) bool {
+	guardMutex.Lock()
+	defer guardMutex.Unlock()
+	now := time.Now().Unix()
+	if now-lastSweep >= guardSweepPeriod {
+		guardSweep(now)
+	}
+	state := attempts[source]
+	if state == nil {
+		state = &LockState{Source: source}
+		attempts[source] = state
+	}
+	if state.LockedUntil > now {
+		return false
+	}
+	state.lastTry = now
+	state.Failures++
+	limit := util.GetInt("guard.attempts")
+	if limit <= 0 {
+		limit = 5
+	}
+	if state.Failures >= limit {
+		// 指数退避锁定, 最长1小时
+		lock := int64(30) << min(state.Failures-limit, 7)
+		if lock > 3600 {
+			lock = 3600
+		}
+		state.LockedUntil = now + lock
+	}
+	return true
+}
+
+// 认证成功, 清除来源的失败计数
+func guardSuccess(source string) {
+	guardMutex.Lock()
+	defer guardMutex.Unlock()
+	delete(attempts, source)
+}
+
+// 记录认证失败
+func guardFail(source, reason string) {
+	entry := AuditEntry{
+		Time:   time.Now().Unix() * 1000,
+		Source: source,
+		Reason: reason,
+	}
+	guardMutex.Lock()
+	auditLog = append(auditLog, entry)
+	if len(auditLog) > auditLimit {
+		auditLog = auditLog[len(auditLog)-auditLimit:]
+	}
+	guardMutex.Unlock()
+	log.Printf("[Guard] %s from %s", reason, source)
+
+	file, err := os.OpenFile(auditPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		log.Printf("[Guard] error writing audit log: %v", err)
+		return
+	}
+	defer file.Close()
+	line, _ := json.Marshal(entry)
+	file.Write(append(line, '\n'))
+}
+
+type GuardServer struct {
+}
+
+func CreateGuardServer() *GuardServer {
+	return &GuardServer{}
+}
+
+// 获取审计日志与锁定状态
+func (gs GuardServer) Get(ctx *gin.Context) {
+	guardMutex.Lock()
+	defer guardMutex.Unlock()
+	now := time.Now().Unix()
+	guardSweep(now)
+	locks := make([]LockState, 0)
+	for _, state := range attempts {
+		if state.LockedUntil > now {
+			locks = append(locks, *state)
+		}
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].LockedUntil > locks[j].LockedUntil })
+	logs := make([]AuditEntry, 0, len(auditLog))
+	for i := len(auditLog) - 1; i >= 0; i-- {
+		logs = append(logs, auditLog[i])
+	}
+	util.ReturnData(ctx, true, map[string]any{
+		"locks": locks,
+		"logs":  logs,
+	})
+}
+
+// 解除全部锁定
+func (gs GuardServer) Unlock(ctx *gin.Context) {
+	guardMutex.Lock()
+	attempts = make(map[string]*LockState)
+	guardMutex.Unlock()
+	util.ReturnMessage(ctx, true, "已解除锁定")
+}
@@ -0,0 +1,135 @@
+package core
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// [工具] 清空尝试记录, 测试结束后恢复
+func resetGuard(t *testing.T) {
+	guardMutex.Lock()
+	attempts = make(map[string]*LockState)
+	lastSweep = 0
+	guardMutex.Unlock()
+	t.Cleanup(func() {
+		guardMutex.Lock()
+		attempts = make(map[string]*LockState)
+		guardMutex.Unlock()
+	})
+}
+
+// [工具] 读取来源的锁定状态
+func lockState(source string) (LockState, bool) {
+	guardMutex.Lock()
+	defer guardMutex.Unlock()
+	state, ok := attempts[source]
+	if !ok {
+		return LockState{}, false
+	}
+	return *state, true
+}
+
+func TestGuardLockout(t *testing.T) {
+	resetGuard(t)
+	// 未配置时默认允许 5 次尝试
+	for i := 1; i <= 5; i++ {
+		if !guardBegin("ip:a") {
+			t.Fatalf("attempt %d refused", i)
+		}
+	}
+	if guardBegin("ip:a") {
+		t.Fatal("attempt allowed while locked")
+	}
+	state, _ := lockState("ip:a")
+	if lock := state.LockedUntil - time.Now().Unix(); lock < 29 || lock > 30 {
+		t.Fatalf("first lockout = %ds, want 30s", lock)
+	}
+	// 其他来源不受影响
+	if !guardBegin("ip:b") {
+		t.Fatal("other source refused")
+	}
+}
+
+func TestGuardBackoff(t *testing.T) {
+	resetGuard(t)
+	for i := 0; i < 5; i++ {
+		guardBegin("ip:a")
+	}
+	for _, want := range []int64{60, 120, 240} {
+		// 模拟锁定到期
+		guardMutex.Lock()
+		attempts["ip:a"].LockedUntil = 0
+		guardMutex.Unlock()
+		if !guardBegin("ip:a") {
+			t.Fatal("attempt refused after lockout expired")
+		}
+		state, _ := lockState("ip:a")
+		if lock := state.LockedUntil - time.Now().Unix(); lock < want-1 || lock > want {
+			t.Fatalf("lockout = %ds, want %ds", lock, want)
+		}
+	}
+	// 最长锁定 1 小时
+	guardMutex.Lock()
+	attempts["ip:a"].Failures = 100
+	attempts["ip:a"].LockedUntil = 0
+	guardMutex.Unlock()
+	guardBegin("ip:a")
+	state, _ := lockState("ip:a")
+	if lock := state.LockedUntil - time.Now().Unix(); lock > 3600 {
+		t.Fatalf("lockout = %ds, want at most 3600s", lock)
+	}
+}
+
+func TestGuardSuccess(t *testing.T) {
+	resetGuard(t)
+	for i := 0; i < 4; i++ {
+		guardBegin("ip:a")
+	}
+	guardSuccess("ip:a")
+	if _, ok := lockState("ip:a"); ok {
+		t.Fatal("failures kept after success")
+	}
+	for i := 1; i <= 5; i++ {
+		if !guardBegin("ip:a") {
+			t.Fatalf("attempt %d refused after success", i)
+		}
+	}
+}
+
+func TestGuardSweep(t *testing.T) {
+	resetGuard(t)
+	for i := 0; i < 1000; i++ {
+		guardBegin(fmt.Sprintf("ip:%d", i))
+	}
+	for i := 0; i < 5; i++ {
+		guardBegin("ip:locked")
+	}
+	now := time.Now().Unix()
+	guardMutex.Lock()
+	for _, state := range attempts {
+		state.lastTry = now - guardWindow
+	}
+	attempts["ip:locked"].LockedUntil = now + 60
+	attempts["ip:recent"] = &LockState{Source: "ip:recent", Failures: 1, lastTry: now}
+	// 距上次清理已超过间隔
+	lastSweep = now - guardSweepPeriod
+	guardMutex.Unlock()
+
+	guardBegin("ip:new")
+	guardMutex.Lock()
+	size := len(attempts)
+	guardMutex.Unlock()
+	if size != 3 {
+		t.Fatalf("%d sources kept after sweep, want 3", size)
+	}
+	if _, ok := lockState("ip:locked"); !ok {
+		t.Fatal("locked source evicted")
+	}
+	if _, ok := lockState("ip:recent"); !ok {
+		t.Fatal("source inside the window evicted")
+	}
+	if guardBegin("ip:locked") {
+		t.Fatal("lockout lost after sweep")
+	}
+}
@@ -0,0 +1,248 @@
+package core
+
+import (
+	"encoding/json"
+	"log"
+	"math/big"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/skye-z/ons/nas-server/util"
+)
+
+const keyPath = "./keys.json"
+
+// 设备访问密钥
+type AccessKey struct {
+	Id       string        `json:"id"`
+	Name     string        `json:"name"`
+	Secret   string        `json:"secret,omitempty"`
+	Policy   *AccessPolicy `json:"policy,omitempty"`
+	Created  int64         `json:"created"`
+	LastUsed int64         `json:"lastUsed"`
+}
+
+var (
+	accessKeys []AccessKey // 已签发的访问密钥
+	keyLoaded  bool        // 是否已从文件载入
+	keyMutex   sync.Mutex  // 保护访问密钥的互斥锁
+)
+
+// 载入访问密钥, 调用方需持有锁
+func loadKeys() {
+	if keyLoaded {
+		return
+	}
+	keyLoaded = true
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("[Key] error reading keys: %v", err)
+		}
+		return
+	}
+	if err := json.Unmarshal(data, &accessKeys); err != nil {
+		log.Printf("[Key] error parsing keys: %v", err)
+	}
+}
+
+// 保存访问密钥, 调用方需持有锁
+func saveKeys() error {
+	data, err := json.MarshalIndent(accessKeys, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(keyPath, data, 0600)
+}
+
+// 获取访问密钥对应的 SPAKE2 秘密与访问策略, 空编号表示共享连接密码
+func keyAccess(natId, id string) (*big.Int, *AccessPolicy) {
+	if id == "" {
+		// 未设置连接密码时只接受访问密钥
+		password := util.GetString("connect.password")
+		if password == "" {
+			return nil, nil
+		}
+		return util.PAKESecret(natId, password), nil
+	}
+	keyMutex.Lock()
+	defer keyMutex.Unlock()
+	loadKeys()
+	for _, key := range accessKeys {
+		if key.Id == id {
+			w, ok := new(big.Int).SetString(key.Secret, 16)
+			if ok {
+				return w, key.Policy
+			}
+		}
+	}
+	return nil, nil
+}
+
+// 从请求中读取访问策略
+func readPolicy(ctx *gin.Context) *AccessPolicy {
+	policy := &AccessPolicy{
+		ReadOnly: util.GetPostBool(ctx, "readOnly", false),
+		Paths:    parsePolicyPaths(ctx.PostForm("paths")),
+	}
+	if !policy.ReadOnly && len(policy.Paths) == 0 {
+		return nil
+	}
+	return policy
+}
+
+// 记录访问密钥使用时间
+func touchKey(id string) {
+	if id == "" {
+		return
+	}
+	keyMutex.Lock()
+	defer keyMutex.Unlock()
+	loadKeys()
+	for i := range accessKeys {
+		if accessKeys[i].Id == id {
+			accessKeys[i].LastUsed = time.Now().Unix() * 1000
+			if err := saveKeys(); err != nil {
+				log.Printf("[Key] error saving keys: %v", err)
+			}
+			return
+		}
+	}
+}
+
+// 吊销全部访问密钥, NAT 编号变更后原密钥的秘密随之失效
+func revokeAllKeys() {
+	keyMutex.Lock()
+	loadKeys()
+	revoked := accessKeys
+	accessKeys = nil
+	if err := saveKeys(); err != nil {
+		log.Printf("[Key] error saving keys: %v", err)
+	}
+	keyMutex.Unlock()
+	for _, key := range revoked {
+		dropLANKey(key.Id)
+	}
+	if len(revoked) > 0 {
+		log.Printf("[Key] %d keys revoked", len(revoked))
+	}
+}
+
+type KeyServer struct {
+	control *Controller
+}
+
+func CreateKeyServer(control *Controller) *KeyServer {
+	return &KeyServer{control: control}
+}
+
+// 获取访问密钥列表
+func (ks KeyServer) List(ctx *gin.Context) {
+	keyMutex.Lock()
+	defer keyMutex.Unlock()
+	loadKeys()
+	list := make([]AccessKey, len(accessKeys))
+	for i, key := range accessKeys {
+		key.Secret = ""
+		list[i] = key
+	}
+	util.ReturnData(ctx, true, list)
+}
+
+// 签发访问密钥, 完整密钥仅返回一次
+func (ks KeyServer) Create(ctx *gin.Context) {
+	name := ctx.PostForm("name")
+	if len(name) == 0 {
+		util.ReturnMessage(ctx, false, "设备名称不能为空")
+		return
+	}
+	natId := util.GetString("connect.natId")
+	if natId == "" {
+		util.ReturnMessage(ctx, false, "请先完成设备注册")
+		return
+	}
+	id := util.GenerateRandomString(8)
+	secret := util.GenerateRandomString(24)
+	keyMutex.Lock()
+	defer keyMutex.Unlock()
+	loadKeys()
+	accessKeys = append(accessKeys, AccessKey{
+		Id:      id,
+		Name:    name,
+		Secret:  util.PAKESecret(natId+"/"+id, secret).Text(16),
+		Policy:  readPolicy(ctx),
+		Created: time.Now().Unix() * 1000,
+	})
+	if err := saveKeys(); err != nil {
+		accessKeys = accessKeys[:len(accessKeys)-1]
+		util.ReturnMessage(ctx, false, "密钥保存失败")
+		return
+	}
+	util.ReturnMessageData(ctx, true, "密钥已签发", id+"."+secret)
+}
+
+// 更新访问策略
+func (ks KeyServer) Update(ctx *gin.Context) {
+	id := ctx.Param("id")
+	keyMutex.Lock()
+	loadKeys()
+	found := false
+	var err error
+	for i := range accessKeys {
+		if accessKeys[i].Id == id {
+			accessKeys[i].Policy = readPolicy(ctx)
+			found = true
+			err = saveKeys()
+			break
+		}
+	}
+	keyMutex.Unlock()
+	if !found {
+		util.ReturnMessage(ctx, false, "密钥不存在")
+		return
+	} else if err != nil {
+		util.ReturnMessage(ctx, false, "密钥保存失败")
+		return
+	}
+	// 断开连接, 重新认证后按新策略生效
+	if server := ks.control.current(); server != nil {
+		server.dropKey(id)
+	}
+	dropLANKey(id)
+	util.ReturnMessage(ctx, true, "访问策略已更新")
+}
+
+// 吊销访问密钥
+func (ks KeyServer) Revoke(ctx *gin.Context) {
+	id := ctx.Param("id")
+	keyMutex.Lock()
+	loadKeys()
+	found := false
+	for i, key := range accessKeys {
+		if key.Id == id {
+			accessKeys = append(accessKeys[:i], accessKeys[i+1:]...)
+			found = true
+			break
+		}
+	}
+	var err error
+	if found {
+		err = saveKeys()
+	}
+	keyMutex.Unlock()
+	if !found {
+		util.ReturnMessage(ctx, false, "密钥不存在")
+		return
+	} else if err != nil {
+		util.ReturnMessage(ctx, false, "密钥保存失败")
+		return
+	}
+	// 断开使用该密钥的连接
+	if server := ks.control.current(); server != nil {
+		server.dropKey(id)
+	}
+	dropLANKey(id)
+	util.ReturnMessage(ctx, true, "密钥已吊销")
+}
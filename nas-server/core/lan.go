@@ -0,0 +1,259 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/skye-z/ons/nas-server/util"
+)
+
+// 局域网直连完成口令认证的最长时间
+const lanHandshakeWait = 10 * time.Second
+
+var (
+	lanUpgrader = websocket.Upgrader{
+		ReadBufferSize:  1024,
+		WriteBufferSize: 1024,
+		CheckOrigin:     lanOrigin,
+	}
+	lanSessions = make(map[*lanTransport]bool) // 局域网直连会话
+	lanMutex    sync.Mutex                     // 保护局域网会话的互斥锁
+)
+
+// 局域网 WebSocket 直连通道
+type lanTransport struct {
+	connect *websocket.Conn
+	source  string
+	// 使用的访问密钥编号
+	kid     string
+	cipher  frameCipher
+	queue   vaultQueue
+	created int64
+	// 传输统计
+	lastSync      int64
+	bytesSent     uint64
+	bytesReceived uint64
+	mu            sync.Mutex
+	writeMu       sync.Mutex
+}
+
+func (lt *lanTransport) SendText(text string) error {
+	// 加密与写入需保持相同顺序
+	lt.writeMu.Lock()
+	defer lt.writeMu.Unlock()
+	lt.mu.Lock()
+	frame, err := lt.cipher.seal(text)
+	lt.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	lt.connect.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := lt.connect.WriteMessage(websocket.TextMessage, []byte(frame)); err != nil {
+		return err
+	}
+	lt.mu.Lock()
+	lt.bytesSent += uint64(len(text))
+	lt.mu.Unlock()
+	return nil
+}
+
+// 解密客户端发来的帧
+func (lt *lanTransport) open(frame []byte) ([]byte, error) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	text, err := lt.cipher.open(string(frame))
+	if err != nil {
+		return nil, err
+	}
+	lt.bytesReceived += uint64(len(text))
+	lt.lastSync = time.Now().Unix() * 1000
+	return text, nil
+}
+
+// 获取会话状态快照
+func (lt *lanTransport) status() ClientState {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	return ClientState{
+		Id:            "lan:" + lt.source,
+		Source:        lt.source,
+		Key:           lt.kid,
+		State:         SessionOpen,
+		Transport:     "lan",
+		LocalType:     "host",
+		RemoteType:    "host",
+		BytesSent:     lt.bytesSent,
+		BytesReceived: lt.bytesReceived,
+		Created:       lt.created,
+		LastSync:      lt.lastSync,
+	}
+}
+
+type LANServer struct {
+}
+
+func CreateLANServer() *LANServer {
+	return &LANServer{}
+}
+
+// 局域网直连同步, 先以访问密钥或连接密码完成口令认证, 之后的帧均加密传输
+func (ls LANServer) Sync(ctx *gin.Context) {
+	source := "lan:" + ctx.ClientIP()
+	if !guardBegin(source) {
+		guardFail(source, "locked out")
+		util.ReturnMessage(ctx, false, "密码错误次数过多, 请稍后再试")
+		return
+	}
+	connect, err := lanUpgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		log.Printf("[LAN] upgrade failed: %v", err)
+		return
+	}
+	defer connect.Close()
+	connect.SetReadDeadline(time.Now().Add(lanHandshakeWait))
+	kid, policy, key, err := lanHandshake(connect)
+	if err != nil {
+		guardFail(source, "lan "+err.Error())
+		connect.WriteControl(websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "password error"),
+			time.Now().Add(writeWait))
+		return
+	}
+	transport := &lanTransport{
+		connect: connect,
+		source:  ctx.ClientIP(),
+		kid:     kid,
+		cipher:  newFrameCipher(key),
+		created: time.Now().Unix() * 1000,
+	}
+	// 首帧可解密即证明客户端持有会话密钥
+	_, frame, err := connect.ReadMessage()
+	if err != nil {
+		return
+	}
+	data, err := transport.open(frame)
+	if err != nil {
+		guardFail(source, "lan frame rejected")
+		return
+	}
+	guardSuccess(source)
+	touchKey(kid)
+	lanMutex.Lock()
+	lanSessions[transport] = true
+	lanMutex.Unlock()
+	notifyState()
+	log.Printf("[LAN] client %s connected", transport.source)
+	defer func() {
+		lanMutex.Lock()
+		delete(lanSessions, transport)
+		lanMutex.Unlock()
+		notifyState()
+		log.Printf("[LAN] client %s disconnected", transport.source)
+	}()
+
+	connect.SetReadDeadline(time.Now().Add(pongWait))
+	connect.SetPongHandler(func(string) error {
+		return connect.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	go transport.keepalive()
+	defer transport.queue.close()
+	for {
+		if !transport.queue.push(transport, policy, data) {
+			log.Printf("[LAN] client %s queue full", transport.source)
+			return
+		}
+		_, frame, err := connect.ReadMessage()
+		if err != nil {
+			return
+		}
+		connect.SetReadDeadline(time.Now().Add(pongWait))
+		if data, err = transport.open(frame); err != nil {
+			log.Printf("[LAN] client %s frame rejected: %v", transport.source, err)
+			return
+		}
+	}
+}
+
+// 定时发送 ping 保持连接
+func (lt *lanTransport) keepalive() {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		lt.writeMu.Lock()
+		err := lt.connect.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+		lt.writeMu.Unlock()
+		if err != nil {
+			lt.connect.Close()
+			return
+		}
+	}
+}
+
+// 完成口令认证, 返回访问密钥编号、访问策略与会话密钥
+func lanHandshake(connect *websocket.Conn) (string, *AccessPolicy, []byte, error) {
+	natId := util.GetString("connect.natId")
+	if natId == "" {
+		return "", nil, nil, errors.New("device not registered")
+	}
+	var init PAKEMessage
+	if err := connect.ReadJSON(&init); err != nil {
+		return "", nil, nil, errors.New("invalid pake message")
+	}
+	w, policy := keyAccess(natId, init.Kid)
+	if w == nil {
+		return "", nil, nil, errors.New("unknown key")
+	}
+	y, key, err := util.PAKERespond(w, "NSC", natId, init.X)
+	if err != nil {
+		return "", nil, nil, err
+	}
+	data, _ := json.Marshal(PAKEMessage{
+		Y:       y,
+		Confirm: util.PAKEMac(key, "confirm", natId),
+	})
+	connect.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := connect.WriteMessage(websocket.TextMessage, data); err != nil {
+		return "", nil, nil, err
+	}
+	return init.Kid, policy, key, nil
+}
+
+// 只允许非浏览器客户端或同源页面建立直连
+func lanOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == r.Host
+}
+
+// 获取局域网直连会话
+func lanClients() []ClientState {
+	lanMutex.Lock()
+	defer lanMutex.Unlock()
+	var list []ClientState
+	for lt := range lanSessions {
+		list = append(list, lt.status())
+	}
+	return list
+}
+
+// 断开使用指定访问密钥的直连会话
+func dropLANKey(id string) {
+	lanMutex.Lock()
+	defer lanMutex.Unlock()
+	for lt := range lanSessions {
+		if lt.kid == id {
+			lt.connect.Close()
+			log.Printf("[LAN] key %s revoked, client %s closed", id, lt.source)
+		}
+	}
+}
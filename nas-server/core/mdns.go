@@ -0,0 +1,348 @@
+package core
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/skye-z/ons/nas-server/util"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+const (
+	// DNS-SD 服务类型
+	mdnsService = "_ons._tcp.local."
+	mdnsBrowse  = "_services._dns-sd._udp.local."
+	// 记录有效期/秒
+	mdnsTTL = 120
+	// 缓存刷新标记
+	mdnsCacheFlush = 1 << 15
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// 局域网发现到的 NAS
+type DiscoveredNAS struct {
+	Instance string
+	NatId    string
+	Hostname string
+	Host     string
+	Port     int
+	TLS      bool
+	Addrs    []net.IP
+	Text     map[string]string
+}
+
+// mDNS 广播服务
+type mdnsAdvertiser struct {
+	connect *net.UDPConn
+	port    int
+	tls     bool
+}
+
+// 通过 mDNS/DNS-SD 在局域网广播本机, 端口与是否启用 TLS 须与路由实际监听的一致
+func StartAdvertise(port int, tls bool) {
+	if !util.GetBool("mdns.enable") {
+		return
+	}
+	connect, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		log.Printf("[mDNS] listen failed: %v", err)
+		return
+	}
+	ma := &mdnsAdvertiser{connect: connect, port: port, tls: tls}
+	log.Printf("[mDNS] advertising %s", ma.instance())
+	// 启动时主动通告两次
+	go func() {
+		for i := 0; i < 2; i++ {
+			ma.announce()
+			time.Sleep(time.Second)
+		}
+	}()
+	go ma.serve()
+}
+
+// 监听查询并应答
+func (ma *mdnsAdvertiser) serve() {
+	buf := make([]byte, 9000)
+	for {
+		n, src, err := ma.connect.ReadFromUDP(buf)
+		if err != nil {
+			log.Printf("[mDNS] read: %v", err)
+			return
+		}
+		var query dnsmessage.Message
+		if err := query.Unpack(buf[:n]); err != nil || query.Header.Response {
+			continue
+		}
+		answers := ma.answer(query.Questions)
+		if len(answers) == 0 {
+			continue
+		}
+		// 非 5353 端口的查询按传统单播应答, 不设置缓存刷新标记
+		if src.Port != mdnsGroup.Port {
+			for i := range answers {
+				answers[i].Header.Class &^= mdnsCacheFlush
+			}
+			ma.send(query.Header.ID, query.Questions, answers, src)
+		} else {
+			ma.send(0, nil, answers, mdnsGroup)
+		}
+	}
+}
+
+// 主动通告全部记录
+func (ma *mdnsAdvertiser) announce() {
+	ma.send(0, nil, ma.records(), mdnsGroup)
+}
+
+// [工具] 发送应答
+func (ma *mdnsAdvertiser) send(id uint16, questions []dnsmessage.Question, answers []dnsmessage.Resource, dst *net.UDPAddr) {
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, Response: true, Authoritative: true},
+		Questions: questions,
+		Answers:   answers,
+	}
+	data, err := msg.Pack()
+	if err != nil {
+		log.Printf("[mDNS] pack: %v", err)
+		return
+	}
+	if _, err := ma.connect.WriteToUDP(data, dst); err != nil {
+		log.Printf("[mDNS] write: %v", err)
+	}
+}
+
+// [工具] 根据问题筛选需要应答的记录
+func (ma *mdnsAdvertiser) answer(questions []dnsmessage.Question) []dnsmessage.Resource {
+	records := ma.records()
+	var answers []dnsmessage.Resource
+	for _, q := range questions {
+		name := strings.ToLower(q.Name.String())
+		if q.Type == dnsmessage.TypePTR && name == mdnsBrowse {
+			// 服务类型枚举
+			answers = append(answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(mdnsBrowse), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: mdnsTTL},
+				Body:   &dnsmessage.PTRResource{PTR: dnsmessage.MustNewName(mdnsService)},
+			})
+			continue
+		}
+		// PTR 查询附带实例的全部记录, 便于一次完成解析
+		if q.Type == dnsmessage.TypePTR && name == mdnsService {
+			answers = append(answers, records...)
+			continue
+		}
+		for _, r := range records {
+			if strings.ToLower(r.Header.Name.String()) != name {
+				continue
+			}
+			if q.Type == dnsmessage.TypeALL || q.Type == r.Header.Type {
+				answers = append(answers, r)
+			}
+		}
+	}
+	return answers
+}
+
+// [工具] 生成本机的 DNS-SD 记录
+func (ma *mdnsAdvertiser) records() []dnsmessage.Resource {
+	instance, err := dnsmessage.NewName(ma.instance())
+	if err != nil {
+		return nil
+	}
+	hostname := mdnsHostname()
+	host := dnsmessage.MustNewName(hostname + ".local.")
+	records := []dnsmessage.Resource{
+		{
+			Header: dnsmessage.ResourceHeader{Name: dnsmessage.MustNewName(mdnsService), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET, TTL: mdnsTTL},
+			Body:   &dnsmessage.PTRResource{PTR: instance},
+		},
+		{
+			Header: dnsmessage.ResourceHeader{Name: instance, Type: dnsmessage.TypeSRV, Class: dnsmessage.ClassINET | mdnsCacheFlush, TTL: mdnsTTL},
+			Body:   &dnsmessage.SRVResource{Target: host, Port: uint16(ma.port)},
+		},
+		{
+			Header: dnsmessage.ResourceHeader{Name: instance, Type: dnsmessage.TypeTXT, Class: dnsmessage.ClassINET | mdnsCacheFlush, TTL: mdnsTTL},
+			Body: &dnsmessage.TXTResource{TXT: []string{
+				"natId=" + util.GetString("connect.natId"),
+				"hostname=" + hostname,
+				"port=" + strconv.Itoa(ma.port),
+				"tls=" + strconv.FormatBool(ma.tls),
+				"path=/sync",
+				"version=" + util.Version,
+			}},
+		},
+	}
+	for _, ip := range localIPv4() {
+		var a [4]byte
+		copy(a[:], ip)
+		records = append(records, dnsmessage.Resource{
+			Header: dnsmessage.ResourceHeader{Name: host, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET | mdnsCacheFlush, TTL: mdnsTTL},
+			Body:   &dnsmessage.AResource{A: a},
+		})
+	}
+	return records
+}
+
+// [工具] 服务实例名
+func (ma *mdnsAdvertiser) instance() string {
+	name := mdnsHostname()
+	if natId := util.GetString("connect.natId"); natId != "" {
+		name += "-" + natId
+	}
+	return "ONS NAS " + name + "." + mdnsService
+}
+
+// 浏览局域网内的 NAS, 用于测试发现
+func Discover(timeout time.Duration) ([]DiscoveredNAS, error) {
+	connect, err := net.ListenUDP("udp4", &net.UDPAddr{})
+	if err != nil {
+		return nil, err
+	}
+	defer connect.Close()
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 1},
+		Questions: []dnsmessage.Question{
+			{Name: dnsmessage.MustNewName(mdnsService), Type: dnsmessage.TypePTR, Class: dnsmessage.ClassINET},
+		},
+	}
+	data, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := connect.WriteToUDP(data, mdnsGroup); err != nil {
+		return nil, err
+	}
+	found := make(map[string]*DiscoveredNAS)
+	hosts := make(map[string][]net.IP)
+	var order []string
+	connect.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, 9000)
+	for {
+		n, _, err := connect.ReadFromUDP(buf)
+		if err != nil {
+			break
+		}
+		var msg dnsmessage.Message
+		if err := msg.Unpack(buf[:n]); err != nil || !msg.Header.Response {
+			continue
+		}
+		for _, r := range append(msg.Answers, msg.Additionals...) {
+			name := r.Header.Name.String()
+			item := func() *DiscoveredNAS {
+				if found[name] == nil {
+					found[name] = &DiscoveredNAS{Instance: strings.TrimSuffix(name, "."+mdnsService), Text: make(map[string]string)}
+					order = append(order, name)
+				}
+				return found[name]
+			}
+			switch body := r.Body.(type) {
+			case *dnsmessage.SRVResource:
+				nas := item()
+				nas.Host = body.Target.String()
+				nas.Port = int(body.Port)
+			case *dnsmessage.TXTResource:
+				nas := item()
+				for _, txt := range body.TXT {
+					if k, v, ok := strings.Cut(txt, "="); ok {
+						nas.Text[k] = v
+					}
+				}
+				nas.NatId = nas.Text["natId"]
+				nas.Hostname = nas.Text["hostname"]
+				nas.TLS = nas.Text["tls"] == "true"
+			case *dnsmessage.AResource:
+				ip := net.IP(body.A[:])
+				if !containsIP(hosts[name], ip) {
+					hosts[name] = append(hosts[name], ip)
+				}
+			}
+		}
+	}
+	var list []DiscoveredNAS
+	for _, name := range order {
+		nas := found[name]
+		if nas.Port == 0 {
+			continue
+		}
+		nas.Addrs = hosts[nas.Host]
+		list = append(list, *nas)
+	}
+	return list, nil
+}
+
+// 输出局域网发现结果
+func PrintDiscover(timeout time.Duration) {
+	list, err := Discover(timeout)
+	if err != nil {
+		util.OutErr("mDNS", "discover failed: %v", err)
+	}
+	if len(list) == 0 {
+		fmt.Println("no NAS found")
+		return
+	}
+	for _, nas := range list {
+		scheme := "http://"
+		if nas.TLS {
+			scheme = "https://"
+		}
+		var addrs []string
+		for _, ip := range nas.Addrs {
+			addrs = append(addrs, scheme+net.JoinHostPort(ip.String(), strconv.Itoa(nas.Port)))
+		}
+		fmt.Printf("%s\tNAT.ID %s\thost %s\t%s\n", nas.Instance, nas.NatId, nas.Hostname, strings.Join(addrs, ", "))
+	}
+}
+
+// [工具] 生成符合 DNS 标签规则的主机名
+func mdnsHostname() string {
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "ons-nas"
+	}
+	return mdnsLabel(hostname)
+}
+
+// [工具] 取主机名首段, 非字母数字的字符替换为连字符
+func mdnsLabel(hostname string) string {
+	hostname = strings.ToLower(strings.Split(hostname, ".")[0])
+	var b strings.Builder
+	for _, c := range hostname {
+		if (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') || c == '-' {
+			b.WriteRune(c)
+		} else {
+			b.WriteRune('-')
+		}
+	}
+	return b.String()
+}
+
+// [工具] 获取本机局域网 IPv4 地址
+func localIPv4() []net.IP {
+	var list []net.IP
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok {
+			if ip := ipNet.IP.To4(); ip != nil && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() {
+				list = append(list, ip)
+			}
+		}
+	}
+	return list
+}
+
+func containsIP(list []net.IP, ip net.IP) bool {
+	for _, item := range list {
+		if item.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,135 @@
+package core
+
+import (
+	"embed"
+	"strings"
+	"testing"
+
+	"github.com/skye-z/ons/nas-server/util"
+	"github.com/spf13/viper"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// [工具] 设置广播的 NAT 编号, 测试结束后清空
+func useNATId(t *testing.T, natId string) {
+	viper.Set("connect.natId", natId)
+	t.Cleanup(func() { viper.Set("connect.natId", "") })
+}
+
+// [工具] 按类型查找记录
+func findRecord(records []dnsmessage.Resource, kind dnsmessage.Type) *dnsmessage.Resource {
+	for i := range records {
+		if records[i].Header.Type == kind {
+			return &records[i]
+		}
+	}
+	return nil
+}
+
+func TestMDNSRecords(t *testing.T) {
+	useNATId(t, "7992739875")
+	for _, c := range []struct {
+		port int
+		tls  bool
+		txt  []string
+	}{
+		{9892, false, []string{"port=9892", "tls=false"}},
+		{443, true, []string{"port=443", "tls=true"}},
+	} {
+		ma := &mdnsAdvertiser{port: c.port, tls: c.tls}
+		records := ma.records()
+		// 记录须能编码为合法的 DNS 报文
+		msg := dnsmessage.Message{Header: dnsmessage.Header{Response: true, Authoritative: true}, Answers: records}
+		data, err := msg.Pack()
+		if err != nil {
+			t.Fatalf("pack: %v", err)
+		}
+		var parsed dnsmessage.Message
+		if err := parsed.Unpack(data); err != nil || len(parsed.Answers) != len(records) {
+			t.Fatalf("unpack = %d answers, %v", len(parsed.Answers), err)
+		}
+		instance := ma.instance()
+		if !strings.HasSuffix(instance, "-7992739875."+mdnsService) {
+			t.Fatalf("instance = %s", instance)
+		}
+		ptr := findRecord(parsed.Answers, dnsmessage.TypePTR)
+		if ptr == nil || ptr.Body.(*dnsmessage.PTRResource).PTR.String() != instance {
+			t.Fatalf("ptr = %+v", ptr)
+		}
+		srv := findRecord(parsed.Answers, dnsmessage.TypeSRV)
+		if srv == nil || srv.Body.(*dnsmessage.SRVResource).Port != uint16(c.port) || srv.Header.Name.String() != instance {
+			t.Fatalf("srv = %+v", srv)
+		}
+		txt := findRecord(parsed.Answers, dnsmessage.TypeTXT)
+		if txt == nil {
+			t.Fatal("txt record missing")
+		}
+		text := make(map[string]bool)
+		for _, item := range txt.Body.(*dnsmessage.TXTResource).TXT {
+			text[item] = true
+		}
+		for _, want := range append(c.txt, "natId=7992739875", "path=/sync", "version="+util.Version) {
+			if !text[want] {
+				t.Errorf("txt %v missing %s", txt.Body.(*dnsmessage.TXTResource).TXT, want)
+			}
+		}
+	}
+}
+
+func TestMDNSAnswer(t *testing.T) {
+	useNATId(t, "7992739875")
+	ma := &mdnsAdvertiser{port: 9892}
+	instance := dnsmessage.MustNewName(ma.instance())
+	all := len(ma.records())
+	for _, c := range []struct {
+		name  string
+		query dnsmessage.Question
+		want  int
+	}{
+		{"browse", dnsmessage.Question{Name: dnsmessage.MustNewName(mdnsBrowse), Type: dnsmessage.TypePTR}, 1},
+		// 服务查询附带实例的全部记录
+		{"service", dnsmessage.Question{Name: dnsmessage.MustNewName(strings.ToUpper(mdnsService)), Type: dnsmessage.TypePTR}, all},
+		{"srv", dnsmessage.Question{Name: instance, Type: dnsmessage.TypeSRV}, 1},
+		{"any", dnsmessage.Question{Name: instance, Type: dnsmessage.TypeALL}, 2},
+		{"aaaa", dnsmessage.Question{Name: instance, Type: dnsmessage.TypeAAAA}, 0},
+		{"other service", dnsmessage.Question{Name: dnsmessage.MustNewName("_http._tcp.local."), Type: dnsmessage.TypePTR}, 0},
+	} {
+		if got := len(ma.answer([]dnsmessage.Question{c.query})); got != c.want {
+			t.Errorf("%s: %d answers, want %d", c.name, got, c.want)
+		}
+	}
+}
+
+func TestMDNSLabel(t *testing.T) {
+	for hostname, want := range map[string]string{
+		"NAS":               "nas",
+		"my-nas.local":      "my-nas",
+		"Skye's NAS":        "skye-s-nas",
+		"nas_01.example.io": "nas-01",
+	} {
+		if got := mdnsLabel(hostname); got != want {
+			t.Errorf("mdnsLabel(%q) = %q, want %q", hostname, got, want)
+		}
+	}
+}
+
+func TestRouterAdvertisedPort(t *testing.T) {
+	var page embed.FS
+	for _, c := range []struct {
+		port      int
+		cert, key string
+		want      int
+		tls       bool
+	}{
+		// 未指定端口时按是否启用 TLS 监听 443 或 80
+		{0, "", "", 80, false},
+		{0, "cert.pem", "key.pem", 443, true},
+		{9892, "", "", 9892, false},
+		{9893, "cert.pem", "key.pem", 9893, true},
+	} {
+		router := BuildRouter(true, c.port, "", c.cert, c.key, page)
+		if router.Port() != c.want || router.TLS() != c.tls {
+			t.Errorf("port %d: advertised %d tls %v, want %d tls %v", c.port, router.Port(), router.TLS(), c.want, c.tls)
+		}
+	}
+}
@@ -2,10 +2,13 @@ package core
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
+	"math/rand"
 	"net/url"
 	"os"
 	"os/signal"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -20,49 +23,162 @@ type Message struct {
 	To    string          `json:"to,omitempty"`
 	From  string          `json:"from,omitempty"`
 	Pass  string          `json:"pass"`
+	// 中控标记的 NSC 来源
+	Source string `json:"source,omitempty"`
 }
 
+const (
+	// 等待 pong 的最长时间
+	pongWait = 60 * time.Second
+	// 发送 ping 的间隔, 需小于 pongWait
+	pingPeriod = 25 * time.Second
+	// 写入超时
+	writeWait = 10 * time.Second
+	// 重连退避上下限
+	minBackoff = time.Second
+	maxBackoff = 2 * time.Minute
+	// 会话清理间隔
+	reapPeriod = 15 * time.Second
+	// 会话建立超时
+	sessionSetupTimeout = 2 * time.Minute
+	// 连接中断后等待恢复的最长时间
+	sessionFailTimeout = time.Minute
+	// 连接失败后 NSB 发起 ICE 重启的等待时间及次数上限
+	restartDelay = 3 * time.Second
+	maxRestarts  = 2
+)
+
 type P2PServer struct {
-	natId             string
-	connect           *websocket.Conn
-	p2p               *webrtc.PeerConnection
-	ticker            *time.Ticker
-	iceCandidateQueue []webrtc.ICECandidateInit
+	natId   string
+	host    string
+	connect *websocket.Conn
+	// NSC 会话, 按中控分配的会话编号区分
+	sessions map[string]*peerSession
+	// 中控下发的 ICE 服务器
+	iceServers []webrtc.ICEServer
+	// 信令连接状态及原因
+	state  string
+	reason string
+	// 最近一次错误
+	lastErr     string
+	lastErrTime int64
+	// 保护信令连接的读写
+	mu      sync.Mutex
+	writeMu sync.Mutex
+	stop    chan struct{}
 }
 
 // 第一步 创建 P2P 服务
 func NewP2PServer(natId string, host string) *P2PServer {
-	path := url.URL{Scheme: "wss", Host: host, Path: "/nat"}
-	log.Printf("[P2P] connect %s", path.String())
-	connect, _, err := websocket.DefaultDialer.Dial(path.String(), nil)
+	server := &P2PServer{
+		natId:    natId,
+		host:     host,
+		sessions: make(map[string]*peerSession),
+		state:    StateConnecting,
+		stop:     make(chan struct{}),
+	}
+	// 第二步 启动连接守护
+	go server.supervise()
+	go server.reap()
+	return server
+}
+
+// 第二步 连接守护, 断开后按指数退避重连
+func (s *P2PServer) supervise() {
+	backoff := minBackoff
+	for {
+		select {
+		case <-s.stop:
+			return
+		default:
+		}
+		s.setState(StateConnecting, "")
+		connect, err := s.dial()
+		if err != nil {
+			err = fmt.Errorf("connect: %w", err)
+			s.setError(err)
+			s.setState(StateError, err.Error())
+		} else {
+			// 第三步 注册 NSB
+			s.register()
+			// 第四步 监听请求, 连接断开后返回
+			if s.handleMessages(connect) {
+				// 注册成功过则从最短间隔重新开始
+				backoff = minBackoff
+			}
+			s.closeSessions()
+			s.setState(StateDisconnected, "signaling connection lost")
+		}
+		// 随机抖动, 避免多台设备同时重连
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		log.Printf("[P2P] reconnect in %v", wait.Round(time.Millisecond))
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(wait):
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// 连接中控信令服务
+func (s *P2PServer) dial() (*websocket.Conn, error) {
+	path := signalURL(s.host)
+	log.Printf("[P2P] connect %s", path)
+	connect, _, err := websocket.DefaultDialer.Dial(path, nil)
 	if err != nil {
-		log.Fatal("dial:", err)
+		return nil, err
 	}
+	connect.SetReadDeadline(time.Now().Add(pongWait))
+	connect.SetPongHandler(func(string) error {
+		return connect.SetReadDeadline(time.Now().Add(pongWait))
+	})
+	s.mu.Lock()
+	s.connect = connect
+	s.mu.Unlock()
+	go s.keepalive(connect)
+	return connect, nil
+}
 
-	server := &P2PServer{
-		natId:   natId,
-		connect: connect,
-		ticker:  time.NewTicker(5 * time.Minute), // 每5分钟检查一次
+// 定时发送 ping 保持连接
+func (s *P2PServer) keepalive(connect *websocket.Conn) {
+	ticker := time.NewTicker(pingPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !s.isCurrent(connect) {
+			return
+		}
+		s.writeMu.Lock()
+		err := connect.WriteControl(websocket.PingMessage, nil, time.Now().Add(writeWait))
+		s.writeMu.Unlock()
+		if err != nil {
+			log.Println("[P2P] ping:", err)
+			connect.Close()
+			return
+		}
 	}
-	// 第二步 监听请求
-	go server.handleMessages()
-	// 第三步 注册 NSB
-	server.register()
-	// 第四步 启动自动重连
-	go server.reconnect(host)
-	return server
 }
 
-// 第二步 监听请求
-func (s *P2PServer) handleMessages() {
+// 第四步 监听请求, 返回本次连接是否注册成功
+func (s *P2PServer) handleMessages(connect *websocket.Conn) (registered bool) {
+	defer func() {
+		connect.Close()
+		s.mu.Lock()
+		if s.connect == connect {
+			s.connect = nil
+		}
+		s.mu.Unlock()
+	}()
 	for {
-		_, msgBytes, err := s.connect.ReadMessage()
+		_, msgBytes, err := connect.ReadMessage()
 		if err != nil {
 			log.Println("[P2P] read:", err)
-			s.connect.Close()
-			s.p2p.Close()
 			return
 		}
+		connect.SetReadDeadline(time.Now().Add(pongWait))
 		var msg Message
 		if err := json.Unmarshal(msgBytes, &msg); err != nil {
 			log.Println("[P2P] unmarshal:", err)
@@ -70,46 +186,34 @@ func (s *P2PServer) handleMessages() {
 		}
 
 		switch msg.Event {
+		case "pake-init":
+			s.session(msg).handlePAKE(msg)
 		case "p2p-exchange":
-			if msg.Pass != util.GetString("connect.password") {
-				log.Println("[P2P] NSC connection password error")
-				s.sendMessage(Message{
-					Event: "p2p-error",
-					Data:  json.RawMessage(`"password error"`),
-					To:    s.natId,
-					From:  "NSB",
-				})
-				continue
-			}
-			signalData := webrtc.SessionDescription{}
-			if err := json.Unmarshal(msg.Data, &signalData); err != nil {
-				log.Printf("[P2P] unable to parse connection information: %v", err)
-				continue
-			}
-			if signalData.Type == webrtc.SDPTypeOffer {
-				s.setP2PInfo(signalData)
-			}
+			s.session(msg).handleOffer(msg)
 		case "p2p-node":
-			if msg.Pass != util.GetString("connect.password") {
-				log.Println("[P2P] NSC connection password error")
-				s.sendMessage(Message{
-					Event: "p2p-error",
-					Data:  json.RawMessage(`"password error"`),
-					To:    s.natId,
-					From:  "NSB",
-				})
-				continue
-			}
-			nodeData := webrtc.ICECandidateInit{}
-			if err := json.Unmarshal(msg.Data, &nodeData); err != nil {
-				log.Printf("[P2P] unable to parse node information: %v", err)
-				continue
-			}
-			s.setP2PNode(nodeData)
+			s.session(msg).handleNode(msg)
+		case "relay-data":
+			s.session(msg).handleRelay(msg)
+		case "leave":
+			s.leave(msg)
+		case "kick":
+			s.kick(msg)
+		case "challenge":
+			s.answerChallenge(msg.Data)
+		case "ice-config":
+			s.setRemoteICE(msg.Data)
 		case "online":
+			s.updateNATId(msg.Data)
+			registered = true
+			s.setError(nil)
+			s.setState(StateRegistered, "")
 			log.Println("[P2P] connection successful")
 		case "error":
-			log.Printf("[P2P] connect failed: %v", string(msg.Data))
+			err := fmt.Errorf("signaling error %s", string(msg.Data))
+			s.setError(err)
+			if !registered {
+				s.setState(StateError, err.Error())
+			}
 		default:
 			log.Printf("[P2P] Unknown message event: %s", msg.Event)
 		}
@@ -126,150 +230,294 @@ func (s *P2PServer) register() {
 	s.sendMessage(message)
 }
 
-// 第四步 启动自动重连
-func (s *P2PServer) reconnect(host string) {
-	for t := range s.ticker.C {
-		if s.connect == nil || s.isClosed() {
-			path := url.URL{Scheme: "ws", Host: host, Path: "/nat"}
-			connect, _, err := websocket.DefaultDialer.Dial(path.String(), nil)
-			if err != nil {
-				log.Println("[P2P] attempt to reconnect failed:", err)
-				continue
-			}
-			s.connect = connect
-			log.Println("[P2P] successfully reconnected")
-			go s.handleMessages() // 重启消息处理
-		}
-		log.Println("[P2P] check connection status:", t)
+// 使用旧版编号注册时, 改用中控返回的当前编号
+func (s *P2PServer) updateNATId(data json.RawMessage) {
+	var natId string
+	if err := json.Unmarshal(data, &natId); err != nil || natId == "" || natId == s.natId {
+		return
 	}
+	log.Printf("[P2P] nat id changed from %s to %s", s.natId, natId)
+	util.Set("connect.natId", natId)
+	s.natId = natId
+	revokeAllKeys()
 }
 
-// [工具] 发送消息
-func (s *P2PServer) sendMessage(message Message) {
-	msgBytes, _ := json.Marshal(message)
-	s.connect.WriteMessage(websocket.TextMessage, msgBytes)
+// 第三步 应答中控的注册挑战
+func (s *P2PServer) answerChallenge(data json.RawMessage) {
+	var nonce string
+	if err := json.Unmarshal(data, &nonce); err != nil {
+		log.Printf("[P2P] unable to parse challenge: %v", err)
+		return
+	}
+	sign, err := util.SignChallenge(util.GetString("connect.deviceKey"), s.natId, nonce)
+	if err != nil {
+		err = fmt.Errorf("register: %w, please register the device again", err)
+		s.setError(err)
+		s.setState(StateError, err.Error())
+		return
+	}
+	s.sendMessage(Message{
+		Event: "register-auth",
+		Data:  data,
+		Pass:  sign,
+	})
 }
 
-// [工具] 检查连接是否已关闭
-func (s *P2PServer) isClosed() bool {
-	_, _, err := s.connect.ReadMessage()
-	return err != nil
+// 关闭服务, 停止重连
+func (s *P2PServer) Close() {
+	select {
+	case <-s.stop:
+		return
+	default:
+		close(s.stop)
+	}
+	s.mu.Lock()
+	if s.connect != nil {
+		s.connect.Close()
+	}
+	s.mu.Unlock()
+	s.closeSessions()
+	s.setState(StateDisconnected, "closed")
 }
 
-// 设置对等连接信息
-func (s *P2PServer) setP2PInfo(data webrtc.SessionDescription) {
-	peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-			{
-				URLs: []string{"stun:stun.nextcloud.com:443"},
-			},
-		},
-	})
-	if err != nil {
-		log.Fatalf("[P2P] Failed to create PeerConnection: %v", err)
+// 获取连接状态
+func (s *P2PServer) State() ConnState {
+	s.mu.Lock()
+	state := ConnState{
+		State:     s.state,
+		Reason:    s.reason,
+		Online:    s.connect != nil,
+		Error:     s.lastErr,
+		ErrorTime: s.lastErrTime,
+		Clients:   []ClientState{},
 	}
-	s.p2p = peerConnection
-	// 设置 NSC 连接信息
-	if err := s.p2p.SetRemoteDescription(data); err != nil {
-		log.Printf("[P2P] Failed to set remote description: %v", err)
+	sessions := make([]*peerSession, 0, len(s.sessions))
+	for _, ps := range s.sessions {
+		sessions = append(sessions, ps)
 	}
-	log.Println("[P2P] NSC connection has been set up")
-	// 处理 ICE 候选队列
-	for _, candidate := range s.iceCandidateQueue {
-		err := s.p2p.AddICECandidate(candidate)
-		if err != nil {
-			log.Printf("[P2P] node addition failed: %v", err)
+	s.mu.Unlock()
+	negotiating := false
+	for _, ps := range sessions {
+		client := ps.status()
+		if client.State == SessionClosed {
+			continue
+		}
+		state.Clients = append(state.Clients, client)
+		if client.State == SessionOpen {
+			state.State = StateOpen
+		} else if client.State == SessionNegotiating || client.State == SessionRestarting {
+			negotiating = true
 		}
 	}
-	// 清空候选队列
-	s.iceCandidateQueue = nil
-	// 创建 NSB 本地连接信息
-	answer, err := s.p2p.CreateAnswer(nil)
-	if err != nil {
-		log.Printf("[P2P] Failed to create answer: %v", err)
+	if state.State == StateRegistered && negotiating {
+		state.State = StateNegotiating
 	}
-	// 设置本地连接信息
-	if err := s.p2p.SetLocalDescription(answer); err != nil {
-		log.Fatalf("[P2P] Failed to set local description: %v", err)
+	return state
+}
+
+// [工具] 更新信令连接状态
+func (s *P2PServer) setState(state, reason string) {
+	s.mu.Lock()
+	s.state = state
+	s.reason = reason
+	s.mu.Unlock()
+	notifyState()
+}
+
+// [工具] 记录中控下发的 ICE 服务器
+func (s *P2PServer) setRemoteICE(data json.RawMessage) {
+	var servers []webrtc.ICEServer
+	if err := json.Unmarshal(data, &servers); err != nil {
+		log.Printf("[P2P] unable to parse ice servers: %v", err)
+		return
 	}
+	s.mu.Lock()
+	s.iceServers = servers
+	s.mu.Unlock()
+}
 
-	// 发送本地连接信息
-	answerDataBytes, err := json.Marshal(map[string]interface{}{
-		"sdp": map[string]interface{}{
-			"type": "answer",
-			"sdp":  s.p2p.LocalDescription().SDP,
-		},
-	})
-	if err != nil {
-		log.Fatalf("[P2P] Failed to marshal answer data: %v", err)
+// [工具] 获取中控下发的 ICE 服务器
+func (s *P2PServer) remoteICE() []webrtc.ICEServer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.iceServers
+}
+
+// [工具] 获取或创建 NSC 会话
+func (s *P2PServer) session(msg Message) *peerSession {
+	id := messageSession(msg)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ps, ok := s.sessions[id]
+	if !ok {
+		ps = &peerSession{
+			server:  s,
+			id:      id,
+			source:  messageSource(msg),
+			state:   SessionNegotiating,
+			created: time.Now().Unix() * 1000,
+			since:   time.Now().Unix() * 1000,
+		}
+		s.sessions[id] = ps
+	}
+	return ps
+}
+
+// [工具] 移除已关闭的 NSC 会话
+func (s *P2PServer) removeSession(ps *peerSession) {
+	s.mu.Lock()
+	if s.sessions[ps.id] == ps {
+		delete(s.sessions, ps.id)
 	}
+	s.mu.Unlock()
+}
+
+// NSC 断开信令连接, 关闭仍需信令的会话, 已打开的 WebRTC 连接不受影响
+func (s *P2PServer) leave(msg Message) {
+	s.mu.Lock()
+	ps, ok := s.sessions[msg.From]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	ps.mu.Lock()
+	open := ps.state == SessionOpen
+	ps.mu.Unlock()
+	if ps.relaying() || !open {
+		log.Printf("[P2P] NSC #%s left, session closed", ps.id)
+		ps.close()
+	}
+}
 
-	answerMsg := Message{
-		Event: "p2p-exchange",
-		Data:  json.RawMessage(answerDataBytes),
-		To:    s.natId,
-		From:  "NSB",
+// NSC 已无权访问设备, 无论连接方式均关闭会话
+func (s *P2PServer) kick(msg Message) {
+	s.mu.Lock()
+	ps, ok := s.sessions[msg.From]
+	s.mu.Unlock()
+	if !ok {
+		return
 	}
-	s.sendMessage(answerMsg)
+	log.Printf("[P2P] NSC #%s access revoked, session closed", ps.id)
+	ps.close()
+}
 
-	// 监控节点更新
-	s.p2p.OnICECandidate(func(candidate *webrtc.ICECandidate) {
-		if candidate == nil {
+// 定时清理长时间未建立或中断后未恢复的会话
+func (s *P2PServer) reap() {
+	ticker := time.NewTicker(reapPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.stop:
 			return
+		case <-ticker.C:
 		}
-		candidateJSON := candidate.ToJSON()
-		jsonBytes, err := json.Marshal(candidateJSON)
-		if err != nil {
-			log.Println("JSON 序列化错误:", err)
-			return
+		s.mu.Lock()
+		sessions := make([]*peerSession, 0, len(s.sessions))
+		for _, ps := range s.sessions {
+			sessions = append(sessions, ps)
 		}
-		mgs := Message{
-			Event: "p2p-node",
-			Data:  json.RawMessage(jsonBytes),
-			To:    s.natId,
-			From:  "NSB",
+		s.mu.Unlock()
+		for _, ps := range sessions {
+			if reason := ps.expired(); reason != "" {
+				log.Printf("[P2P] NSC #%s %s, session closed", ps.id, reason)
+				ps.report("failed", reason)
+				ps.close()
+			}
 		}
-		s.sendMessage(mgs)
-	})
+	}
+}
 
-	// 创建数据通道
-	dataChannel, err := s.p2p.CreateDataChannel("NSChanel", nil)
-	if err != nil {
-		log.Fatalf("[P2P] Failed to create data channel: %v", err)
+// [工具] 关闭全部 NSC 会话
+func (s *P2PServer) closeSessions() {
+	s.mu.Lock()
+	sessions := s.sessions
+	s.sessions = make(map[string]*peerSession)
+	s.mu.Unlock()
+	for _, ps := range sessions {
+		ps.close()
 	}
-	log.Println("[P2P] data channel created")
-
-	s.p2p.OnDataChannel(func(channel *webrtc.DataChannel) {
-		channel.OnOpen(func() {
-			log.Println("[P2P] data channel open")
-		})
-
-		channel.OnClose(func() {
-			log.Println("[P2P] data channel close")
-		})
-
-		channel.OnError(func(err error) {
-			log.Printf("[P2P] data channel error: %s", err.Error())
-		})
-		channel.OnMessage(func(msg webrtc.DataChannelMessage) {
-			VaultOperate(dataChannel, msg.Data)
-		})
-	})
 }
 
-// 设置节点信息
-func (s *P2PServer) setP2PNode(data webrtc.ICECandidateInit) {
-	if s.p2p == nil {
-		// 如果 PeerConnection 还未准备好，先缓存候选
-		s.iceCandidateQueue = append(s.iceCandidateQueue, data)
+// [工具] 记录错误, 传入 nil 清除
+func (s *P2PServer) setError(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err == nil {
+		s.lastErr = ""
+		s.lastErrTime = 0
 		return
 	}
-	err := s.p2p.AddICECandidate(data)
-	if err != nil {
-		log.Fatalf("设置节点信息出错: %v", err)
+	log.Printf("[P2P] %v", err)
+	s.lastErr = err.Error()
+	s.lastErrTime = time.Now().Unix() * 1000
+	notifyState()
+}
+
+// [工具] 检查是否为当前连接
+func (s *P2PServer) isCurrent(connect *websocket.Conn) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.connect == connect
+}
+
+// [工具] 获取信令服务地址
+func signalURL(host string) string {
+	scheme := "wss"
+	if util.GetBool("connect.insecure") {
+		scheme = "ws"
+	}
+	path := url.URL{Scheme: scheme, Host: host, Path: "/nat"}
+	return path.String()
+}
+
+// 断开使用指定访问密钥的会话
+func (s *P2PServer) dropKey(id string) {
+	s.mu.Lock()
+	var dropped []*peerSession
+	for _, ps := range s.sessions {
+		if key, kid, _ := ps.auth(); kid == id && key != nil {
+			dropped = append(dropped, ps)
+		}
+	}
+	s.mu.Unlock()
+	for _, ps := range dropped {
+		ps.close()
+		log.Printf("[P2P] key %s revoked, session #%s closed", id, ps.id)
+	}
+}
+
+// [工具] 获取消息所属的 NSC 会话, 由中控在 From 中分配
+func messageSession(msg Message) string {
+	if msg.From != "" && msg.From != "NSC" {
+		return msg.From
+	}
+	return messageSource(msg)
+}
+
+// [工具] 获取消息来源
+func messageSource(msg Message) string {
+	if msg.Source != "" {
+		return msg.Source
+	}
+	return msg.From
+}
+
+// [工具] 发送消息
+func (s *P2PServer) sendMessage(message Message) {
+	s.mu.Lock()
+	connect := s.connect
+	s.mu.Unlock()
+	if connect == nil {
+		log.Printf("[P2P] signaling offline, drop %s", message.Event)
+		return
+	}
+	msgBytes, _ := json.Marshal(message)
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	connect.SetWriteDeadline(time.Now().Add(writeWait))
+	if err := connect.WriteMessage(websocket.TextMessage, msgBytes); err != nil {
+		log.Printf("[P2P] write: %v", err)
+		connect.Close()
 	}
 }
 
@@ -278,6 +526,5 @@ func (s *P2PServer) Run() {
 	signal.Notify(stop, os.Interrupt)
 	<-stop
 
-	s.connect.Close()
-	s.ticker.Stop()
+	s.Close()
 }
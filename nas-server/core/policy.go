@@ -0,0 +1,98 @@
+package core
+
+import (
+	"errors"
+	"path"
+	"strings"
+)
+
+var (
+	errPathIllegal = errors.New("path illegal")
+	errPermission  = errors.New("permission denied")
+)
+
+// 访问策略, 为空表示完全访问
+type AccessPolicy struct {
+	// 只读访问
+	ReadOnly bool `json:"readOnly"`
+	// 允许访问的路径前缀, 为空表示整个存储库
+	Paths []string `json:"paths"`
+}
+
+// 规范化存储库内的相对路径
+func cleanVaultPath(p string) string {
+	p = path.Clean("/" + strings.ReplaceAll(p, "\\", "/"))
+	return strings.TrimPrefix(p, "/")
+}
+
+// 校验对端提交的相对路径, 拒绝绝对路径与上级目录, 返回规范化后的路径
+func safeVaultPath(p string) (string, error) {
+	p = strings.ReplaceAll(p, "\\", "/")
+	// Obsidian 以 / 表示存储库根目录
+	if p == "/" {
+		return "", nil
+	}
+	if strings.HasPrefix(p, "/") || (len(p) >= 2 && p[1] == ':') {
+		return "", errPathIllegal
+	}
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return "", errPathIllegal
+		}
+	}
+	if p = path.Clean(p); p == "." {
+		p = ""
+	}
+	return p, nil
+}
+
+// 解析以逗号分隔的路径前缀
+func parsePolicyPaths(value string) []string {
+	var paths []string
+	for _, item := range strings.Split(value, ",") {
+		item = cleanVaultPath(strings.TrimSpace(item))
+		if item != "" {
+			paths = append(paths, item)
+		}
+	}
+	return paths
+}
+
+// 检查路径是否位于允许的前缀内
+func (p *AccessPolicy) inScope(target string) bool {
+	if p == nil || len(p.Paths) == 0 {
+		return true
+	}
+	target = cleanVaultPath(target)
+	for _, prefix := range p.Paths {
+		if target == prefix || strings.HasPrefix(target, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// 检查路径是否可见, 允许前缀的上级目录也可见
+func (p *AccessPolicy) canRead(target string, dir bool) bool {
+	if p.inScope(target) {
+		return true
+	}
+	if !dir {
+		return false
+	}
+	target = cleanVaultPath(target)
+	for _, prefix := range p.Paths {
+		if target == "" || strings.HasPrefix(prefix, target+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// 检查路径是否可写
+func (p *AccessPolicy) canWrite(target string) bool {
+	if p != nil && p.ReadOnly {
+		return false
+	}
+	return p.inScope(target)
+}
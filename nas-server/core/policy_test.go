@@ -0,0 +1,163 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSafeVaultPath(t *testing.T) {
+	for _, c := range []struct {
+		path string
+		want string
+		err  bool
+	}{
+		{"/", "", false},
+		{"", "", false},
+		{".", "", false},
+		{"notes/a.md", "notes/a.md", false},
+		{"notes//a.md", "notes/a.md", false},
+		{"notes/./a.md", "notes/a.md", false},
+		{"notes\\a.md", "notes/a.md", false},
+		{"notes/..a.md", "notes/..a.md", false},
+		{"..", "", true},
+		{"../secret", "", true},
+		{"notes/../../secret", "", true},
+		{"notes/../private/a.md", "", true},
+		{"notes\\..\\private", "", true},
+		{"notes/..", "", true},
+		{"/etc/passwd", "", true},
+		{"//server/share", "", true},
+		{"\\\\server\\share", "", true},
+		{"C:\\Windows", "", true},
+		{"c:/windows", "", true},
+	} {
+		got, err := safeVaultPath(c.path)
+		if (err != nil) != c.err {
+			t.Errorf("safeVaultPath(%q) error = %v, want error %v", c.path, err, c.err)
+			continue
+		}
+		if err == nil && got != c.want {
+			t.Errorf("safeVaultPath(%q) = %q, want %q", c.path, got, c.want)
+		}
+	}
+}
+
+func TestPolicyScope(t *testing.T) {
+	scoped := &AccessPolicy{Paths: []string{"notes", "work/2024"}}
+	readOnly := &AccessPolicy{ReadOnly: true}
+	scopedReadOnly := &AccessPolicy{ReadOnly: true, Paths: []string{"notes"}}
+	for _, c := range []struct {
+		name   string
+		policy *AccessPolicy
+		path   string
+		dir    bool
+		read   bool
+		write  bool
+	}{
+		{"full access", nil, "private/a.md", false, true, true},
+		{"scope root", scoped, "notes", true, true, true},
+		{"inside scope", scoped, "notes/a.md", false, true, true},
+		{"nested scope", scoped, "work/2024/q1/a.md", false, true, true},
+		{"prefix collision", scoped, "notes2/x", false, false, false},
+		{"prefix collision dir", scoped, "notes2", true, false, false},
+		{"prefix collision file", scoped, "notes.md", false, false, false},
+		{"outside scope", scoped, "private/a.md", false, false, false},
+		{"parent of scope", scoped, "work", true, true, false},
+		{"parent as file", scoped, "work", false, false, false},
+		{"sibling of scope", scoped, "work/2023/a.md", false, false, false},
+		{"vault root", scoped, "", true, true, false},
+		{"backslash path", scoped, "notes\\a.md", false, true, true},
+		{"cleaned escape", scoped, "notes/../private/a.md", false, false, false},
+		{"read only", readOnly, "notes/a.md", false, true, false},
+		{"read only root", readOnly, "", true, true, false},
+		{"scoped read only", scopedReadOnly, "notes/a.md", false, true, false},
+		{"scoped read only outside", scopedReadOnly, "private/a.md", false, false, false},
+	} {
+		if got := c.policy.canRead(c.path, c.dir); got != c.read {
+			t.Errorf("%s: canRead(%q) = %v, want %v", c.name, c.path, got, c.read)
+		}
+		if got := c.policy.canWrite(c.path); got != c.write {
+			t.Errorf("%s: canWrite(%q) = %v, want %v", c.name, c.path, got, c.write)
+		}
+	}
+}
+
+func TestParsePolicyPaths(t *testing.T) {
+	got := parsePolicyPaths(" notes/ , /work//2024, ,../x,\\docs")
+	want := []string{"notes", "work/2024", "x", "docs"}
+	if len(got) != len(want) {
+		t.Fatalf("parsePolicyPaths = %q, want %q", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("parsePolicyPaths = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestCheckAccess(t *testing.T) {
+	scoped := &AccessPolicy{Paths: []string{"notes"}}
+	for _, c := range []struct {
+		name   string
+		policy *AccessPolicy
+		msg    SyncMessage
+		err    error
+	}{
+		{"create inside", scoped, SyncMessage{Operate: "create", Path: "notes", Name: "a.md"}, nil},
+		{"create outside", scoped, SyncMessage{Operate: "create", Path: "private", Name: "a.md"}, errPermission},
+		{"create collision", scoped, SyncMessage{Operate: "create", Path: "notes2", Name: "a.md"}, errPermission},
+		{"create traversal", scoped, SyncMessage{Operate: "create", Path: "notes/..", Name: "a.md"}, errPathIllegal},
+		{"name traversal", nil, SyncMessage{Operate: "update", Path: "notes", Name: "../../a.md"}, errPathIllegal},
+		{"absolute path", nil, SyncMessage{Operate: "update", Path: "/etc", Name: "passwd"}, errPathIllegal},
+		{"delete outside", scoped, SyncMessage{Operate: "delete", Path: "private/a.md"}, errPermission},
+		{"delete traversal", nil, SyncMessage{Operate: "delete", Path: "../a.md"}, errPathIllegal},
+		{"rename from outside", scoped, SyncMessage{Operate: "rename", Path: "notes", Name: "a.md", Data: "private/a.md"}, errPermission},
+		{"rename traversal", nil, SyncMessage{Operate: "rename", Path: "notes", Name: "a.md", Data: "../a.md"}, errPathIllegal},
+		{"read only update", &AccessPolicy{ReadOnly: true}, SyncMessage{Operate: "update", Path: "notes", Name: "a.md"}, errPermission},
+		{"read only tree", &AccessPolicy{ReadOnly: true}, SyncMessage{Operate: "tree"}, nil},
+	} {
+		msg := c.msg
+		if err := checkAccess(c.policy, &msg); err != c.err {
+			t.Errorf("%s: checkAccess = %v, want %v", c.name, err, c.err)
+		}
+	}
+}
+
+func TestJoinVaultSymlink(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	for _, dir := range []string{"notes", "private"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// 范围内指向范围外与存储库外的链接
+	if err := os.Symlink(filepath.Join(root, "private"), filepath.Join(root, "notes", "link")); err != nil {
+		t.Skip("symlink unsupported:", err)
+	}
+	if err := os.Symlink(outside, filepath.Join(root, "notes", "escape")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(filepath.Join(outside, "a.md"), filepath.Join(root, "notes", "file.md")); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		elem []string
+		err  bool
+	}{
+		{[]string{"notes", "a.md"}, false},
+		{[]string{"notes", "new", "a.md"}, false},
+		{[]string{""}, false},
+		{[]string{"notes/link", "a.md"}, true},
+		{[]string{"notes", "link"}, true},
+		{[]string{"notes/escape", "a.md"}, true},
+		{[]string{"notes", "file.md"}, true},
+		{[]string{"..", "a.md"}, true},
+	} {
+		_, err := joinVault(root, c.elem...)
+		if (err != nil) != c.err {
+			t.Errorf("joinVault(%q) error = %v, want error %v", c.elem, err, c.err)
+		}
+	}
+}
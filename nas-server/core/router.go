@@ -9,6 +9,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"syscall"
 
@@ -64,6 +65,8 @@ func BuildRouter(release bool, port int, host, cert, key string, page embed.FS)
 
 	// 挂载公共路由
 	addPublicRoute(router.Object)
+	// 挂载私有路由
+	addPrivateRoute(router.Object)
 	// 兼容路由
 	router.Object.NoRoute(func(c *gin.Context) {
 		switch {
@@ -104,27 +107,62 @@ func addPublicRoute(router *gin.Engine) {
 		ctx.Request.URL.Path = "/app"
 		router.HandleContext(ctx)
 	})
+	// 局域网直连同步, 自行校验令牌
+	lan := CreateLANServer()
+	router.GET("/sync", lan.Sync)
+	auth := CreateAuthServer()
+	api := router.Group("/api/admin")
+	{
+		api.GET("/state", auth.GetState)
+		api.POST("/init", auth.Init)
+		api.POST("/login", auth.Login)
+	}
+}
+
+// 挂载私有路由
+func addPrivateRoute(router *gin.Engine) {
 	control := CreateController()
 	setting := CreateSettingServer()
-	api := router.Group("/api")
+	guard := CreateGuardServer()
+	key := CreateKeyServer(control)
+	api := router.Group("/api").Use(AuthHandler())
 	{
 		api.GET("/setting", setting.Get)
+		api.GET("/setting/pwd", setting.GetPassword)
 		api.POST("/setting/pwd", setting.SetPassword)
+		api.GET("/guard", guard.Get)
+		api.POST("/guard/unlock", guard.Unlock)
+		api.GET("/keys", key.List)
+		api.POST("/keys", key.Create)
+		api.POST("/keys/:id", key.Update)
+		api.DELETE("/keys/:id", key.Revoke)
 		api.GET("/auto/switch", control.SwitchAutoConnect)
 		api.GET("/register", control.Register)
 		api.GET("/conn/state", control.GetStatus)
+		api.GET("/conn/events", control.StreamStatus)
 		api.GET("/conn/open", control.Connect)
 		api.GET("/conn/close", control.Disconnect)
 	}
 }
 
+// 实际监听的端口
+func (r Router) Port() int {
+	port, _ := strconv.Atoi(r.port)
+	return port
+}
+
+// 是否启用 TLS
+func (r Router) TLS() bool {
+	return r.cert != ""
+}
+
 // 启动路由
 func (r Router) Run() {
 	util.OutLogf(MODEL_NAME, "starting from port "+r.port)
 	// 启动服务
 	go func() {
 		var err error
-		if r.cert == "" {
+		if !r.TLS() {
 			err = r.Object.Run(":" + r.port)
 		} else {
 			err = r.Object.RunTLS(":"+r.port, r.cert, r.key)
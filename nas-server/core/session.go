@@ -0,0 +1,650 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pion/webrtc/v3"
+	"github.com/skye-z/ons/nas-server/util"
+)
+
+// 口令认证消息
+type PAKEMessage struct {
+	Kid     string `json:"kid,omitempty"`
+	X       string `json:"x,omitempty"`
+	Y       string `json:"y,omitempty"`
+	Confirm string `json:"confirm,omitempty"`
+}
+
+// NSC 对等会话
+type peerSession struct {
+	server *P2PServer
+	// NSC 会话编号
+	id string
+	// NSC 来源
+	source            string
+	p2p               *webrtc.PeerConnection
+	iceCandidateQueue []webrtc.ICECandidateInit
+	// 口令认证后的会话密钥
+	pakeKey []byte
+	// 会话使用的访问密钥编号
+	pakeKid string
+	// 会话的访问策略
+	policy *AccessPolicy
+	// WebRTC 无法建立时使用的中继通道
+	relay *relayTransport
+	// NSC 证书指纹, 相同指纹的提议视为 ICE 重启
+	fingerprint string
+	// 数据通道是否打开过
+	opened bool
+	// NSB 已发起的 ICE 重启次数
+	restarts int
+	// 会话状态及进入该状态的时间
+	state    string
+	since    int64
+	created  int64
+	lastSync int64
+	mu       sync.Mutex
+	// 串行化 SDP 协商
+	negotiate sync.Mutex
+}
+
+// 处理 NSC 发起的口令认证
+func (ps *peerSession) handlePAKE(msg Message) {
+	s := ps.server
+	if !guardBegin(ps.source) {
+		guardFail(ps.source, "locked out")
+		ps.sendError("too many attempts")
+		return
+	}
+	var init PAKEMessage
+	if err := json.Unmarshal(msg.Data, &init); err != nil {
+		log.Printf("[P2P] unable to parse pake information: %v", err)
+		return
+	}
+	w, policy := keyAccess(s.natId, init.Kid)
+	if w == nil {
+		guardFail(ps.source, "unknown key")
+		ps.sendError("password error")
+		return
+	}
+	y, key, err := util.PAKERespond(w, "NSC", s.natId, init.X)
+	if err != nil {
+		log.Printf("[P2P] pake failed: %v", err)
+		guardFail(ps.source, "invalid pake message")
+		ps.sendError("password error")
+		return
+	}
+	ps.mu.Lock()
+	ps.pakeKey = key
+	ps.pakeKid = init.Kid
+	ps.policy = policy
+	ps.mu.Unlock()
+	data, _ := json.Marshal(PAKEMessage{
+		Y:       y,
+		Confirm: util.PAKEMac(key, "confirm", s.natId),
+	})
+	s.sendMessage(Message{
+		Event: "pake-reply",
+		Data:  json.RawMessage(data),
+		To:    ps.id,
+		From:  "NSB",
+	})
+}
+
+// 处理 NSC 连接信息
+func (ps *peerSession) handleOffer(msg Message) {
+	signalData := webrtc.SessionDescription{}
+	if err := json.Unmarshal(msg.Data, &signalData); err != nil {
+		log.Printf("[P2P] unable to parse connection information: %v", err)
+		return
+	}
+	// 校验会话密钥与 NSC 证书指纹的绑定
+	fingerprint := util.SDPFingerprint(signalData.SDP)
+	key, kid, _ := ps.auth()
+	if key == nil || !util.PAKEVerify(key, "offer", fingerprint, msg.Pass) {
+		ps.mu.Lock()
+		ps.pakeKey = nil
+		ps.mu.Unlock()
+		guardFail(ps.source, "password error")
+		ps.sendError("password error")
+		return
+	}
+	guardSuccess(ps.source)
+	touchKey(kid)
+	ps.negotiate.Lock()
+	defer ps.negotiate.Unlock()
+	switch {
+	case signalData.Type == webrtc.SDPTypeAnswer:
+		// NSB 发起 ICE 重启后 NSC 的应答
+		if err := ps.acceptAnswer(signalData); err != nil {
+			ps.fail("NSC restart answer rejected", err)
+		}
+	case signalData.Type != webrtc.SDPTypeOffer:
+		return
+	case ps.restartable(fingerprint):
+		// 同一 NSC 发起的 ICE 重启, 沿用现有连接
+		if err := ps.acceptRestart(signalData); err != nil {
+			ps.fail("NSC ICE restart failed", err)
+		}
+	default:
+		if err := ps.setP2PInfo(signalData); err != nil {
+			ps.fail("NSC connection setup failed", err)
+		}
+	}
+}
+
+// 处理 NSC 节点信息
+func (ps *peerSession) handleNode(msg Message) {
+	nodeData := webrtc.ICECandidateInit{}
+	if err := json.Unmarshal(msg.Data, &nodeData); err != nil {
+		log.Printf("[P2P] unable to parse node information: %v", err)
+		return
+	}
+	key, _, _ := ps.auth()
+	if key == nil || !util.PAKEVerify(key, "node", nodeData.Candidate, msg.Pass) {
+		ps.sendError("password error")
+		return
+	}
+	if err := ps.setP2PNode(nodeData); err != nil {
+		ps.fail("NSC node rejected", err)
+	}
+}
+
+// 处理 NSC 经中控转发的加密同步消息
+func (ps *peerSession) handleRelay(msg Message) {
+	key, kid, policy := ps.auth()
+	if key == nil {
+		ps.sendError("password error")
+		return
+	}
+	ps.mu.Lock()
+	relay := ps.relay
+	ps.mu.Unlock()
+	fresh := relay == nil
+	if fresh {
+		relay = newRelayTransport(ps, key)
+	}
+	data, err := relay.open(msg.Data)
+	if err != nil {
+		log.Printf("[P2P] NSC #%s relay frame rejected: %v", ps.id, err)
+		if fresh {
+			guardFail(ps.source, "relay frame rejected")
+			ps.sendError("password error")
+		}
+		return
+	}
+	if fresh {
+		// 首个中继帧可解密即证明 NSC 持有会话密钥
+		guardSuccess(ps.source)
+		touchKey(kid)
+		ps.mu.Lock()
+		ps.relay = relay
+		ps.mu.Unlock()
+		log.Printf("[P2P] NSC #%s falls back to relay", ps.id)
+		ps.setState(SessionOpen)
+		ps.report("relay", "")
+	}
+	ps.mu.Lock()
+	ps.lastSync = time.Now().Unix() * 1000
+	ps.mu.Unlock()
+	if !relay.queue.push(relay, policy, data) {
+		ps.sendError("relay queue full")
+		ps.close()
+	}
+}
+
+// 设置对等连接信息
+func (ps *peerSession) setP2PInfo(data webrtc.SessionDescription) error {
+	s := ps.server
+	peerConnection, err := webrtc.NewPeerConnection(webrtc.Configuration{
+		ICEServers: util.MergeICEServers(util.ICEServers(), s.remoteICE()),
+	})
+	if err != nil {
+		return fmt.Errorf("create peer connection: %w", err)
+	}
+	// 替换旧连接
+	ps.mu.Lock()
+	old := ps.p2p
+	ps.p2p = peerConnection
+	ps.fingerprint = util.SDPFingerprint(data.SDP)
+	ps.opened = false
+	ps.restarts = 0
+	ps.mu.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	// 失败时释放连接
+	ok := false
+	defer func() {
+		if !ok {
+			peerConnection.Close()
+			ps.mu.Lock()
+			if ps.p2p == peerConnection {
+				ps.p2p = nil
+			}
+			ps.mu.Unlock()
+		}
+	}()
+	ps.setState(SessionNegotiating)
+	peerConnection.OnConnectionStateChange(func(state webrtc.PeerConnectionState) {
+		log.Printf("[P2P] NSC #%s connection %s", ps.id, state)
+		// 忽略已被替换的旧连接
+		if !ps.isCurrent(peerConnection) {
+			return
+		}
+		switch state {
+		case webrtc.PeerConnectionStateConnected:
+			local, remote := candidateTypes(peerConnection)
+			ps.report("connected", local+"/"+remote)
+		case webrtc.PeerConnectionStateFailed:
+			// 连接失败时保留会话, 尝试 ICE 重启, NSC 也可改用中继通道
+			ps.interrupted(peerConnection, true)
+		case webrtc.PeerConnectionStateClosed:
+			if !ps.relaying() {
+				ps.setState(SessionClosed)
+			}
+		}
+	})
+	peerConnection.OnICEConnectionStateChange(func(state webrtc.ICEConnectionState) {
+		log.Printf("[P2P] NSC #%s ice %s", ps.id, state)
+		if !ps.isCurrent(peerConnection) {
+			return
+		}
+		switch state {
+		case webrtc.ICEConnectionStateConnected, webrtc.ICEConnectionStateCompleted:
+			ps.recovered()
+		case webrtc.ICEConnectionStateDisconnected:
+			// 网络切换时先等待自行恢复或 NSC 发起重启
+			ps.interrupted(peerConnection, false)
+		}
+	})
+	// 设置 NSC 连接信息
+	if err := peerConnection.SetRemoteDescription(data); err != nil {
+		return fmt.Errorf("set remote description: %w", err)
+	}
+	log.Println("[P2P] NSC connection has been set up")
+	// 取出并清空 ICE 候选队列
+	ps.mu.Lock()
+	queue := ps.iceCandidateQueue
+	ps.iceCandidateQueue = nil
+	ps.mu.Unlock()
+	for _, candidate := range queue {
+		err := peerConnection.AddICECandidate(candidate)
+		if err != nil {
+			log.Printf("[P2P] node addition failed: %v", err)
+		}
+	}
+	// 创建并发送 NSB 本地连接信息
+	if err := ps.answer(peerConnection); err != nil {
+		return err
+	}
+
+	// 监控节点更新
+	pakeKey, _, policy := ps.auth()
+	peerConnection.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		if candidate == nil {
+			return
+		}
+		candidateJSON := candidate.ToJSON()
+		jsonBytes, err := json.Marshal(candidateJSON)
+		if err != nil {
+			log.Println("JSON 序列化错误:", err)
+			return
+		}
+		mgs := Message{
+			Event: "p2p-node",
+			Data:  json.RawMessage(jsonBytes),
+			To:    ps.id,
+			From:  "NSB",
+			Pass:  util.PAKEMac(pakeKey, "node", candidateJSON.Candidate),
+		}
+		s.sendMessage(mgs)
+	})
+
+	// 创建数据通道
+	dataChannel, err := peerConnection.CreateDataChannel("NSChanel", nil)
+	if err != nil {
+		return fmt.Errorf("create data channel: %w", err)
+	}
+	log.Println("[P2P] data channel created")
+	ok = true
+
+	peerConnection.OnDataChannel(func(channel *webrtc.DataChannel) {
+		channel.OnOpen(func() {
+			log.Println("[P2P] data channel open")
+			ps.mu.Lock()
+			ps.opened = true
+			ps.mu.Unlock()
+			ps.setState(SessionOpen)
+		})
+
+		channel.OnClose(func() {
+			log.Println("[P2P] data channel close")
+			if ps.isCurrent(peerConnection) && !ps.relaying() {
+				ps.setState(SessionClosed)
+			}
+		})
+
+		channel.OnError(func(err error) {
+			log.Printf("[P2P] data channel error: %s", err.Error())
+		})
+		channel.OnMessage(func(msg webrtc.DataChannelMessage) {
+			ps.mu.Lock()
+			ps.lastSync = time.Now().Unix() * 1000
+			ps.mu.Unlock()
+			VaultOperate(dataChannel, policy, msg.Data)
+		})
+	})
+	return nil
+}
+
+// 接受同一 NSC 发起的 ICE 重启
+func (ps *peerSession) acceptRestart(offer webrtc.SessionDescription) error {
+	ps.mu.Lock()
+	pc := ps.p2p
+	ps.mu.Unlock()
+	if pc == nil {
+		return fmt.Errorf("peer connection closed")
+	}
+	// 双方同时发起重启时放弃本端提议, 以 NSC 为准
+	if pc.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		if err := pc.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}); err != nil {
+			return fmt.Errorf("rollback local offer: %w", err)
+		}
+	}
+	if err := pc.SetRemoteDescription(offer); err != nil {
+		return fmt.Errorf("set remote description: %w", err)
+	}
+	log.Printf("[P2P] NSC #%s requested ice restart", ps.id)
+	return ps.answer(pc)
+}
+
+// 接受 NSC 对 NSB 重启提议的应答
+func (ps *peerSession) acceptAnswer(answer webrtc.SessionDescription) error {
+	ps.mu.Lock()
+	pc := ps.p2p
+	ps.mu.Unlock()
+	if pc == nil || pc.SignalingState() != webrtc.SignalingStateHaveLocalOffer {
+		log.Printf("[P2P] NSC #%s unexpected answer ignored", ps.id)
+		return nil
+	}
+	if err := pc.SetRemoteDescription(answer); err != nil {
+		return fmt.Errorf("set remote description: %w", err)
+	}
+	return nil
+}
+
+// 由 NSB 发起 ICE 重启, NSC 未先行重启时使用
+func (ps *peerSession) restartICE(pc *webrtc.PeerConnection) {
+	ps.negotiate.Lock()
+	defer ps.negotiate.Unlock()
+	ps.mu.Lock()
+	valid := ps.p2p == pc && ps.relay == nil && ps.pakeKey != nil && ps.state == SessionRestarting
+	if valid {
+		ps.restarts++
+	}
+	restarts := ps.restarts
+	ps.mu.Unlock()
+	// NSC 已发起重启或连接已恢复
+	if !valid || pc.SignalingState() != webrtc.SignalingStateStable || restarts > maxRestarts {
+		return
+	}
+	offer, err := pc.CreateOffer(&webrtc.OfferOptions{ICERestart: true})
+	if err != nil {
+		log.Printf("[P2P] NSC #%s create restart offer: %v", ps.id, err)
+		return
+	}
+	if err := pc.SetLocalDescription(offer); err != nil {
+		log.Printf("[P2P] NSC #%s set restart offer: %v", ps.id, err)
+		return
+	}
+	log.Printf("[P2P] NSC #%s ice restart (%d/%d)", ps.id, restarts, maxRestarts)
+	if err := ps.sendDescription(pc.LocalDescription(), "restart"); err != nil {
+		log.Printf("[P2P] NSC #%s send restart offer: %v", ps.id, err)
+	}
+}
+
+// [工具] 创建并发送应答
+func (ps *peerSession) answer(pc *webrtc.PeerConnection) error {
+	answer, err := pc.CreateAnswer(nil)
+	if err != nil {
+		return fmt.Errorf("create answer: %w", err)
+	}
+	if err := pc.SetLocalDescription(answer); err != nil {
+		return fmt.Errorf("set local description: %w", err)
+	}
+	return ps.sendDescription(pc.LocalDescription(), "answer")
+}
+
+// [工具] 发送本地连接信息, 以会话密钥绑定 NSB 证书指纹
+func (ps *peerSession) sendDescription(desc *webrtc.SessionDescription, label string) error {
+	s := ps.server
+	data, err := json.Marshal(map[string]interface{}{
+		"sdp": map[string]interface{}{
+			"type": desc.Type.String(),
+			"sdp":  desc.SDP,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", desc.Type, err)
+	}
+	key, _, _ := ps.auth()
+	if key == nil {
+		return fmt.Errorf("session closed")
+	}
+	s.sendMessage(Message{
+		Event: "p2p-exchange",
+		Data:  json.RawMessage(data),
+		To:    ps.id,
+		From:  "NSB",
+		Pass:  util.PAKEMac(key, label, util.SDPFingerprint(desc.SDP)),
+	})
+	return nil
+}
+
+// [工具] 连接中断, 失败时稍后由 NSB 发起重启
+func (ps *peerSession) interrupted(pc *webrtc.PeerConnection, failed bool) {
+	if ps.relaying() {
+		return
+	}
+	ps.setState(SessionRestarting)
+	if failed {
+		// NSC 是原提议方, 先留时间由其发起重启, 避免双方同时提议
+		time.AfterFunc(restartDelay, func() {
+			ps.restartICE(pc)
+		})
+	}
+}
+
+// [工具] 连接恢复
+func (ps *peerSession) recovered() {
+	ps.mu.Lock()
+	ps.restarts = 0
+	state := SessionNegotiating
+	if ps.opened {
+		state = SessionOpen
+	}
+	ps.mu.Unlock()
+	ps.setState(state)
+}
+
+// [工具] 是否可在现有连接上重启 ICE
+func (ps *peerSession) restartable(fingerprint string) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.p2p != nil && ps.p2p.ConnectionState() != webrtc.PeerConnectionStateClosed && ps.fingerprint == fingerprint
+}
+
+// [工具] 检查会话是否超时, 返回原因
+func (ps *peerSession) expired() string {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if ps.relay != nil {
+		return ""
+	}
+	elapsed := time.Duration(time.Now().Unix()*1000-ps.since) * time.Millisecond
+	switch {
+	case ps.state == SessionRestarting && elapsed > sessionFailTimeout:
+		return "failed to recover"
+	case ps.state == SessionNegotiating && elapsed > sessionSetupTimeout:
+		return "setup timed out"
+	}
+	return ""
+}
+
+// 设置节点信息
+func (ps *peerSession) setP2PNode(data webrtc.ICECandidateInit) error {
+	ps.mu.Lock()
+	pc := ps.p2p
+	if pc == nil || pc.RemoteDescription() == nil {
+		// 如果 PeerConnection 还未准备好，先缓存候选
+		ps.iceCandidateQueue = append(ps.iceCandidateQueue, data)
+		ps.mu.Unlock()
+		return nil
+	}
+	ps.mu.Unlock()
+	if err := pc.AddICECandidate(data); err != nil {
+		return fmt.Errorf("add ice candidate: %w", err)
+	}
+	return nil
+}
+
+// 关闭会话
+func (ps *peerSession) close() {
+	ps.mu.Lock()
+	ps.pakeKey = nil
+	relay := ps.relay
+	ps.relay = nil
+	ps.iceCandidateQueue = nil
+	pc := ps.p2p
+	ps.mu.Unlock()
+	if relay != nil {
+		relay.queue.close()
+	}
+	if pc != nil {
+		pc.Close()
+	}
+	ps.setState(SessionClosed)
+}
+
+// [工具] 获取会话密钥、访问密钥编号与访问策略
+func (ps *peerSession) auth() ([]byte, string, *AccessPolicy) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.pakeKey, ps.pakeKid, ps.policy
+}
+
+// [工具] 检查是否为当前对等连接
+func (ps *peerSession) isCurrent(pc *webrtc.PeerConnection) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.p2p == pc
+}
+
+// [工具] 是否已改用中继通道
+func (ps *peerSession) relaying() bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	return ps.relay != nil
+}
+
+// [工具] 更新会话状态
+func (ps *peerSession) setState(state string) {
+	ps.mu.Lock()
+	changed := ps.state != state
+	ps.state = state
+	if changed {
+		ps.since = time.Now().Unix() * 1000
+	}
+	ps.mu.Unlock()
+	if state == SessionClosed {
+		ps.server.removeSession(ps)
+	}
+	if changed {
+		notifyState()
+	}
+}
+
+// [工具] 获取会话状态快照
+func (ps *peerSession) status() ClientState {
+	ps.mu.Lock()
+	client := ClientState{
+		Id:       ps.id,
+		Source:   ps.source,
+		Key:      ps.pakeKid,
+		State:    ps.state,
+		Created:  ps.created,
+		LastSync: ps.lastSync,
+	}
+	p2p := ps.p2p
+	relay := ps.relay
+	ps.mu.Unlock()
+	if relay != nil {
+		client.Transport = "relay"
+		relay.mu.Lock()
+		client.BytesSent = relay.bytesSent
+		client.BytesReceived = relay.bytesReceived
+		relay.mu.Unlock()
+		return client
+	}
+	if p2p == nil {
+		return client
+	}
+	client.Transport = "webrtc"
+	client.LocalType, client.RemoteType = candidateTypes(p2p)
+	// 传输字节数
+	for _, stat := range p2p.GetStats() {
+		if transport, ok := stat.(webrtc.TransportStats); ok {
+			client.BytesSent += transport.BytesSent
+			client.BytesReceived += transport.BytesReceived
+		}
+	}
+	return client
+}
+
+// [工具] 获取已选中的候选对类型
+func candidateTypes(pc *webrtc.PeerConnection) (string, string) {
+	if sctp := pc.SCTP(); sctp != nil && sctp.Transport() != nil {
+		pair, err := sctp.Transport().ICETransport().GetSelectedCandidatePair()
+		if err == nil && pair != nil {
+			return pair.Local.Typ.String(), pair.Remote.Typ.String()
+		}
+	}
+	return "", ""
+}
+
+// [工具] 向中控报告连接结果, 记录到设备事件中, 不转发给 NSC
+func (ps *peerSession) report(state, detail string) {
+	data, _ := json.Marshal(map[string]string{
+		"state":  state,
+		"detail": detail,
+	})
+	ps.server.sendMessage(Message{
+		Event: "p2p-report",
+		Data:  json.RawMessage(data),
+		To:    ps.id,
+		From:  "NSB",
+	})
+}
+
+// [工具] 记录对等连接错误并通知 NSC
+func (ps *peerSession) fail(reason string, err error) {
+	ps.server.setError(err)
+	ps.sendError(reason)
+}
+
+// [工具] 向 NSC 发送错误
+func (ps *peerSession) sendError(reason string) {
+	log.Printf("[P2P] NSC #%s connection %s", ps.id, reason)
+	data, _ := json.Marshal(reason)
+	ps.server.sendMessage(Message{
+		Event: "p2p-error",
+		Data:  json.RawMessage(data),
+		To:    ps.id,
+		From:  "NSB",
+	})
+}
@@ -12,7 +12,12 @@ type Setting struct {
 	Auto     bool   `json:"auto"`
 	Server   string `json:"server"`
 	NatId    string `json:"natId"`
-	Password string `json:"password"`
+	// 是否已设置连接密码, 密码本身需单独获取
+	HasPassword bool `json:"hasPassword"`
+	// 是否已绑定设备密钥, 旧版本注册的设备需重新绑定
+	HasDeviceKey bool `json:"hasDeviceKey"`
+	// 是否为旧版 6 位编号, 可升级为更长的编号
+	LegacyId bool `json:"legacyId"`
 }
 
 type SettingServer struct {
@@ -28,16 +33,35 @@ func (ss SettingServer) Get(ctx *gin.Context) {
 		hostname = "匿名主机"
 	}
 	setting := &Setting{
-		Hostname: hostname,
-		Auto:     util.GetBool("connect.auto"),
-		Server:   util.GetString("connect.server"),
-		NatId:    util.GetString("connect.natId"),
-		Password: util.GetString("connect.password"),
+		Hostname:     hostname,
+		Auto:         util.GetBool("connect.auto"),
+		Server:       util.GetString("connect.server"),
+		NatId:        util.GetString("connect.natId"),
+		HasPassword:  util.GetString("connect.password") != "",
+		HasDeviceKey: util.GetString("connect.deviceKey") != "",
+		LegacyId:     legacyNATId(util.GetString("connect.natId")),
 	}
 	util.ReturnData(ctx, true, setting)
 }
 
+func (ss SettingServer) GetPassword(ctx *gin.Context) {
+	util.ReturnData(ctx, true, util.GetString("connect.password"))
+}
+
 func (ss SettingServer) SetPassword(ctx *gin.Context) {
 	util.Set("connect.password", util.GenerateRandomString(8))
 	util.ReturnMessage(ctx, true, "密码已更新")
 }
+
+// [工具] 是否为旧版 6 位数字编号
+func legacyNATId(id string) bool {
+	if len(id) != 6 {
+		return false
+	}
+	for _, c := range id {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,82 @@
+package core
+
+import "sync"
+
+// 连接状态
+const (
+	StateDisconnected = "disconnected"
+	StateConnecting   = "connecting"
+	StateRegistered   = "registered"
+	StateNegotiating  = "negotiating"
+	StateOpen         = "open"
+	StateError        = "error"
+)
+
+// NSC 会话状态
+const (
+	SessionNegotiating = "negotiating"
+	SessionOpen        = "open"
+	SessionRestarting  = "restarting"
+	SessionClosed      = "closed"
+)
+
+// NSC 会话状态快照
+type ClientState struct {
+	Id     string `json:"id"`
+	Source string `json:"source"`
+	// 使用的访问密钥, 空为共享连接密码
+	Key   string `json:"key"`
+	State string `json:"state"`
+	// 传输方式 webrtc/relay
+	Transport string `json:"transport"`
+	// 选中的候选对类型 host/srflx/prflx/relay
+	LocalType     string `json:"localType"`
+	RemoteType    string `json:"remoteType"`
+	BytesSent     uint64 `json:"bytesSent"`
+	BytesReceived uint64 `json:"bytesReceived"`
+	Created       int64  `json:"created"`
+	LastSync      int64  `json:"lastSync"`
+}
+
+// 连接状态
+type ConnState struct {
+	State     string        `json:"state"`
+	Reason    string        `json:"reason"`
+	Online    bool          `json:"online"`
+	Error     string        `json:"error"`
+	ErrorTime int64         `json:"errorTime"`
+	Clients   []ClientState `json:"clients"`
+}
+
+var (
+	stateListeners = make(map[chan struct{}]bool) // 状态变化订阅者
+	stateMutex     sync.Mutex                     // 保护订阅者的互斥锁
+)
+
+// 订阅状态变化
+func subscribeState() chan struct{} {
+	ch := make(chan struct{}, 1)
+	stateMutex.Lock()
+	stateListeners[ch] = true
+	stateMutex.Unlock()
+	return ch
+}
+
+// 取消订阅状态变化
+func unsubscribeState(ch chan struct{}) {
+	stateMutex.Lock()
+	delete(stateListeners, ch)
+	stateMutex.Unlock()
+}
+
+// 通知状态变化, 订阅者未处理时合并通知
+func notifyState() {
+	stateMutex.Lock()
+	defer stateMutex.Unlock()
+	for ch := range stateListeners {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/skye-z/ons/nas-server/util"
+)
+
+// 同步消息传输通道
+type Transport interface {
+	SendText(text string) error
+}
+
+// 按方向加密的同步帧, 中继通道与局域网直连共用, 调用方负责加锁
+type frameCipher struct {
+	// 发送与接收使用不同方向的密钥
+	sendKey []byte
+	recvKey []byte
+	sendSeq uint64
+	recvSeq uint64
+}
+
+func newFrameCipher(key []byte) frameCipher {
+	return frameCipher{
+		sendKey: util.RelayKey(key, "NSB"),
+		recvKey: util.RelayKey(key, "NSC"),
+	}
+}
+
+// 加密发往 NSC 的帧
+func (fc *frameCipher) seal(text string) (string, error) {
+	fc.sendSeq++
+	return util.RelaySeal(fc.sendKey, fc.sendSeq, []byte(text))
+}
+
+// 解密 NSC 发来的帧, 拒绝重放
+func (fc *frameCipher) open(frame string) ([]byte, error) {
+	seq, text, err := util.RelayOpen(fc.recvKey, frame)
+	if err != nil {
+		return nil, err
+	}
+	if seq <= fc.recvSeq {
+		return nil, errors.New("relay frame replayed")
+	}
+	fc.recvSeq = seq
+	return text, nil
+}
+
+// 待执行的同步操作数上限
+const vaultQueueSize = 1024
+
+// 同步操作队列, 在独立协程中按到达顺序执行, 避免阻塞读取循环
+type vaultQueue struct {
+	pending []vaultJob
+	running bool
+	closed  bool
+	mu      sync.Mutex
+}
+
+type vaultJob struct {
+	policy *AccessPolicy
+	data   []byte
+}
+
+// 加入同步操作, 队列已满时返回 false
+func (vq *vaultQueue) push(channel Transport, policy *AccessPolicy, data []byte) bool {
+	vq.mu.Lock()
+	defer vq.mu.Unlock()
+	if vq.closed {
+		return true
+	}
+	if len(vq.pending) >= vaultQueueSize {
+		return false
+	}
+	vq.pending = append(vq.pending, vaultJob{policy: policy, data: data})
+	if !vq.running {
+		vq.running = true
+		go vq.run(channel)
+	}
+	return true
+}
+
+func (vq *vaultQueue) run(channel Transport) {
+	for {
+		vq.mu.Lock()
+		if vq.closed || len(vq.pending) == 0 {
+			vq.running = false
+			vq.mu.Unlock()
+			return
+		}
+		job := vq.pending[0]
+		vq.pending = vq.pending[1:]
+		vq.mu.Unlock()
+		VaultOperate(channel, job.policy, job.data)
+	}
+}
+
+// 停止执行, 丢弃尚未执行的操作
+func (vq *vaultQueue) close() {
+	vq.mu.Lock()
+	defer vq.mu.Unlock()
+	vq.closed = true
+	vq.pending = nil
+}
+
+// 经中控转发的加密中继通道, 用于 WebRTC 无法建立时
+type relayTransport struct {
+	session *peerSession
+	cipher  frameCipher
+	queue   vaultQueue
+	// 传输字节数
+	bytesSent     uint64
+	bytesReceived uint64
+	mu            sync.Mutex
+	writeMu       sync.Mutex
+}
+
+func newRelayTransport(ps *peerSession, key []byte) *relayTransport {
+	return &relayTransport{
+		session: ps,
+		cipher:  newFrameCipher(key),
+	}
+}
+
+func (rt *relayTransport) SendText(text string) error {
+	// 加密与发送需保持相同顺序, 否则对端按序号拒绝
+	rt.writeMu.Lock()
+	defer rt.writeMu.Unlock()
+	rt.mu.Lock()
+	frame, err := rt.cipher.seal(text)
+	rt.bytesSent += uint64(len(text))
+	rt.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	data, _ := json.Marshal(frame)
+	s := rt.session.server
+	s.sendMessage(Message{
+		Event: "relay-data",
+		Data:  json.RawMessage(data),
+		To:    rt.session.id,
+		From:  "NSB",
+	})
+	return nil
+}
+
+// 解密 NSC 发来的中继帧
+func (rt *relayTransport) open(data json.RawMessage) ([]byte, error) {
+	var frame string
+	if err := json.Unmarshal(data, &frame); err != nil {
+		return nil, err
+	}
+	rt.mu.Lock()
+	defer rt.mu.Unlock()
+	text, err := rt.cipher.open(frame)
+	if err != nil {
+		return nil, err
+	}
+	rt.bytesReceived += uint64(len(text))
+	return text, nil
+}
@@ -0,0 +1,195 @@
+package core
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/skye-z/ons/nas-server/util"
+)
+
+// [工具] 创建 NSC 一侧的帧加密, 与 NSB 方向相反
+func peerFrameCipher(key []byte) frameCipher {
+	return frameCipher{
+		sendKey: util.RelayKey(key, "NSC"),
+		recvKey: util.RelayKey(key, "NSB"),
+	}
+}
+
+func TestFrameCipher(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	nsb, nsc := newFrameCipher(key), peerFrameCipher(key)
+
+	frame, err := nsb.seal("hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text, err := nsc.open(frame); err != nil || string(text) != "hello" {
+		t.Fatalf("open = %q, %v", text, err)
+	}
+	if _, err := nsc.open(frame); err == nil {
+		t.Fatal("replayed frame accepted")
+	}
+	// 同一方向不能解密自己发出的帧
+	if _, err := nsb.open(frame); err == nil {
+		t.Fatal("reflected frame accepted")
+	}
+	// 序号只能递增, 乱序到达的旧帧被拒绝
+	first, _ := nsc.seal("first")
+	second, _ := nsc.seal("second")
+	if text, err := nsb.open(second); err != nil || string(text) != "second" {
+		t.Fatalf("open second = %q, %v", text, err)
+	}
+	if _, err := nsb.open(first); err == nil {
+		t.Fatal("stale frame accepted")
+	}
+	// 不同会话密钥无法解密
+	other := peerFrameCipher([]byte("fedcba9876543210fedcba9876543210"))
+	third, _ := nsb.seal("third")
+	if _, err := other.open(third); err == nil {
+		t.Fatal("frame opened with another session key")
+	}
+}
+
+func TestRelaySendOrder(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	const senders, frames = 16, 200
+	received := make(chan Message, senders*frames)
+	upgrader := websocket.Upgrader{}
+	hub := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			var msg Message
+			if err := conn.ReadJSON(&msg); err != nil {
+				return
+			}
+			received <- msg
+		}
+	}))
+	defer hub.Close()
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(hub.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s := &P2PServer{connect: conn, sessions: make(map[string]*peerSession)}
+	rt := newRelayTransport(&peerSession{server: s, id: "c1"}, key)
+	var wg sync.WaitGroup
+	for i := 0; i < senders; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < frames; j++ {
+				rt.SendText(fmt.Sprintf("%d-%d", i, j))
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// 并发发送的帧须按序号到达, 否则对端拒绝
+	nsc := peerFrameCipher(key)
+	for i := 0; i < senders*frames; i++ {
+		select {
+		case msg := <-received:
+			if msg.Event != "relay-data" || msg.To != "c1" {
+				t.Fatalf("unexpected message %+v", msg)
+			}
+			var frame string
+			json.Unmarshal(msg.Data, &frame)
+			if _, err := nsc.open(frame); err != nil {
+				t.Fatalf("frame %d rejected: %v", i, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d of %d frames", i, senders*frames)
+		}
+	}
+}
+
+// 记录发送内容的传输通道, gate 不为空时发送前等待放行
+type recordTransport struct {
+	gate chan struct{}
+	sent chan string
+}
+
+func (rt *recordTransport) SendText(text string) error {
+	if rt.gate != nil {
+		<-rt.gate
+	}
+	rt.sent <- text
+	return nil
+}
+
+// [工具] 生成会被只读策略拒绝的删除操作, 拒绝消息中带回路径
+func deniedDelete(i int) []byte {
+	data, _ := json.Marshal(SyncMessage{Operate: "delete", Path: fmt.Sprintf("note-%d.md", i)})
+	return data
+}
+
+func TestVaultQueueOrder(t *testing.T) {
+	channel := &recordTransport{sent: make(chan string, 100)}
+	policy := &AccessPolicy{ReadOnly: true}
+	var queue vaultQueue
+	for i := 0; i < 100; i++ {
+		if !queue.push(channel, policy, deniedDelete(i)) {
+			t.Fatal("queue rejected operation")
+		}
+	}
+	for i := 0; i < 100; i++ {
+		select {
+		case text := <-channel.sent:
+			var msg SyncMessage
+			json.Unmarshal([]byte(text), &msg)
+			if msg.Operate != "error" || msg.Path != fmt.Sprintf("note-%d.md", i) {
+				t.Fatalf("operation %d out of order: %s", i, text)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("operation %d not executed", i)
+		}
+	}
+}
+
+func TestVaultQueueFull(t *testing.T) {
+	channel := &recordTransport{gate: make(chan struct{}), sent: make(chan string, vaultQueueSize+2)}
+	policy := &AccessPolicy{ReadOnly: true}
+	var queue vaultQueue
+	// 首个操作阻塞在发送上, 读取循环不受影响
+	queue.push(channel, policy, deniedDelete(0))
+	deadline := time.Now().Add(time.Second)
+	for {
+		queue.mu.Lock()
+		started := len(queue.pending) == 0
+		queue.mu.Unlock()
+		if started {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatal("worker not started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for i := 1; i <= vaultQueueSize; i++ {
+		if !queue.push(channel, policy, deniedDelete(i)) {
+			t.Fatalf("operation %d rejected before queue full", i)
+		}
+	}
+	if queue.push(channel, policy, deniedDelete(vaultQueueSize+1)) {
+		t.Fatal("full queue accepted operation")
+	}
+	// 关闭后丢弃未执行的操作
+	queue.close()
+	close(channel.gate)
+	time.Sleep(50 * time.Millisecond)
+	if sent := len(channel.sent); sent != 1 {
+		t.Fatalf("executed %d operations after close, want 1", sent)
+	}
+}
@@ -3,16 +3,17 @@ package core
 import (
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/pion/webrtc/v3"
 	"github.com/skye-z/ons/nas-server/util"
 )
 
@@ -32,8 +33,60 @@ type SyncMessage struct {
 	Data    string `json:"data"`
 }
 
+// 加密存储库中尚未加密的文件
+func InitVault() {
+	if !util.VaultEncrypted() {
+		return
+	}
+	count, failed := 0, 0
+	err := filepath.Walk(vaultPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if path == vaultPath {
+				return err
+			}
+			// 跳过无法访问的文件或目录, 继续加密其余文件
+			log.Printf("[Vault] skip %s: %v", path, err)
+			failed++
+			if info != nil && info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() || info.Name() == ".synclog" {
+			return nil
+		}
+		data, err := os.ReadFile(path)
+		if err == nil && util.IsEncrypted(data) {
+			return nil
+		}
+		if err == nil {
+			err = util.WriteVaultFile(path, data)
+		}
+		if err != nil {
+			log.Printf("[Vault] skip %s: %v", path, err)
+			failed++
+			return nil
+		}
+		count++
+		// 保留修改时间, 避免触发同步
+		if err := os.Chtimes(path, info.ModTime(), info.ModTime()); err != nil {
+			log.Printf("[Vault] keep mtime of %s: %v", path, err)
+		}
+		return nil
+	})
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("[Vault] encrypt vault error: %v", err)
+	}
+	if count > 0 {
+		log.Printf("[Vault] encrypted %d files", count)
+	}
+	if failed > 0 {
+		log.Printf("[Vault] %d files could not be encrypted and stay in plain text", failed)
+	}
+}
+
 // 存储库操作
-func VaultOperate(channel *webrtc.DataChannel, data []byte) {
+func VaultOperate(channel Transport, policy *AccessPolicy, data []byte) {
 	var syncMsg SyncMessage
 	if err := json.Unmarshal(data, &syncMsg); err != nil {
 		log.Printf("[Vault] failed to unmarshal message: %v", err)
@@ -41,12 +94,19 @@ func VaultOperate(channel *webrtc.DataChannel, data []byte) {
 	}
 	log.Printf("[Vault] received operate: %s", syncMsg.Operate)
 
+	// 检查路径与写入权限, 拒绝时告知对端
+	if err := checkAccess(policy, &syncMsg); err != nil {
+		log.Printf("[Vault] %s denied: %s", syncMsg.Operate, filepath.Join(syncMsg.Path, syncMsg.Name))
+		sendError(channel, syncMsg, err)
+		return
+	}
+
 	// 根据操作类型执行对应的操作
 	switch syncMsg.Operate {
 	case "tree":
-		handleTree(channel, syncMsg.Data)
+		handleTree(channel, policy, syncMsg.Data)
 	case "check":
-		handleCheck(channel, syncMsg)
+		handleCheck(channel, policy, syncMsg)
 	case "create":
 		handleCreate(syncMsg)
 	case "delete":
@@ -60,6 +120,105 @@ func VaultOperate(channel *webrtc.DataChannel, data []byte) {
 	}
 }
 
+// 检查操作路径是否合法且符合访问策略, 通过后消息中的路径替换为规范化后的路径
+func checkAccess(policy *AccessPolicy, msg *SyncMessage) error {
+	var targets []string
+	switch msg.Operate {
+	case "create", "update", "rename":
+		dir, err := safeVaultPath(msg.Path)
+		if err != nil {
+			return err
+		}
+		name, err := safeVaultPath(msg.Name)
+		if err != nil {
+			return err
+		}
+		msg.Path, msg.Name = dir, name
+		targets = append(targets, path.Join(dir, name))
+		if msg.Operate == "rename" {
+			old, err := safeVaultPath(msg.Data)
+			if err != nil {
+				return err
+			}
+			msg.Data = old
+			targets = append(targets, old)
+		}
+	case "delete":
+		target, err := safeVaultPath(msg.Path)
+		if err != nil {
+			return err
+		}
+		msg.Path = target
+		targets = append(targets, target)
+	}
+	for _, target := range targets {
+		if !policy.canWrite(target) {
+			return errPermission
+		}
+	}
+	return nil
+}
+
+// [工具] 拼接存储库内的文件路径, 结果不在存储库内时返回错误
+func vaultFile(elem ...string) (string, error) {
+	return joinVault(vaultPath, elem...)
+}
+
+// [工具] 拼接根目录下的文件路径, 路径越出根目录或经过符号链接时返回错误
+func joinVault(root string, elem ...string) (string, error) {
+	root = filepath.Clean(root)
+	target := root
+	for _, item := range elem {
+		target = filepath.Join(target, filepath.FromSlash(item))
+	}
+	if target != root && !strings.HasPrefix(target, root+string(filepath.Separator)) {
+		return "", errPathIllegal
+	}
+	// 符号链接可能指向存储库外或访问范围外, 一律拒绝
+	current := root
+	for _, segment := range strings.Split(strings.TrimPrefix(target, root), string(filepath.Separator)) {
+		if segment == "" {
+			continue
+		}
+		current = filepath.Join(current, segment)
+		info, err := os.Lstat(current)
+		if err != nil {
+			// 尚不存在的部分由后续操作创建
+			break
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return "", errPathIllegal
+		}
+	}
+	return target, nil
+}
+
+// 告知对端操作被拒绝
+func sendError(channel Transport, msg SyncMessage, err error) {
+	msgBytes, _ := json.Marshal(SyncMessage{
+		Type:    "text",
+		Operate: "error",
+		Path:    msg.Path,
+		Name:    msg.Name,
+		Data:    err.Error(),
+	})
+	channel.SendText(string(msgBytes))
+}
+
+// 按访问策略过滤文件列表
+func filterFiles(policy *AccessPolicy, files []util.FileInfo) []util.FileInfo {
+	if policy == nil {
+		return files
+	}
+	list := make([]util.FileInfo, 0, len(files))
+	for _, file := range files {
+		if policy.canRead(file.Path, file.Name == "") {
+			list = append(list, file)
+		}
+	}
+	return list
+}
+
 // 读取.synclog文件中的时间戳
 func getSyncCheckTime() int64 {
 	syncLogPath := filepath.Join(vaultPath, ".synclog")
@@ -84,7 +243,7 @@ func saveSyncLog() {
 }
 
 // 处理文件树比对
-func handleTree(channel *webrtc.DataChannel, data string) {
+func handleTree(channel Transport, policy *AccessPolicy, data string) {
 	idle := true
 	var files []util.FileInfo
 	if err := json.Unmarshal([]byte(data), &files); err != nil {
@@ -96,6 +255,9 @@ func handleTree(channel *webrtc.DataChannel, data string) {
 		log.Printf("[Vault] scan directory error: %v", err)
 		return
 	}
+	serverFiles = filterFiles(policy, serverFiles)
+	// 范围外的客户端文件不参与比对
+	files = filterFiles(policy, files)
 	// 云端有客户端没有
 	for _, sf := range serverFiles {
 		if sf.Path == "." || sf.Path == "/" || strings.HasPrefix(sf.Path, ".") || sf.Name == ".DS_Store" {
@@ -151,7 +313,7 @@ func handleTree(channel *webrtc.DataChannel, data string) {
 }
 
 // 处理新旧检查任务
-func handleCheck(channel *webrtc.DataChannel, msg SyncMessage) {
+func handleCheck(channel Transport, policy *AccessPolicy, msg SyncMessage) {
 	// 获取客户端同步时间
 	clientDate, err := strconv.ParseInt(msg.Data, 10, 64)
 	if err != nil {
@@ -193,7 +355,7 @@ func handleCheck(channel *webrtc.DataChannel, msg SyncMessage) {
 			log.Printf("[Vault] scan directory error: %v", err)
 			return
 		}
-		scanBytes, _ := json.Marshal(scan)
+		scanBytes, _ := json.Marshal(filterFiles(policy, scan))
 		// 如果服务端的时间戳较新，则要求客户端发送文件树
 		msgBytes, _ := json.Marshal(SyncMessage{
 			Type:    "text",
@@ -208,10 +370,13 @@ func handleCheck(channel *webrtc.DataChannel, msg SyncMessage) {
 
 // 处理创建任务
 func handleCreate(msg SyncMessage) {
-	msg.Path = filepath.Join(vaultPath, msg.Path)
-
 	if msg.Type == "directory" {
-		if err := os.MkdirAll(msg.Path, os.ModePerm); err != nil {
+		dirPath, err := vaultFile(msg.Path)
+		if err != nil {
+			log.Printf("[Vault] error creating directory: %v", err)
+			return
+		}
+		if err := os.MkdirAll(dirPath, os.ModePerm); err != nil {
 			log.Printf("[Vault] error creating directory: %v", err)
 		} else {
 			saveSyncLog()
@@ -222,7 +387,7 @@ func handleCreate(msg SyncMessage) {
 }
 
 // 发送创建
-func sendCreate(channel *webrtc.DataChannel, path, name string) {
+func sendCreate(channel Transport, path, name string) {
 	msg := SyncMessage{
 		Type:    "binary",
 		Operate: "create",
@@ -245,7 +410,11 @@ func sendCreate(channel *webrtc.DataChannel, path, name string) {
 // 处理删除任务
 func handleDelete(path string) {
 	log.Printf("rename: %s", path)
-	path = filepath.Join(vaultPath, path)
+	path, err := vaultFile(path)
+	if err != nil {
+		log.Printf("[Vault] error removing file or directory: %v", err)
+		return
+	}
 	if err := os.Remove(path); err != nil {
 		log.Printf("[Vault] error removing file or directory: %v", err)
 	}
@@ -253,7 +422,7 @@ func handleDelete(path string) {
 }
 
 // 发送删除
-func sendDelete(channel *webrtc.DataChannel, path, name string) {
+func sendDelete(channel Transport, path, name string) {
 	msg := SyncMessage{
 		Type:    "binary",
 		Operate: "delete",
@@ -272,7 +441,6 @@ func sendDelete(channel *webrtc.DataChannel, path, name string) {
 
 // 处理更新任务
 func handleUpdate(msg SyncMessage) {
-	msg.Path = filepath.Join(vaultPath, msg.Path)
 	if msg.Type == "directory" {
 		return
 	}
@@ -280,7 +448,7 @@ func handleUpdate(msg SyncMessage) {
 }
 
 // 发送更新
-func sendUpdate(channel *webrtc.DataChannel, path, name string) {
+func sendUpdate(channel Transport, path, name string) {
 	msg := SyncMessage{
 		Operate: "update",
 		Path:    path,
@@ -296,7 +464,12 @@ func sendUpdate(channel *webrtc.DataChannel, path, name string) {
 	}
 
 	// 读取完整文件
-	fileData, err := os.ReadFile(filepath.Join(vaultPath, path))
+	filePath, err := vaultFile(path)
+	if err != nil {
+		log.Printf("[Vault] read file error: %v", err)
+		return
+	}
+	fileData, err := util.ReadVaultFile(filePath)
 	if err != nil {
 		log.Println("[Vault] read file error")
 		return
@@ -315,7 +488,7 @@ func sendUpdate(channel *webrtc.DataChannel, path, name string) {
 }
 
 // 发送分块数据
-func sendBase64Chunks(channel *webrtc.DataChannel, msg *SyncMessage, base64Data string) {
+func sendBase64Chunks(channel Transport, msg *SyncMessage, base64Data string) {
 	// 计算总块数
 	totalChunks := (len(base64Data) + blockSize - 1) / blockSize
 
@@ -344,15 +517,21 @@ func sendBase64Chunks(channel *webrtc.DataChannel, msg *SyncMessage, base64Data
 
 // 处理重命名任务
 func handleRename(path, name, oldName string) {
-	path = filepath.Join(vaultPath, path)
+	dirPath, err1 := vaultFile(path)
+	oldPath, err2 := vaultFile(oldName)
+	newPath, err3 := vaultFile(path, name)
+	if err := errors.Join(err1, err2, err3); err != nil {
+		log.Printf("[Vault] error renaming file or directory: %v", err)
+		return
+	}
 
 	// 确保路径存在
-	if err := util.EnsureDirExists(path); err != nil {
+	if err := util.EnsureDirExists(dirPath); err != nil {
 		log.Printf("[Vault] error ensuring directory exists: %v", err)
 		return
 	}
 
-	if err := os.Rename(filepath.Join(vaultPath, oldName), filepath.Join(path, name)); err != nil {
+	if err := os.Rename(oldPath, newPath); err != nil {
 		log.Printf("[Vault] error renaming file or directory: %v", err)
 	}
 	saveSyncLog()
@@ -376,7 +555,11 @@ func handleChunkedDataIfBinary(msg SyncMessage) {
 		base64ChunkData := parts[2]
 
 		// 获取文件名的完整路径
-		filePath := filepath.Join(msg.Path, msg.Name)
+		filePath, err := vaultFile(msg.Path, msg.Name)
+		if err != nil {
+			log.Printf("[Vault] error writing file: %v", err)
+			return
+		}
 
 		// 确保路径存在
 		dirPath := filepath.Dir(filePath)
@@ -400,7 +583,7 @@ func handleChunkedDataIfBinary(msg SyncMessage) {
 			delete(fileChunks, filePath)
 
 			// 将合并后的数据写入文件
-			if err := os.WriteFile(filePath, mergedData, 0644); err != nil {
+			if err := util.WriteVaultFile(filePath, mergedData); err != nil {
 				log.Printf("[Vault] error writing merged data to file: %v", err)
 			} else {
 				saveSyncLog()
@@ -415,7 +598,11 @@ func handleChunkedDataIfBinary(msg SyncMessage) {
 		}
 
 		// 获取文件名的完整路径
-		filePath := filepath.Join(msg.Path, msg.Name)
+		filePath, err := vaultFile(msg.Path, msg.Name)
+		if err != nil {
+			log.Printf("[Vault] error writing file: %v", err)
+			return
+		}
 
 		// 确保路径存在
 		dirPath := filepath.Dir(filePath)
@@ -425,7 +612,7 @@ func handleChunkedDataIfBinary(msg SyncMessage) {
 		}
 
 		// 将解码后的数据写入文件
-		if err := os.WriteFile(filePath, data, 0644); err != nil {
+		if err := util.WriteVaultFile(filePath, data); err != nil {
 			log.Printf("[Vault] error writing file: %v", err)
 		} else {
 			saveSyncLog()
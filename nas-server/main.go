@@ -3,6 +3,7 @@ package main
 import (
 	"embed"
 	"flag"
+	"time"
 
 	"github.com/skye-z/ons/nas-server/core"
 	"github.com/skye-z/ons/nas-server/util"
@@ -18,9 +19,23 @@ func main() {
 	debug := flag.Bool("debug", false, "output debug logs")
 	// 定义一个命令行参数
 	port := flag.Int("port", 9892, "the port to listen on")
+	// 定义一个命令行参数
+	discover := flag.Bool("discover", false, "browse NAS servers on the LAN and exit")
 	// 解析命令行参数
 	flag.Parse()
+	// 浏览局域网内的 NAS
+	if *discover {
+		core.PrintDiscover(3 * time.Second)
+		return
+	}
+	// 解锁存储库加密
+	if err := util.InitVaultCipher(); err != nil {
+		util.OutErr("Vault", "unlock failed: %v", err)
+	}
+	core.InitVault()
 	// 初始化路由器
 	router := core.BuildRouter(!*debug, *port, "0.0.0.0", util.GetString("basic.sslCert"), util.GetString("basic.sslKey"), page)
+	// 局域网广播
+	core.StartAdvertise(router.Port(), router.TLS())
 	router.Run()
 }
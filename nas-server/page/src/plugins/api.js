@@ -23,14 +23,34 @@ function get(url) {
     })
 }
 
+export const admin = {
+    state: () => get('/admin/state'),
+    init: (password) => post('/admin/init', { password }),
+    login: (password) => post('/admin/login', { password }),
+}
+
 export const setting = {
     all: () => get('/setting'),
+    getPassword: () => get('/setting/pwd'),
     setPassword: () => post('/setting/pwd'),
 }
 
+export const guard = {
+    get: () => get('/guard'),
+    unlock: () => post('/guard/unlock'),
+}
+
+export const key = {
+    list: () => get('/keys'),
+    create: (form) => post('/keys', form),
+    update: (id, form) => post('/keys/' + id, form),
+    revoke: (id) => request({ url: '/keys/' + id, method: 'DELETE' }),
+}
+
 export const device = {
-    register: () => get('/register'),
+    register: (code, migrate) => get('/register?code=' + encodeURIComponent(code) + (migrate ? '&migrate=true' : '')),
     getState: () => get('/conn/state'),
+    events: () => new EventSource('/api/conn/events?token=' + encodeURIComponent(localStorage.getItem("nas:token"))),
     openServer: () => get('/conn/open'),
     closeServer: () => get('/conn/close'),
     switchAuto: () => get('/auto/switch'),
@@ -7,7 +7,7 @@ const request = axios.create({
 
 request.interceptors.request.use(
     config => {
-        let token = localStorage.getItem("access:token");
+        let token = localStorage.getItem("nas:token");
         if (token) config.headers['Authorization'] = 'Bearer '+token;
         return config
     },
@@ -23,11 +23,10 @@ request.interceptors.response.use(
         }
         if (response?.data?.code){
             let code = parseInt(response.data.code);
-            // if (code >= 10100 && code <= 10103) {
-            //     window.$message.warning(response.data.message);
-            //     localStorage.removeItem("access:token");
-            //     location.href = '/app'
-            // } else 
+            if (code >= 10100 && code <= 10103) {
+                localStorage.removeItem("nas:token");
+                location.href = '/app'
+            }
             return response.data
         } else return response.data
     }, () => {
@@ -0,0 +1,201 @@
+/*
+存储加密工具
+
+BetaX Blog
+Copyright © 2024 SkyeZhang <skai-zhang@hotmail.com>
+*/
+
+package util
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// 加密文件头
+var cipherMagic = []byte("ONSE")
+
+const (
+	cipherVersion = 1
+	cipherNonce   = 12
+	cipherTag     = 16
+	// 加密文件相对明文多出的长度
+	CipherOverhead = 4 + 1 + cipherNonce + cipherTag
+	// 口令校验内容
+	cipherCheck = "ons-vault"
+)
+
+var vaultAEAD cipher.AEAD
+
+// 初始化存储库加密
+func InitVaultCipher() error {
+	if !GetBool("vault.encrypt") {
+		return nil
+	}
+	var key []byte
+	var err error
+	if keyFile := GetString("vault.keyFile"); keyFile != "" {
+		key, err = loadKeyFile(keyFile)
+	} else {
+		key, err = deriveKey()
+	}
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+	vaultAEAD = aead
+	// 校验密钥
+	check := GetString("vault.check")
+	if check == "" {
+		sealed, err := EncryptData([]byte(cipherCheck))
+		if err != nil {
+			return err
+		}
+		Set("vault.check", base64.StdEncoding.EncodeToString(sealed))
+		return nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(check)
+	if err != nil {
+		return err
+	}
+	plain, err := DecryptData(sealed)
+	if err != nil || string(plain) != cipherCheck {
+		vaultAEAD = nil
+		return errors.New("vault key mismatch")
+	}
+	return nil
+}
+
+// 是否启用存储库加密
+func VaultEncrypted() bool {
+	return vaultAEAD != nil
+}
+
+// 加密数据
+func EncryptData(plain []byte) ([]byte, error) {
+	if vaultAEAD == nil {
+		return plain, nil
+	}
+	nonce := make([]byte, cipherNonce)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	header := append(append([]byte{}, cipherMagic...), cipherVersion)
+	out := append(header, nonce...)
+	return vaultAEAD.Seal(out, nonce, plain, header), nil
+}
+
+// 解密数据, 未加密的旧数据原样返回
+func DecryptData(data []byte) ([]byte, error) {
+	if vaultAEAD == nil || !IsEncrypted(data) {
+		return data, nil
+	}
+	header := data[:len(cipherMagic)+1]
+	if header[len(cipherMagic)] != cipherVersion {
+		return nil, fmt.Errorf("unsupported cipher version %d", header[len(cipherMagic)])
+	}
+	nonce := data[len(header) : len(header)+cipherNonce]
+	return vaultAEAD.Open(nil, nonce, data[len(header)+cipherNonce:], header)
+}
+
+// 检查数据是否已加密
+func IsEncrypted(data []byte) bool {
+	return len(data) >= CipherOverhead && bytes.Equal(data[:len(cipherMagic)], cipherMagic)
+}
+
+// 检查文件是否已加密, 只读取文件头
+func IsEncryptedFile(path string) bool {
+	file, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	header := make([]byte, len(cipherMagic))
+	if _, err := io.ReadFull(file, header); err != nil {
+		return false
+	}
+	return bytes.Equal(header, cipherMagic)
+}
+
+// 载入密钥文件, 不存在时自动生成
+func loadKeyFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)), 0600); err != nil {
+			return nil, err
+		}
+		OutLogf("Vault", "generated key file %s, keep it away from the vault disk", path)
+		return key, nil
+	} else if err != nil {
+		return nil, err
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, errors.New("key file must contain 32 bytes")
+	}
+	return key, nil
+}
+
+// [工具] 标准输入是否为终端, 重定向到空设备或管道时不是
+func stdinTerminal() bool {
+	stat, err := os.Stdin.Stat()
+	if err != nil || stat.Mode()&os.ModeCharDevice == 0 {
+		return false
+	}
+	null, err := os.Stat(os.DevNull)
+	return err != nil || !os.SameFile(stat, null)
+}
+
+// 通过启动口令派生密钥
+func deriveKey() ([]byte, error) {
+	passphrase := os.Getenv("ONS_VAULT_PASSPHRASE")
+	if passphrase == "" {
+		// 以服务运行时没有终端, 不等待输入
+		if !stdinTerminal() {
+			return nil, errors.New("vault passphrase required, set ONS_VAULT_PASSPHRASE when running without a terminal")
+		}
+		fmt.Print("Vault passphrase: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return nil, errors.New("vault passphrase required")
+		}
+		passphrase = strings.TrimSpace(line)
+	}
+	if passphrase == "" {
+		return nil, errors.New("vault passphrase required")
+	}
+	salt, err := base64.StdEncoding.DecodeString(GetString("vault.salt"))
+	if err != nil || len(salt) == 0 {
+		salt = make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		Set("vault.salt", base64.StdEncoding.EncodeToString(salt))
+	}
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+}
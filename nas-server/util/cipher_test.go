@@ -0,0 +1,141 @@
+package util
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// [工具] 使用给定密钥启用存储库加密, 测试结束后关闭
+func useVaultKey(t *testing.T, key []byte) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vaultAEAD = aead
+	t.Cleanup(func() { vaultAEAD = nil })
+}
+
+func TestCipherRoundTrip(t *testing.T) {
+	useVaultKey(t, bytes.Repeat([]byte{1}, 32))
+	plain := []byte("# note\nhello vault")
+	sealed, err := EncryptData(plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sealed) != len(plain)+CipherOverhead {
+		t.Fatalf("sealed length = %d, want %d", len(sealed), len(plain)+CipherOverhead)
+	}
+	if !IsEncrypted(sealed) || bytes.Contains(sealed, plain) {
+		t.Fatal("data not encrypted")
+	}
+	again, _ := EncryptData(plain)
+	if bytes.Equal(again, sealed) {
+		t.Fatal("nonce reused")
+	}
+	opened, err := DecryptData(sealed)
+	if err != nil || !bytes.Equal(opened, plain) {
+		t.Fatalf("DecryptData = %q, %v", opened, err)
+	}
+	empty, _ := EncryptData(nil)
+	if opened, err := DecryptData(empty); err != nil || len(opened) != 0 {
+		t.Fatalf("empty round trip = %q, %v", opened, err)
+	}
+}
+
+func TestCipherTamper(t *testing.T) {
+	useVaultKey(t, bytes.Repeat([]byte{1}, 32))
+	sealed, _ := EncryptData([]byte("hello vault"))
+	// 版本号, 随机数, 密文与认证标签任一被修改都无法解密
+	for _, i := range []int{4, 5, CipherOverhead - cipherTag, len(sealed) - 1} {
+		tampered := append([]byte{}, sealed...)
+		tampered[i] ^= 1
+		if _, err := DecryptData(tampered); err == nil {
+			t.Errorf("tampered byte %d accepted", i)
+		}
+	}
+	if _, err := DecryptData(sealed[:len(sealed)-1]); err == nil {
+		t.Error("truncated data accepted")
+	}
+	useVaultKey(t, bytes.Repeat([]byte{2}, 32))
+	if _, err := DecryptData(sealed); err == nil {
+		t.Error("wrong key accepted")
+	}
+}
+
+func TestCipherPlainData(t *testing.T) {
+	plain := []byte("legacy note")
+	// 未启用加密时原样读写
+	if sealed, err := EncryptData(plain); err != nil || !bytes.Equal(sealed, plain) {
+		t.Fatalf("EncryptData without key = %q, %v", sealed, err)
+	}
+	useVaultKey(t, bytes.Repeat([]byte{1}, 32))
+	// 启用加密前写入的明文原样返回
+	if opened, err := DecryptData(plain); err != nil || !bytes.Equal(opened, plain) {
+		t.Fatalf("DecryptData legacy = %q, %v", opened, err)
+	}
+	if IsEncrypted([]byte("ONSE")) {
+		t.Fatal("short data treated as encrypted")
+	}
+}
+
+func TestIsEncryptedFile(t *testing.T) {
+	useVaultKey(t, bytes.Repeat([]byte{1}, 32))
+	dir := t.TempDir()
+	sealed, _ := EncryptData([]byte("hello vault"))
+	for name, c := range map[string]struct {
+		data []byte
+		want bool
+	}{
+		"sealed.md": {sealed, true},
+		"plain.md":  {[]byte("hello vault, long enough to hold a header"), false},
+		"short.md":  {[]byte("ON"), false},
+		"empty.md":  {nil, false},
+	} {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, c.data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if got := IsEncryptedFile(path); got != c.want {
+			t.Errorf("IsEncryptedFile(%s) = %v, want %v", name, got, c.want)
+		}
+	}
+	if IsEncryptedFile(filepath.Join(dir, "missing.md")) {
+		t.Error("missing file treated as encrypted")
+	}
+}
+
+func TestLoadKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "vault.key")
+	key, err := loadKeyFile(path)
+	if err != nil || len(key) != 32 {
+		t.Fatalf("generated key = %d bytes, %v", len(key), err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("key file mode = %v, %v", info.Mode(), err)
+	}
+	again, err := loadKeyFile(path)
+	if err != nil || !bytes.Equal(again, key) {
+		t.Fatal("key file not reused")
+	}
+	for name, data := range map[string]string{
+		"short.key":  base64.StdEncoding.EncodeToString(make([]byte, 16)),
+		"broken.key": "not base64!",
+	} {
+		path := filepath.Join(dir, name)
+		os.WriteFile(path, []byte(data), 0600)
+		if _, err := loadKeyFile(path); err == nil {
+			t.Errorf("%s accepted", name)
+		}
+	}
+}
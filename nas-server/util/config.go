@@ -17,6 +17,7 @@ import (
 const Version = "0.2.0"
 
 func InitConfig() {
+	loadDefault()
 	viper.SetConfigName("config")
 	viper.SetConfigType("ini")
 	viper.AddConfigPath(".")
@@ -63,8 +64,21 @@ func createDefault() {
 	// 是否开放注册
 	viper.SetDefault("connect.auto", "false")
 	viper.SetDefault("connect.server", "ons.betax.dev")
+	// 使用未加密的 ws 连接中控, 仅用于本地调试
+	viper.SetDefault("connect.insecure", "false")
 	viper.SetDefault("connect.natId", "")
 	viper.SetDefault("connect.password", "")
+	// 设备私钥, 注册时生成, 用于向中控证明 NAT 编号归属
+	viper.SetDefault("connect.deviceKey", "")
+	// 连续认证失败锁定阈值
+	viper.SetDefault("guard.attempts", 5)
+	// ICE 服务器, 逗号分隔, 支持 stun: 与 turn:/turns:
+	viper.SetDefault("ice.servers", "stun:stun.l.google.com:19302,stun:stun.nextcloud.com:443")
+	viper.SetDefault("ice.username", "")
+	viper.SetDefault("ice.credential", "")
+	// 存储库加密
+	viper.SetDefault("vault.encrypt", "false")
+	viper.SetDefault("vault.keyFile", "")
 	// 令牌密钥
 	secret, err := generateSecret()
 	if err != nil {
@@ -76,6 +90,12 @@ func createDefault() {
 	viper.SafeWriteConfig()
 }
 
+// 后续版本新增的配置项, 旧配置文件中缺失时使用默认值
+func loadDefault() {
+	// 通过 mDNS 在局域网广播本机
+	viper.SetDefault("mdns.enable", true)
+}
+
 func generateSecret() (string, error) {
 	key := make([]byte, 32)
 	_, err := rand.Read(key)
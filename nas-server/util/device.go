@@ -0,0 +1,40 @@
+/*
+设备密钥工具
+
+BetaX Blog
+Copyright © 2024 SkyeZhang <skai-zhang@hotmail.com>
+*/
+
+package util
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+)
+
+// 生成设备密钥对, 返回私钥种子与公钥 (Base64)
+// 公钥在注册时提交给中控, 私钥种子仅保存在本机
+func GenerateDeviceKey() (string, string, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(private.Seed()), base64.StdEncoding.EncodeToString(public), nil
+}
+
+// 对中控下发的注册挑战签名, 证明 NAT 编号归属
+func SignChallenge(seed, natId, nonce string) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(seed)
+	if err != nil || len(raw) != ed25519.SeedSize {
+		return "", errors.New("device key missing or invalid")
+	}
+	sign := ed25519.Sign(ed25519.NewKeyFromSeed(raw), challengeMessage(natId, nonce))
+	return base64.StdEncoding.EncodeToString(sign), nil
+}
+
+// [工具] 签名内容, 与中控 util.VerifyChallenge 一致
+func challengeMessage(natId, nonce string) []byte {
+	return []byte("ons-register:" + natId + ":" + nonce)
+}
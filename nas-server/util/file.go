@@ -41,12 +41,18 @@ func ScanDirectory(vaultPath string) ([]FileInfo, error) {
 			return nil
 		}
 
+		// 加密存储时按明文大小比对, 尚未加密的文件保持原大小
+		size := info.Size()
+		if name != "" && VaultEncrypted() && size >= CipherOverhead && IsEncryptedFile(path) {
+			size -= CipherOverhead
+		}
+
 		// 添加文件信息到列表
 		files = append(files, FileInfo{
 			Name:  name,
 			Path:  relativePath,
 			Mtime: info.ModTime().Unix(),
-			Size:  info.Size(),
+			Size:  size,
 		})
 
 		return nil
@@ -71,6 +77,24 @@ func EnsureDirExists(dirPath string) error {
 	return nil
 }
 
+// 读取存储库文件
+func ReadVaultFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return DecryptData(data)
+}
+
+// 写入存储库文件
+func WriteVaultFile(path string, data []byte) error {
+	sealed, err := EncryptData(data)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, sealed, 0644)
+}
+
 // 合并分块数据
 func MergeChunks(chunks map[int]string) []byte {
 	var mergedData string
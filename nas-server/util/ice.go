@@ -0,0 +1,75 @@
+/*
+ICE 服务器配置工具
+
+BetaX Blog
+Copyright © 2024 SkyeZhang <skai-zhang@hotmail.com>
+*/
+
+package util
+
+import (
+	"strings"
+
+	"github.com/pion/webrtc/v3"
+)
+
+// 未配置时使用的公共 STUN 服务器
+const defaultICEServers = "stun:stun.l.google.com:19302,stun:stun.nextcloud.com:443"
+
+// 获取本机配置的 ICE 服务器
+// ice.servers 为逗号分隔的 stun/turn 地址, ice.username 与 ice.credential 用于 TURN 认证
+func ICEServers() []webrtc.ICEServer {
+	list := GetString("ice.servers")
+	if strings.TrimSpace(list) == "" {
+		list = defaultICEServers
+	}
+	var stuns, turns []string
+	for _, item := range strings.Split(list, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if strings.HasPrefix(item, "turn:") || strings.HasPrefix(item, "turns:") {
+			turns = append(turns, item)
+		} else {
+			stuns = append(stuns, item)
+		}
+	}
+	var servers []webrtc.ICEServer
+	for _, url := range stuns {
+		servers = append(servers, webrtc.ICEServer{URLs: []string{url}})
+	}
+	if len(turns) > 0 {
+		servers = append(servers, webrtc.ICEServer{
+			URLs:       turns,
+			Username:   GetString("ice.username"),
+			Credential: GetString("ice.credential"),
+		})
+	}
+	return servers
+}
+
+// 合并中控下发的 ICE 服务器, 忽略重复地址
+func MergeICEServers(local, remote []webrtc.ICEServer) []webrtc.ICEServer {
+	seen := make(map[string]bool)
+	for _, server := range local {
+		for _, url := range server.URLs {
+			seen[url] = true
+		}
+	}
+	servers := append([]webrtc.ICEServer{}, local...)
+	for _, server := range remote {
+		var urls []string
+		for _, url := range server.URLs {
+			if !seen[url] {
+				seen[url] = true
+				urls = append(urls, url)
+			}
+		}
+		if len(urls) > 0 {
+			server.URLs = urls
+			servers = append(servers, server)
+		}
+	}
+	return servers
+}
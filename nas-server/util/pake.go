@@ -0,0 +1,135 @@
+/*
+口令认证密钥交换工具 (SPAKE2)
+
+BetaX Blog
+Copyright © 2024 SkyeZhang <skai-zhang@hotmail.com>
+*/
+
+package util
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"math/big"
+	"strings"
+)
+
+// RFC 3526 2048位 MODP 群
+const pakePrimeHex = "FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1" +
+	"29024E088A67CC74020BBEA63B139B22514A08798E3404DD" +
+	"EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245" +
+	"E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED" +
+	"EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3D" +
+	"C2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F" +
+	"83655D23DCA3AD961C62F356208552BB9ED529077096966D" +
+	"670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B" +
+	"E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9" +
+	"DE2BCBF6955817183995497CEA956AE515D2261898FA0510" +
+	"15728E5A8AACAA68FFFFFFFFFFFFFFFF"
+
+const pakeSize = 256
+
+var (
+	pakeP, _ = new(big.Int).SetString(pakePrimeHex, 16)
+	pakeQ    = new(big.Int).Rsh(pakeP, 1)
+	pakeG    = big.NewInt(2)
+	pakeM    = pakeHashToGroup("ONS-SPAKE2-M")
+	pakeN    = pakeHashToGroup("ONS-SPAKE2-N")
+)
+
+// 由口令派生 SPAKE2 秘密
+func PAKESecret(id, password string) *big.Int {
+	sum := sha256.Sum256([]byte("ONS-SPAKE2-W\x00" + id + "\x00" + password))
+	return new(big.Int).Mod(new(big.Int).SetBytes(sum[:]), pakeQ)
+}
+
+// 作为响应方(NSB)完成交换, 返回响应值与会话密钥
+func PAKERespond(w *big.Int, idA, idB, xHex string) (string, []byte, error) {
+	y, err := rand.Int(rand.Reader, new(big.Int).Sub(pakeQ, big.NewInt(1)))
+	if err != nil {
+		return "", nil, err
+	}
+	y.Add(y, big.NewInt(1))
+	return pakeRespond(w, idA, idB, xHex, y)
+}
+
+// 使用给定随机数完成交换
+func pakeRespond(w *big.Int, idA, idB, xHex string, y *big.Int) (string, []byte, error) {
+	x, ok := new(big.Int).SetString(xHex, 16)
+	if !ok || !pakeValid(x) {
+		return "", nil, errors.New("invalid pake message")
+	}
+	// Y = g^y * N^w
+	Y := new(big.Int).Exp(pakeG, y, pakeP)
+	Y.Mul(Y, new(big.Int).Exp(pakeN, w, pakeP)).Mod(Y, pakeP)
+	// Z = (X / M^w)^y
+	mw := new(big.Int).Exp(pakeM, w, pakeP)
+	Z := new(big.Int).Mul(x, new(big.Int).ModInverse(mw, pakeP))
+	Z.Mod(Z, pakeP).Exp(Z, y, pakeP)
+	return hex.EncodeToString(pakeBytes(Y)), pakeKey(idA, idB, x, Y, Z, w), nil
+}
+
+// 由交换记录派生会话密钥
+func pakeKey(idA, idB string, X, Y, Z, w *big.Int) []byte {
+	h := sha256.New()
+	for _, part := range [][]byte{
+		[]byte("ONS-SPAKE2"), []byte(idA), []byte(idB),
+		pakeBytes(X), pakeBytes(Y), pakeBytes(Z), pakeBytes(w),
+	} {
+		var size [8]byte
+		binary.BigEndian.PutUint64(size[:], uint64(len(part)))
+		h.Write(size[:])
+		h.Write(part)
+	}
+	return h.Sum(nil)
+}
+
+// 使用会话密钥计算消息认证码
+func PAKEMac(key []byte, label, data string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(label + "|" + data))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// 校验消息认证码
+func PAKEVerify(key []byte, label, data, sum string) bool {
+	return hmac.Equal([]byte(PAKEMac(key, label, data)), []byte(strings.ToLower(sum)))
+}
+
+// 提取 SDP 中的 DTLS 证书指纹
+func SDPFingerprint(sdp string) string {
+	for _, line := range strings.Split(sdp, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "a=fingerprint:") {
+			return strings.ToLower(strings.TrimPrefix(line, "a=fingerprint:"))
+		}
+	}
+	return ""
+}
+
+// 检查元素是否位于素数阶子群
+func pakeValid(v *big.Int) bool {
+	if v.Cmp(big.NewInt(1)) <= 0 || v.Cmp(new(big.Int).Sub(pakeP, big.NewInt(1))) >= 0 {
+		return false
+	}
+	return new(big.Int).Exp(v, pakeQ, pakeP).Cmp(big.NewInt(1)) == 0
+}
+
+func pakeBytes(v *big.Int) []byte {
+	return v.FillBytes(make([]byte, pakeSize))
+}
+
+// 将标签映射为离散对数未知的群元素
+func pakeHashToGroup(label string) *big.Int {
+	var buf []byte
+	for i := byte(0); len(buf) < pakeSize+32; i++ {
+		sum := sha256.Sum256(append([]byte(label), i))
+		buf = append(buf, sum[:]...)
+	}
+	v := new(big.Int).Mod(new(big.Int).SetBytes(buf), pakeP)
+	return v.Exp(v, big.NewInt(2), pakeP)
+}
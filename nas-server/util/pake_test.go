@@ -0,0 +1,200 @@
+package util
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"math/big"
+	"os"
+	"testing"
+)
+
+// 与 obsidian-plugin 共用的已知答案向量
+type pakeVectors struct {
+	Exchanges []struct {
+		Name     string `json:"name"`
+		Id       string `json:"id"`
+		Password string `json:"password"`
+		IdA      string `json:"idA"`
+		IdB      string `json:"idB"`
+		// 双方的随机数
+		X string `json:"x"`
+		Y string `json:"y"`
+		W string `json:"w"`
+		// 双方发送的交换值
+		XMsg     string `json:"X"`
+		YMsg     string `json:"Y"`
+		Key      string `json:"key"`
+		Confirm  string `json:"confirm"`
+		RelayNSC string `json:"relayNSC"`
+		RelayNSB string `json:"relayNSB"`
+	} `json:"exchanges"`
+	// 必须拒绝的交换值
+	Invalid []string `json:"invalid"`
+}
+
+func loadPAKEVectors(t *testing.T) pakeVectors {
+	data, err := os.ReadFile("testdata/pake_vectors.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var vectors pakeVectors
+	if err := json.Unmarshal(data, &vectors); err != nil {
+		t.Fatal(err)
+	}
+	return vectors
+}
+
+// [工具] 发起方(NSC)生成交换值
+func pakeStart(w, x *big.Int) string {
+	X := new(big.Int).Exp(pakeG, x, pakeP)
+	X.Mul(X, new(big.Int).Exp(pakeM, w, pakeP)).Mod(X, pakeP)
+	return hex.EncodeToString(pakeBytes(X))
+}
+
+// [工具] 发起方(NSC)处理响应并派生会话密钥
+func pakeFinish(w, x *big.Int, idA, idB, xHex, yHex string) []byte {
+	X, _ := new(big.Int).SetString(xHex, 16)
+	Y, _ := new(big.Int).SetString(yHex, 16)
+	nw := new(big.Int).Exp(pakeN, w, pakeP)
+	Z := new(big.Int).Mul(Y, new(big.Int).ModInverse(nw, pakeP))
+	Z.Mod(Z, pakeP).Exp(Z, x, pakeP)
+	return pakeKey(idA, idB, X, Y, Z, w)
+}
+
+func randomScalar(t *testing.T) *big.Int {
+	x, err := rand.Int(rand.Reader, new(big.Int).Sub(pakeQ, big.NewInt(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return x.Add(x, big.NewInt(1))
+}
+
+func TestPAKEVectors(t *testing.T) {
+	for _, v := range loadPAKEVectors(t).Exchanges {
+		t.Run(v.Name, func(t *testing.T) {
+			w := PAKESecret(v.Id, v.Password)
+			if w.Text(16) != v.W {
+				t.Fatalf("secret = %s, want %s", w.Text(16), v.W)
+			}
+			x, _ := new(big.Int).SetString(v.X, 16)
+			y, _ := new(big.Int).SetString(v.Y, 16)
+			if X := pakeStart(w, x); X != v.XMsg {
+				t.Fatalf("X = %s, want %s", X, v.XMsg)
+			}
+			Y, key, err := pakeRespond(w, v.IdA, v.IdB, v.XMsg, y)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if Y != v.YMsg {
+				t.Fatalf("Y = %s, want %s", Y, v.YMsg)
+			}
+			if hex.EncodeToString(key) != v.Key {
+				t.Fatalf("key = %x, want %s", key, v.Key)
+			}
+			if !bytes.Equal(pakeFinish(w, x, v.IdA, v.IdB, v.XMsg, v.YMsg), key) {
+				t.Fatal("initiator derived a different key")
+			}
+			if confirm := PAKEMac(key, "confirm", v.IdB); confirm != v.Confirm {
+				t.Fatalf("confirm = %s, want %s", confirm, v.Confirm)
+			}
+			if relay := hex.EncodeToString(RelayKey(key, "NSC")); relay != v.RelayNSC {
+				t.Fatalf("relay NSC = %s, want %s", relay, v.RelayNSC)
+			}
+			if relay := hex.EncodeToString(RelayKey(key, "NSB")); relay != v.RelayNSB {
+				t.Fatalf("relay NSB = %s, want %s", relay, v.RelayNSB)
+			}
+		})
+	}
+}
+
+func TestPAKEExchange(t *testing.T) {
+	w := PAKESecret("K7Q2M9X4PW", "password")
+	x := randomScalar(t)
+	X := pakeStart(w, x)
+	Y, key, err := PAKERespond(w, "NSC", "K7Q2M9X4PW", X)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pakeFinish(w, x, "NSC", "K7Q2M9X4PW", X, Y), key) {
+		t.Fatal("keys differ")
+	}
+	if !PAKEVerify(key, "confirm", "K7Q2M9X4PW", PAKEMac(key, "confirm", "K7Q2M9X4PW")) {
+		t.Fatal("confirm rejected")
+	}
+}
+
+func TestPAKEWrongPassword(t *testing.T) {
+	w := PAKESecret("K7Q2M9X4PW", "password")
+	guess := PAKESecret("K7Q2M9X4PW", "passw0rd")
+	x := randomScalar(t)
+	X := pakeStart(guess, x)
+	Y, key, err := PAKERespond(w, "NSC", "K7Q2M9X4PW", X)
+	if err != nil {
+		t.Fatal(err)
+	}
+	guessKey := pakeFinish(guess, x, "NSC", "K7Q2M9X4PW", X, Y)
+	if bytes.Equal(guessKey, key) {
+		t.Fatal("wrong password derived the session key")
+	}
+	if PAKEVerify(guessKey, "confirm", "K7Q2M9X4PW", PAKEMac(key, "confirm", "K7Q2M9X4PW")) {
+		t.Fatal("confirm accepted with wrong password")
+	}
+	// 同一口令在不同设备上派生的秘密不同
+	if PAKESecret("K7Q2M9X4PX", "password").Cmp(w) == 0 {
+		t.Fatal("secret not bound to device")
+	}
+}
+
+func TestPAKERejectsInvalid(t *testing.T) {
+	w := PAKESecret("K7Q2M9X4PW", "password")
+	invalid := append(loadPAKEVectors(t).Invalid, "", "zz", "-2")
+	for _, x := range invalid {
+		if _, _, err := PAKERespond(w, "NSC", "K7Q2M9X4PW", x); err == nil {
+			t.Errorf("accepted X = %q", x)
+		}
+	}
+}
+
+func TestPAKEVerify(t *testing.T) {
+	key := []byte("0123456789abcdef0123456789abcdef")
+	sum := PAKEMac(key, "offer", "fingerprint")
+	if !PAKEVerify(key, "offer", "fingerprint", sum) {
+		t.Fatal("valid mac rejected")
+	}
+	// 接受大写十六进制
+	upper := []byte(sum)
+	for i, c := range upper {
+		if c >= 'a' && c <= 'f' {
+			upper[i] = c - 'a' + 'A'
+		}
+	}
+	if !PAKEVerify(key, "offer", "fingerprint", string(upper)) {
+		t.Fatal("uppercase mac rejected")
+	}
+	last := "0"
+	if sum[len(sum)-1] == '0' {
+		last = "1"
+	}
+	for _, tamper := range [][3]string{
+		{"answer", "fingerprint", sum},
+		{"offer", "other", sum},
+		{"offer", "fingerprint", sum[:len(sum)-1] + last},
+		{"offer", "fingerprint", ""},
+	} {
+		if PAKEVerify(key, tamper[0], tamper[1], tamper[2]) {
+			t.Errorf("tampered mac accepted: %v", tamper)
+		}
+	}
+}
+
+func TestSDPFingerprint(t *testing.T) {
+	sdp := "v=0\r\no=- 1 2 IN IP4 127.0.0.1\r\na=fingerprint:sha-256 AB:CD:EF\r\n"
+	if fp := SDPFingerprint(sdp); fp != "sha-256 ab:cd:ef" {
+		t.Fatalf("fingerprint = %q", fp)
+	}
+	if fp := SDPFingerprint("v=0\r\n"); fp != "" {
+		t.Fatalf("fingerprint = %q, want empty", fp)
+	}
+}
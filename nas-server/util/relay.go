@@ -0,0 +1,71 @@
+/*
+中继通道加密工具
+
+BetaX Blog
+Copyright © 2024 SkyeZhang <skai-zhang@hotmail.com>
+*/
+
+package util
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+)
+
+// 由会话密钥派生单向中继密钥, direction 为发送方 NSC 或 NSB
+func RelayKey(key []byte, direction string) []byte {
+	out, _ := hex.DecodeString(PAKEMac(key, "relay", direction))
+	return out
+}
+
+// 加密中继帧, 格式为 base64(序号 8 字节 + 密文)
+func RelaySeal(key []byte, seq uint64, data []byte) (string, error) {
+	gcm, err := relayCipher(key)
+	if err != nil {
+		return "", err
+	}
+	head := make([]byte, 8)
+	binary.BigEndian.PutUint64(head, seq)
+	frame := gcm.Seal(head, relayNonce(head), data, head)
+	return base64.StdEncoding.EncodeToString(frame), nil
+}
+
+// 解密中继帧, 返回序号与明文
+func RelayOpen(key []byte, frame string) (uint64, []byte, error) {
+	raw, err := base64.StdEncoding.DecodeString(frame)
+	if err != nil {
+		return 0, nil, err
+	}
+	if len(raw) < 8 {
+		return 0, nil, errors.New("relay frame too short")
+	}
+	gcm, err := relayCipher(key)
+	if err != nil {
+		return 0, nil, err
+	}
+	head := raw[:8]
+	data, err := gcm.Open(nil, relayNonce(head), raw[8:], head)
+	if err != nil {
+		return 0, nil, err
+	}
+	return binary.BigEndian.Uint64(head), data, nil
+}
+
+func relayCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// 以序号作为随机数, 同一密钥下不重复
+func relayNonce(head []byte) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce[4:], head)
+	return nonce
+}
@@ -0,0 +1,44 @@
+package util
+
+import (
+	"bytes"
+	"encoding/base64"
+	"testing"
+)
+
+func TestRelaySealOpen(t *testing.T) {
+	key := RelayKey([]byte("session key"), "NSC")
+	if len(key) != 32 {
+		t.Fatalf("relay key = %d bytes, want 32", len(key))
+	}
+	if bytes.Equal(key, RelayKey([]byte("session key"), "NSB")) {
+		t.Fatal("directions share a key")
+	}
+	frame, err := RelaySeal(key, 42, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq, data, err := RelayOpen(key, frame)
+	if err != nil || seq != 42 || string(data) != "hello" {
+		t.Fatalf("RelayOpen = %d, %q, %v", seq, data, err)
+	}
+	// 序号参与认证, 不能被改写
+	raw, _ := base64.StdEncoding.DecodeString(frame)
+	raw[7] ^= 1
+	if _, _, err := RelayOpen(key, base64.StdEncoding.EncodeToString(raw)); err == nil {
+		t.Fatal("rewritten sequence accepted")
+	}
+	raw[7] ^= 1
+	raw[len(raw)-1] ^= 1
+	if _, _, err := RelayOpen(key, base64.StdEncoding.EncodeToString(raw)); err == nil {
+		t.Fatal("tampered frame accepted")
+	}
+	if _, _, err := RelayOpen(RelayKey([]byte("other key"), "NSC"), frame); err == nil {
+		t.Fatal("frame opened with another key")
+	}
+	for _, frame := range []string{"", "AAAA", "not base64!"} {
+		if _, _, err := RelayOpen(key, frame); err == nil {
+			t.Errorf("malformed frame %q accepted", frame)
+		}
+	}
+}
@@ -9,10 +9,10 @@ package util
 
 import (
 	"crypto/md5"
+	"crypto/rand"
 	"encoding/hex"
-	"math/rand"
+	"math/big"
 	"strconv"
-	"time"
 
 	"github.com/gin-gonic/gin"
 )
@@ -25,12 +25,16 @@ func GenerateRandomNumber(length int) string {
 	return GenerateRandom("0123456789", length)
 }
 
+// 使用 crypto/rand 生成随机字符串, 可用于密钥与编号
 func GenerateRandom(charset string, length int) string {
-	source := rand.NewSource(time.Now().UnixNano())
-	random := rand.New(source)
+	max := big.NewInt(int64(len(charset)))
 	result := make([]byte, length)
 	for i := 0; i < length; i++ {
-		result[i] = charset[random.Intn(len(charset))]
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		result[i] = charset[n.Int64()]
 	}
 	return string(result)
 }
@@ -3,6 +3,7 @@ export interface NSPluginSettings {
 	server: string;
 	devId: string;
 	pwd: string;
+	token: string;
 	lastSync: number;
 	stunMain: string;
 	stunBackup: string;
@@ -13,6 +14,7 @@ export const NSDefaultSettings: NSPluginSettings = {
 	server: 'ons.betax.dev',
 	devId: '',
 	pwd: '',
+	token: '',
 	lastSync: 0,
 	stunMain: 'stun:stun.l.google.com:19302',
 	stunBackup: 'stun:stun.nextcloud.com:443'
@@ -0,0 +1,148 @@
+// 口令认证密钥交换 (SPAKE2), 与 nas-server/util/pake.go 对应
+
+// RFC 3526 2048位 MODP 群
+const PRIME_HEX = 'FFFFFFFFFFFFFFFFC90FDAA22168C234C4C6628B80DC1CD1' +
+  '29024E088A67CC74020BBEA63B139B22514A08798E3404DD' +
+  'EF9519B3CD3A431B302B0A6DF25F14374FE1356D6D51C245' +
+  'E485B576625E7EC6F44C42E9A637ED6B0BFF5CB6F406B7ED' +
+  'EE386BFB5A899FA5AE9F24117C4B1FE649286651ECE45B3D' +
+  'C2007CB8A163BF0598DA48361C55D39A69163FA8FD24CF5F' +
+  '83655D23DCA3AD961C62F356208552BB9ED529077096966D' +
+  '670C354E4ABC9804F1746C08CA18217C32905E462E36CE3B' +
+  'E39E772C180E86039B2783A2EC07A28FB5C55DF06F4C52C9' +
+  'DE2BCBF6955817183995497CEA956AE515D2261898FA0510' +
+  '15728E5A8AACAA68FFFFFFFFFFFFFFFF';
+
+const SIZE = 256;
+const P = BigInt('0x' + PRIME_HEX);
+const Q = P >> BigInt(1);
+const G = BigInt(2);
+const encoder = new TextEncoder();
+
+function modPow(base: bigint, exp: bigint, mod: bigint): bigint {
+  let result = BigInt(1);
+  base %= mod;
+  while (exp > BigInt(0)) {
+    if (exp & BigInt(1)) result = (result * base) % mod;
+    base = (base * base) % mod;
+    exp >>= BigInt(1);
+  }
+  return result;
+}
+
+function toHex(bytes: Uint8Array): string {
+  return Array.from(bytes, b => b.toString(16).padStart(2, '0')).join('');
+}
+
+function toBytes(v: bigint): Uint8Array {
+  const hex = v.toString(16).padStart(SIZE * 2, '0');
+  const out = new Uint8Array(SIZE);
+  for (let i = 0; i < SIZE; i++) out[i] = parseInt(hex.substring(i * 2, i * 2 + 2), 16);
+  return out;
+}
+
+function fromBytes(bytes: Uint8Array): bigint {
+  return bytes.length === 0 ? BigInt(0) : BigInt('0x' + toHex(bytes));
+}
+
+function concat(parts: Uint8Array[]): Uint8Array {
+  const out = new Uint8Array(parts.reduce((n, p) => n + p.length, 0));
+  let offset = 0;
+  for (const p of parts) {
+    out.set(p, offset);
+    offset += p.length;
+  }
+  return out;
+}
+
+async function sha256(data: Uint8Array): Promise<Uint8Array> {
+  return new Uint8Array(await crypto.subtle.digest('SHA-256', data));
+}
+
+async function hmac(key: Uint8Array, data: string): Promise<string> {
+  const k = await crypto.subtle.importKey('raw', key, { name: 'HMAC', hash: 'SHA-256' }, false, ['sign']);
+  return toHex(new Uint8Array(await crypto.subtle.sign('HMAC', k, encoder.encode(data))));
+}
+
+// 将标签映射为离散对数未知的群元素
+async function hashToGroup(label: string): Promise<bigint> {
+  const parts: Uint8Array[] = [];
+  for (let i = 0; parts.length * 32 < SIZE + 32; i++) {
+    parts.push(await sha256(concat([encoder.encode(label), new Uint8Array([i])])));
+  }
+  const v = fromBytes(concat(parts)) % P;
+  return modPow(v, BigInt(2), P);
+}
+
+// 由口令派生 SPAKE2 秘密
+async function secret(id: string, password: string): Promise<bigint> {
+  return fromBytes(await sha256(encoder.encode('ONS-SPAKE2-W\x00' + id + '\x00' + password))) % Q;
+}
+
+// 提取 SDP 中的 DTLS 证书指纹
+export function sdpFingerprint(sdp: string | undefined): string {
+  for (const line of (sdp || '').split('\n')) {
+    const item = line.trim();
+    if (item.startsWith('a=fingerprint:')) return item.substring('a=fingerprint:'.length).toLowerCase();
+  }
+  return '';
+}
+
+// 发起方(NSC)口令认证
+export class PAKE {
+  private w: bigint;
+  private x: bigint;
+  private key: Uint8Array | null = null;
+  // 发送给 NSB 的交换值
+  public X: string;
+
+  static async create(id: string, password: string): Promise<PAKE> {
+    const random = crypto.getRandomValues(new Uint8Array(SIZE + 16));
+    return PAKE.withScalar(id, password, fromBytes(random) % (Q - BigInt(1)) + BigInt(1));
+  }
+
+  // 使用给定随机数创建, 仅用于已知答案测试
+  static async withScalar(id: string, password: string, x: bigint): Promise<PAKE> {
+    const pake = new PAKE();
+    pake.w = await secret(id, password);
+    pake.x = x;
+    const M = await hashToGroup('ONS-SPAKE2-M');
+    const X = (modPow(G, pake.x, P) * modPow(M, pake.w, P)) % P;
+    pake.X = toHex(toBytes(X));
+    return pake;
+  }
+
+  // 处理 NSB 响应, 校验通过返回 true
+  async finish(idA: string, idB: string, yHex: string, confirm: string): Promise<boolean> {
+    if (!/^[0-9a-f]+$/i.test(yHex || '')) return false;
+    const Y = BigInt('0x' + yHex);
+    if (Y <= BigInt(1) || Y >= P - BigInt(1) || modPow(Y, Q, P) !== BigInt(1)) return false;
+    const N = await hashToGroup('ONS-SPAKE2-N');
+    const nw = modPow(N, this.w, P);
+    const Z = modPow((Y * modPow(nw, P - BigInt(2), P)) % P, this.x, P);
+    const parts = [
+      encoder.encode('ONS-SPAKE2'), encoder.encode(idA), encoder.encode(idB),
+      toBytes(BigInt('0x' + this.X)), toBytes(Y), toBytes(Z), toBytes(this.w)
+    ];
+    const framed: Uint8Array[] = [];
+    for (const part of parts) {
+      const size = new Uint8Array(8);
+      new DataView(size.buffer).setBigUint64(0, BigInt(part.length));
+      framed.push(size, part);
+    }
+    this.key = await sha256(concat(framed));
+    return (await this.mac('confirm', idB)) === (confirm || '').toLowerCase();
+  }
+
+  // 派生单向中继密钥, direction 为发送方 NSC 或 NSB
+  async relayKey(direction: string): Promise<Uint8Array> {
+    const hex = await this.mac('relay', direction);
+    return new Uint8Array((hex.match(/../g) || []).map(b => parseInt(b, 16)));
+  }
+
+  // 使用会话密钥计算消息认证码
+  async mac(label: string, data: string): Promise<string> {
+    if (this.key == null) return '';
+    return hmac(this.key, label + '|' + data);
+  }
+}
@@ -1,5 +1,7 @@
 import { arrayBufferToBase64, base64ToArrayBuffer, Notice, TAbstractFile, TFile, TFolder, Vault } from 'obsidian';
 import NSPlugin from 'main';
+import { PAKE, sdpFingerprint } from './pake';
+import { RelayChannel } from './relay';
 
 // 消息模型
 interface Message {
@@ -12,7 +14,7 @@ interface Message {
 
 interface SyncMessage {
   type: 'text' | 'binary' | 'directory' | undefined; // 消息类型
-  operate: 'create' | 'delete' | 'update' | 'rename' | 'check' | 'tree' | 'tree-none' | undefined; // 操作类型
+  operate: 'create' | 'delete' | 'update' | 'rename' | 'check' | 'tree' | 'tree-none' | 'error' | undefined; // 操作类型
   path: string | undefined; // 所在路径
   name: string | undefined; // 对象名称
   data: string | undefined | null; // 实际数据
@@ -32,10 +34,20 @@ export class PeerManager {
   private nabId: string;
   // NAS连接密码
   private pass: string;
+  // 中控设备访问令牌
+  private token: string;
+  // 口令认证会话
+  private pake: PAKE | null = null;
   // 点对点连接
   private p2pCon: RTCPeerConnection;
-  // 数据通道
-  private channel: RTCDataChannel;
+  // 数据通道, WebRTC 无法建立时为中继通道
+  private channel: RTCDataChannel | RelayChannel;
+  // 等待数据通道打开, 超时后改用中继
+  private relayTimer: NodeJS.Timeout;
+  // 连接中断后等待自行恢复, 超时后重启 ICE
+  private iceTimer: NodeJS.Timeout;
+  // 已发起的 ICE 重启次数
+  private iceRestarts = 0;
   // 添加一个候选队列
   private iceCandidateQueue: RTCIceCandidateInit[] = [];
   // 构造函数
@@ -45,12 +57,10 @@ export class PeerManager {
     this.nsaPath = 'wss://' + app.settings.server + '/nat';
     this.nabId = app.settings.devId;
     this.pass = app.settings.pwd;
+    this.token = app.settings.token;
     // 创建点对点连接
     this.p2pCon = new RTCPeerConnection({
-      iceServers: [
-        { urls: 'stun:stun.l.google.com:19302' },
-        { urls: 'stun:stun.nextcloud.com:443' }
-      ],
+      iceServers: this.iceServers(app)
     });
     // 第一步 生成本地描述信息
     this.settingLocalInfo(app, app.app.vault)
@@ -70,15 +80,18 @@ export class PeerManager {
     this.p2pCon.onicecandidate = (event) => {
       if (event.candidate) {
         // console.log('网络节点信息', event.candidate);
-        if (this.p2pCon.localDescription && this.p2pCon.remoteDescription) {
-          const candidateMsg: Message = {
-            event: 'p2p-node',
-            to: this.nabId,
-            from: 'NSC',
-            data: event.candidate,
-            pass: this.pass
-          };
-          this.sendMessage(candidateMsg);
+        if (this.p2pCon.localDescription && this.p2pCon.remoteDescription && this.pake) {
+          const candidate = event.candidate;
+          this.pake.mac('node', candidate.candidate).then(pass => {
+            const candidateMsg: Message = {
+              event: 'p2p-node',
+              to: this.nabId,
+              from: 'NSC',
+              data: candidate,
+              pass
+            };
+            this.sendMessage(candidateMsg);
+          });
         } else {
           // console.log('等待描述设置完成再发送候选');
         }
@@ -86,10 +99,21 @@ export class PeerManager {
     };
     this.p2pCon.oniceconnectionstatechange = () => {
       // console.log('连接状态更新:', this.p2pCon.iceConnectionState);
-      if (this.p2pCon.iceConnectionState === 'disconnected') {
-        new Notice("⛓️‍💥 NAS 连接已断开");
-        app.status.setText('🟡 NAS 已断开');
-        this.reConnect(app)
+      const state = this.p2pCon.iceConnectionState;
+      if (state === 'failed') {
+        this.restartICE(app, vault)
+      } else if (state === 'disconnected') {
+        // 切换网络时连接会先中断, 稍后仍未恢复再重启 ICE
+        app.status.setText('🟡 NAS 连接中断, 正在恢复');
+        clearTimeout(this.iceTimer)
+        this.iceTimer = setTimeout(() => {
+          if (this.p2pCon.iceConnectionState === 'disconnected') this.restartICE(app, vault)
+        }, 5000)
+      } else if ((state === 'connected' || state === 'completed') && this.iceRestarts > 0) {
+        clearTimeout(this.iceTimer)
+        this.iceRestarts = 0
+        app.status.setText('🟢 NAS 已连接');
+        new Notice("🚀 NAS 连接已恢复");
       }
     };
 
@@ -102,37 +126,110 @@ export class PeerManager {
       const dataChannel = event.channel;
       dataChannel.onopen = () => {
         clearTimeout(this.reConnectTimer)
+        clearTimeout(this.relayTimer)
         this.reConnectNumber = 0
         app.status.setText('🟢 NAS 已连接');
         new Notice("🚀 NAS 已连接");
       };
-      dataChannel.onmessage = (event) => {
-        let msg: SyncMessage = JSON.parse(event.data)
-        // console.log('收到数据:', msg);
-
-        if (msg.operate === 'tree') this.handleTree(app, vault, msg)
-        else if (msg.operate === 'tree-none') {
-          new Notice("😆 同步结束, 数据已是最新");
-          this.syncOver();
-        }
-        else if (msg.operate === 'create') this.handleCreate(app, vault, msg)
-        else if (msg.operate === 'delete') this.handleDelete(app, vault, msg)
-        else if (msg.operate === 'update') this.handleUpdate(app, vault, msg)
-      };
+      dataChannel.onmessage = (event) => this.handleSync(app, vault, event.data);
     };
   }
 
+  // 处理 NAS 发来的同步消息
+  private handleSync(app: NSPlugin, vault: Vault, data: string) {
+    let msg: SyncMessage = JSON.parse(data)
+    // console.log('收到数据:', msg);
+
+    if (msg.operate === 'tree') this.handleTree(app, vault, msg)
+    else if (msg.operate === 'tree-none') {
+      new Notice("😆 同步结束, 数据已是最新");
+      this.syncOver();
+    }
+    else if (msg.operate === 'create') this.handleCreate(app, vault, msg)
+    else if (msg.operate === 'delete') this.handleDelete(app, vault, msg)
+    else if (msg.operate === 'update') this.handleUpdate(app, vault, msg)
+    else if (msg.operate === 'error') {
+      // NAS 拒绝了越权或路径非法的修改
+      const target = msg.name ? (msg.path ? msg.path + '/' : '') + msg.name : msg.path;
+      new Notice("🚫 NAS 拒绝修改 " + target + (msg.data === 'permission denied' ? ", 无写入权限" : ", 路径非法"));
+    }
+  }
+
+  // 连接中断后重启 ICE, 多次失败后改用中继
+  private async restartICE(app: NSPlugin, vault: Vault) {
+    clearTimeout(this.iceTimer)
+    if (this.channel instanceof RelayChannel) return;
+    if (this.pake == null) {
+      new Notice("⛓️‍💥 NAS 连接已断开");
+      app.status.setText('🟡 NAS 已断开');
+      this.reConnect(app)
+      return
+    }
+    if (this.iceRestarts >= 2) {
+      this.useRelay(app, vault)
+      return
+    }
+    this.iceRestarts++
+    app.status.setText('🟡 NAS 连接中断, 正在恢复');
+    const offer = await this.p2pCon.createOffer({ iceRestart: true });
+    await this.p2pCon.setLocalDescription(offer);
+    this.sendLocalInfo(app);
+  }
+
+  // 接受 NSB 发起的 ICE 重启
+  private async acceptRestart(app: NSPlugin, data: any) {
+    // 双方同时发起时以本端提议为准, NSB 会回退
+    if (this.p2pCon.signalingState !== 'stable') return;
+    await this.p2pCon.setRemoteDescription(new RTCSessionDescription(data.sdp));
+    const answer = await this.p2pCon.createAnswer();
+    await this.p2pCon.setLocalDescription(answer);
+    this.sendLocalInfo(app);
+  }
+
+  // WebRTC 无法建立时改由 NSA 转发加密数据
+  private useRelay(app: NSPlugin, vault: Vault) {
+    clearTimeout(this.relayTimer)
+    const state = this.p2pCon.iceConnectionState;
+    if (this.pake == null || this.channel instanceof RelayChannel || state === 'connected' || state === 'completed') return;
+    const relay = new RelayChannel(this.pake, frame => this.sendMessage({
+      event: 'relay-data',
+      to: this.nabId,
+      from: 'NSC',
+      data: frame
+    }));
+    relay.onmessage = data => this.handleSync(app, vault, data);
+    this.channel = relay;
+    clearTimeout(this.reConnectTimer)
+    this.reConnectNumber = 0
+    app.status.setText('🟠 NAS 已连接 (中继)');
+    new Notice("🚀 NAS 已连接, 当前网络无法直连, 数据将加密后经中控转发");
+  }
+
+  // 本地配置的 ICE 服务器
+  private iceServers(app: NSPlugin): RTCIceServer[] {
+    let iceServers: RTCIceServer[] = [];
+    if (app.settings.stunMain != '') iceServers.push({urls:app.settings.stunMain})
+    if (app.settings.stunBackup != '') iceServers.push({urls:app.settings.stunBackup})
+    return iceServers
+  }
+
+  // 合并 NSA 下发的 ICE 服务器, 并以新配置重新收集节点
+  private async applyICEServers(servers: any) {
+    if (!Array.isArray(servers) || servers.length == 0) return;
+    const config = this.p2pCon.getConfiguration();
+    this.p2pCon.setConfiguration({ ...config, iceServers: [...(config.iceServers || []), ...servers] });
+    const offer = await this.p2pCon.createOffer({ iceRestart: true });
+    await this.p2pCon.setLocalDescription(offer);
+  }
+
   private reConnect(app: NSPlugin){
     if (this.reConnectNumber < 3) {
       clearTimeout(this.reConnectTimer)
       this.reConnectTimer = setTimeout(() => {
         this.reConnectNumber++
         new Notice("第"+this.reConnectNumber+"次尝试重新连接...");
-        let iceServers = [];
-        if (app.settings.stunMain != '') iceServers.push({urls:app.settings.stunMain})
-        if (app.settings.stunBackup != '') iceServers.push({urls:app.settings.stunBackup})
         this.p2pCon = new RTCPeerConnection({
-          iceServers
+          iceServers: this.iceServers(app)
         });
         this.settingLocalInfo(app, app.app.vault)
         this.nsa = this.connectnsa(app);
@@ -310,12 +407,24 @@ export class PeerManager {
       // console.log('收到 NSA 消息:', message);
       // 连接注册响应
       if (message.event === 'connect') {
-        // 第四步 发送本地连接信息
-        this.sendLocalInfo()
+        this.updateNATId(app, message.data?.natId)
+        // 第四步 发起口令认证
+        this.applyICEServers(message.data?.iceServers).finally(() => this.startPAKE())
+      } else if (message.event === 'pake-reply') {
+        // 第四步 认证通过后发送本地连接信息
+        this.finishPAKE(app, message.data)
+      } else if (message.event === 'p2p-exchange' && message.data?.sdp?.type === 'offer') {
+        // NSB 发起的 ICE 重启
+        this.checkRemote(app, 'restart', sdpFingerprint(message.data?.sdp?.sdp), message.pass)
+          .then(ok => ok && this.acceptRestart(app, message.data));
       } else if (message.event === 'p2p-exchange') {
-        this.setRemoteInfo(message.data);
+        this.checkRemote(app, 'answer', sdpFingerprint(message.data?.sdp?.sdp), message.pass)
+          .then(ok => ok && this.setRemoteInfo(message.data));
       } else if (message.event === 'p2p-node') {
-        this.setNodeInfo(message.data);
+        this.checkRemote(app, 'node', message.data?.candidate, message.pass)
+          .then(ok => ok && this.setRemoteInfo(message.data));
+      } else if (message.event === 'relay-data') {
+        if (this.channel instanceof RelayChannel) this.channel.receive(message.data);
       } else if (message.event === 'p2p-error' || message.event === 'error') {
         this.outError(app, message.data);
       }
@@ -325,22 +434,69 @@ export class PeerManager {
     return nsa;
   }
 
+  // 旧版 NAT.ID 已升级时改用 NSA 返回的当前编号
+  private updateNATId(app: NSPlugin, natId: string | undefined) {
+    if (!natId || natId === this.nabId) return;
+    this.nabId = natId;
+    app.settings.devId = natId;
+    app.saveSettings();
+    new Notice("NAT.ID 已升级为 " + natId);
+  }
+
   // 第三步 在 NSA 上注册连接
   private register() {
-    const connectMsg: Message = { event: 'connect', to: this.nabId, from: 'NSC', data: '' };
+    const connectMsg: Message = { event: 'connect', to: this.nabId, from: 'NSC', data: '', pass: this.token };
     this.sendMessage(connectMsg);
   }
 
+  // 第四步 发起口令认证
+  private async startPAKE() {
+    // 设备访问密钥格式为 编号.密钥, 否则视为共享连接密码
+    const split = this.pass.indexOf('.');
+    const kid = split > 0 ? this.pass.substring(0, split) : '';
+    this.pake = kid === ''
+      ? await PAKE.create(this.nabId, this.pass)
+      : await PAKE.create(this.nabId + '/' + kid, this.pass.substring(split + 1));
+    const msg: Message = {
+      event: 'pake-init',
+      to: this.nabId,
+      from: 'NSC',
+      data: { kid, x: this.pake.X }
+    };
+    this.sendMessage(msg);
+  }
+
+  // 第四步 校验 NSB 响应
+  private async finishPAKE(app: NSPlugin, data: any) {
+    if (this.pake == null || !(await this.pake.finish('NSC', this.nabId, data?.y, data?.confirm))) {
+      this.pake = null;
+      this.outError(app, 'password error');
+      return;
+    }
+    this.sendLocalInfo(app);
+  }
+
+  // 校验 NSB 消息与会话密钥的绑定
+  private async checkRemote(app: NSPlugin, label: string, data: string, pass: string | undefined) {
+    if (this.pake != null && data && (await this.pake.mac(label, data)) === pass) return true;
+    if (label !== 'node') this.outError(app, 'password error');
+    return false;
+  }
+
   // 第四步 发送本地连接信息
-  public async sendLocalInfo() {
+  public async sendLocalInfo(app: NSPlugin) {
+    if (this.pake == null) return;
     const msg: Message = {
       event: 'p2p-exchange',
       to: this.nabId,
       from: 'NSC',
       data: this.p2pCon.localDescription,
-      pass: this.pass
+      pass: await this.pake.mac('offer', sdpFingerprint(this.p2pCon.localDescription?.sdp))
     };
     this.sendMessage(msg);
+    // 数据通道迟迟未打开时改用中继
+    clearTimeout(this.relayTimer)
+    this.relayTimer = setTimeout(() => this.useRelay(app, app.app.vault), 15000)
   }
 
   // 第五步 设置远程连接信息
@@ -379,6 +535,10 @@ export class PeerManager {
         app.status.setText('连接密码错误');
         msg = '连接密码错误'
         break
+      case 'too many attempts':
+        app.status.setText('连接已被锁定');
+        msg = '密码错误次数过多, 请稍后再试'
+        break
       case 10001:
         app.status.setText('连接失败');
         msg = '协议无法对齐'
@@ -403,6 +563,18 @@ export class PeerManager {
       case 10007:
         msg = '不支持的消息格式'
         break
+      case 10013:
+        app.status.setText('🔴 中控未授权');
+        msg = '中控访问令牌无效, 请在中控“我的设备”中重新生成'
+        break
+      case 10014:
+        app.status.setText('🔴 中控未授权');
+        msg = '无权连接该设备'
+        break
+      case 10015:
+        app.status.setText('🔴 请求过于频繁');
+        msg = '请求过于频繁, 请稍后再试'
+        break
       case 10008:
         app.status.setText('🔴 NAS 已离线');
         msg = 'NAS 已离线'
@@ -533,6 +705,8 @@ export class PeerManager {
   }
 
   close() {
+    clearTimeout(this.relayTimer)
+    clearTimeout(this.iceTimer)
     this.channel.close()
     this.p2pCon.close()
     this.nsa.close()
@@ -0,0 +1,76 @@
+// 经 NSA 转发的加密中继通道, 与 nas-server/core/transport.go 对应
+import { PAKE } from './pake';
+
+const encoder = new TextEncoder();
+const decoder = new TextDecoder();
+
+function toBase64(bytes: Uint8Array): string {
+  let out = '';
+  for (let i = 0; i < bytes.length; i++) out += String.fromCharCode(bytes[i]);
+  return btoa(out);
+}
+
+function fromBase64(data: string): Uint8Array {
+  return Uint8Array.from(atob(data), c => c.charCodeAt(0));
+}
+
+// 以序号作为随机数, 同一密钥下不重复
+function nonce(head: Uint8Array): Uint8Array {
+  const out = new Uint8Array(12);
+  out.set(head, 4);
+  return out;
+}
+
+export class RelayChannel {
+  public readyState: 'open' | 'closed' = 'open';
+  public onmessage: ((data: string) => void) | null = null;
+  private sendKey: Promise<CryptoKey>;
+  private recvKey: Promise<CryptoKey>;
+  private sendSeq = BigInt(0);
+  private recvSeq = BigInt(0);
+  // 保证加解密按顺序完成
+  private sendQueue: Promise<void> = Promise.resolve();
+  private recvQueue: Promise<void> = Promise.resolve();
+
+  constructor(pake: PAKE, private post: (frame: string) => void) {
+    const importKey = async (direction: string) => crypto.subtle.importKey(
+      'raw', await pake.relayKey(direction), { name: 'AES-GCM' }, false, ['encrypt', 'decrypt']);
+    this.sendKey = importKey('NSC');
+    this.recvKey = importKey('NSB');
+  }
+
+  send(text: string) {
+    if (this.readyState !== 'open') return;
+    this.sendSeq += BigInt(1);
+    const seq = this.sendSeq;
+    this.sendQueue = this.sendQueue.then(async () => {
+      const head = new Uint8Array(8);
+      new DataView(head.buffer).setBigUint64(0, seq);
+      const sealed = new Uint8Array(await crypto.subtle.encrypt(
+        { name: 'AES-GCM', iv: nonce(head), additionalData: head }, await this.sendKey, encoder.encode(text)));
+      const frame = new Uint8Array(8 + sealed.length);
+      frame.set(head);
+      frame.set(sealed, 8);
+      this.post(toBase64(frame));
+    }).catch(error => console.error('中继数据加密失败:', error));
+  }
+
+  // 处理 NSB 发来的中继帧, 拒绝重放
+  receive(frame: string) {
+    this.recvQueue = this.recvQueue.then(async () => {
+      const raw = fromBase64(frame);
+      if (raw.length < 8) return;
+      const head = raw.slice(0, 8);
+      const seq = new DataView(head.buffer).getBigUint64(0);
+      if (seq <= this.recvSeq) return;
+      const data = await crypto.subtle.decrypt(
+        { name: 'AES-GCM', iv: nonce(head), additionalData: head }, await this.recvKey, raw.slice(8));
+      this.recvSeq = seq;
+      if (this.onmessage) this.onmessage(decoder.decode(data));
+    }).catch(error => console.error('中继数据解密失败:', error));
+  }
+
+  close() {
+    this.readyState = 'closed';
+  }
+}
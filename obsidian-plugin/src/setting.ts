@@ -34,9 +34,19 @@ export class NSSettingTab extends PluginSettingTab {
 					this.plugin.settings.devId = value;
 					await this.plugin.saveSettings();
 				}));
+		new Setting(containerEl)
+			.setName('Access token')
+			.setDesc('中控设备访问令牌, 在中控“我的设备”中生成')
+			.addText(text => text
+				.setPlaceholder('eyJhbGciOi...')
+				.setValue(this.plugin.settings.token)
+				.onChange(async (value) => {
+					this.plugin.settings.token = value;
+					await this.plugin.saveSettings();
+				}));
 		new Setting(containerEl)
 			.setName('Connection password')
-			.setDesc('连接密码')
+			.setDesc('连接密码或设备访问密钥')
 			.addText(text => text
 				.setPlaceholder('8-24位')
 				.setValue(this.plugin.settings.pwd)
@@ -0,0 +1,52 @@
+// SPAKE2 已知答案测试, 向量与 nas-server/util/pake_test.go 共用
+import { test } from 'node:test';
+import assert from 'node:assert/strict';
+import { readFileSync } from 'node:fs';
+import { resolve } from 'node:path';
+import { PAKE } from '../src/pake';
+
+interface Exchange {
+  name: string;
+  id: string;
+  password: string;
+  idA: string;
+  idB: string;
+  x: string;
+  X: string;
+  Y: string;
+  confirm: string;
+  relayNSC: string;
+  relayNSB: string;
+}
+
+const vectors: { exchanges: Exchange[]; invalid: string[] } = JSON.parse(
+  readFileSync(resolve(__dirname, '../../../nas-server/util/testdata/pake_vectors.json'), 'utf8')
+);
+
+function toHex(bytes: Uint8Array): string {
+  return Array.from(bytes, b => b.toString(16).padStart(2, '0')).join('');
+}
+
+for (const v of vectors.exchanges) {
+  test('known answer: ' + v.name, async () => {
+    const pake = await PAKE.withScalar(v.id, v.password, BigInt('0x' + v.x));
+    assert.equal(pake.X, v.X);
+    assert.ok(await pake.finish(v.idA, v.idB, v.Y, v.confirm), 'confirm rejected');
+    assert.equal(toHex(await pake.relayKey('NSC')), v.relayNSC);
+    assert.equal(toHex(await pake.relayKey('NSB')), v.relayNSB);
+  });
+
+  test('wrong password: ' + v.name, async () => {
+    const pake = await PAKE.withScalar(v.id, v.password + '!', BigInt('0x' + v.x));
+    assert.notEqual(pake.X, v.X);
+    assert.equal(await pake.finish(v.idA, v.idB, v.Y, v.confirm), false);
+  });
+}
+
+test('rejects invalid responses', async () => {
+  const v = vectors.exchanges[0];
+  for (const y of [...vectors.invalid, '', 'zz']) {
+    const pake = await PAKE.withScalar(v.id, v.password, BigInt('0x' + v.x));
+    assert.equal(await pake.finish(v.idA, v.idB, y, v.confirm), false, 'accepted Y = ' + y);
+  }
+});